@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/graphext/metahelm/pkg/dag"
+	"github.com/pkg/errors"
+)
+
+// FieldChange is a changed field of a chart definition present in both graphs
+type FieldChange struct {
+	Chart string `json:"chart"`
+	Field string `json:"field"` // YAML key (nested keys are joined with dots, eg helm.atomic)
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// GraphComparison is the output of plan --compare
+type GraphComparison struct {
+	*dag.GraphDiff
+	FieldChanges []FieldChange `json:"field_changes"`
+}
+
+// compareGraphFiles compares the graph definitions in the files oldf and newf (rendered with tv, with the charts disabled by its variables
+// removed)
+func compareGraphFiles(oldf, newf string, tv templateVars) (*GraphComparison, error) {
+	load := func(f string) (*dag.ObjectGraph, []ChartDefinition, error) {
+		gd, _, err := readAndValidateFile(f, validate, tv)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error reading %v", f)
+		}
+		objs := []dag.GraphObject{}
+		for i := range gd.Charts {
+			objs = append(objs, cdNode{cd: &gd.Charts[i]})
+		}
+		og := &dag.ObjectGraph{}
+		if err := og.Build(objs); err != nil {
+			return nil, nil, errors.Wrapf(err, "error building graph of %v", f)
+		}
+		relativizeChartFilesPath(gd.Charts, filepath.Dir(f))
+		return og, gd.Charts, nil
+	}
+	oog, ocds, err := load(oldf)
+	if err != nil {
+		return nil, err
+	}
+	nog, ncds, err := load(newf)
+	if err != nil {
+		return nil, err
+	}
+	gc := &GraphComparison{GraphDiff: dag.Compare(oog, nog), FieldChanges: []FieldChange{}}
+	om := map[string]ChartDefinition{}
+	for _, cd := range ocds {
+		om[cd.Name] = cd
+	}
+	for _, cd := range ncds {
+		if ocd, ok := om[cd.Name]; ok {
+			gc.FieldChanges = append(gc.FieldChanges, chartFieldChanges(cd.Name, ocd, cd)...)
+		}
+	}
+	sort.SliceStable(gc.FieldChanges, func(i, j int) bool { return gc.FieldChanges[i].Chart < gc.FieldChanges[j].Chart })
+	return gc, nil
+}
+
+// relativizeChartFilesPath undoes expandChartFilesPath for the paths within baseDir, so that graph files in different directories
+// (eg, a copy of the old version in a temporary directory) compare equal
+func relativizeChartFilesPath(charts []ChartDefinition, baseDir string) {
+	rel := func(p string) string {
+		if r, err := filepath.Rel(baseDir, p); err == nil && !strings.HasPrefix(r, "..") {
+			return r
+		}
+		return p
+	}
+	for i := range charts {
+		c := &charts[i]
+		if c.ValuesPath != "" {
+			c.ValuesPath = rel(c.ValuesPath)
+		}
+		for j := range c.ValuesFrom {
+			if c.ValuesFrom[j].SOPS != "" {
+				c.ValuesFrom[j].SOPS = rel(c.ValuesFrom[j].SOPS)
+			}
+		}
+		if c.Path != "" && !c.remote() {
+			c.Path = rel(c.Path)
+		}
+		if c.JobPath != "" {
+			c.JobPath = rel(c.JobPath)
+		}
+	}
+}
+
+// chartFieldChanges returns the fields that differ between two definitions of a chart. Dependencies are compared as graph edges instead.
+func chartFieldChanges(name string, old, new ChartDefinition) []FieldChange {
+	out := []FieldChange{}
+	// prefix is the YAML key of the value followed by a dot (nested keys are joined)
+	var compare func(prefix string, ov, nv reflect.Value)
+	compare = func(prefix string, ov, nv reflect.Value) {
+		if ov.Kind() == reflect.Ptr {
+			if ov.IsNil() && nv.IsNil() {
+				return
+			}
+			// compare against the zero value so that each set field is listed
+			if ov.IsNil() {
+				ov = reflect.New(ov.Type().Elem())
+			}
+			if nv.IsNil() {
+				nv = reflect.New(nv.Type().Elem())
+			}
+			ov, nv = ov.Elem(), nv.Elem()
+		}
+		if ov.Kind() == reflect.Struct {
+			t := ov.Type()
+			for i := 0; i < t.NumField(); i++ {
+				k := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+				if k == "" || k == "-" || (prefix == "" && k == "dependencies") {
+					continue
+				}
+				compare(prefix+k+".", ov.Field(i), nv.Field(i))
+			}
+			return
+		}
+		// lists of structs (eg, values_from) are compared by index, with missing items as zero values
+		if ov.Kind() == reflect.Slice && ov.Type().Elem().Kind() == reflect.Struct {
+			zero := reflect.New(ov.Type().Elem()).Elem()
+			for i := 0; i < ov.Len() || i < nv.Len(); i++ {
+				oe, ne := zero, zero
+				if i < ov.Len() {
+					oe = ov.Index(i)
+				}
+				if i < nv.Len() {
+					ne = nv.Index(i)
+				}
+				compare(fmt.Sprintf("%v%v.", prefix, i), oe, ne)
+			}
+			return
+		}
+		if reflect.DeepEqual(ov.Interface(), nv.Interface()) {
+			return
+		}
+		out = append(out, FieldChange{Chart: name, Field: strings.TrimSuffix(prefix, "."), Old: fieldString(ov), New: fieldString(nv)})
+	}
+	compare("", reflect.ValueOf(old), reflect.ValueOf(new))
+	return out
+}
+
+// fieldString formats a chart definition field value
+func fieldString(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Slice:
+		s := []string{}
+		for i := 0; i < v.Len(); i++ {
+			s = append(s, fmt.Sprintf("%v", v.Index(i).Interface()))
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+// displayComparison writes a graph comparison as text
+func displayComparison(w io.Writer, gc *GraphComparison) {
+	if gc.Empty() && len(gc.FieldChanges) == 0 {
+		fmt.Fprintf(w, "No changes\n")
+		return
+	}
+	for _, n := range gc.AddedNodes {
+		fmt.Fprintf(w, "+ chart %v\n", n)
+	}
+	for _, n := range gc.RemovedNodes {
+		fmt.Fprintf(w, "- chart %v\n", n)
+	}
+	edge := func(e dag.Edge) string {
+		if len(e.Qualifiers) > 0 {
+			return fmt.Sprintf("%v -> %v (%v)", e.From, e.To, strings.Join(e.Qualifiers, ","))
+		}
+		return fmt.Sprintf("%v -> %v", e.From, e.To)
+	}
+	for _, e := range gc.AddedEdges {
+		fmt.Fprintf(w, "+ dependency %v\n", edge(e))
+	}
+	for _, e := range gc.RemovedEdges {
+		fmt.Fprintf(w, "- dependency %v\n", edge(e))
+	}
+	quals := func(qs []string) string {
+		if len(qs) == 0 {
+			return "none"
+		}
+		return strings.Join(qs, ",")
+	}
+	for _, qc := range gc.QualifierChanges {
+		fmt.Fprintf(w, "~ dependency %v -> %v: qualifiers %v => %v\n", qc.From, qc.To, quals(qc.Old), quals(qc.New))
+	}
+	for _, pc := range gc.PhaseChanges {
+		fmt.Fprintf(w, "~ chart %v: phase %v => %v\n", pc.Name, pc.Old, pc.New)
+	}
+	for _, fc := range gc.FieldChanges {
+		fmt.Fprintf(w, "~ chart %v: %v: %q => %q\n", fc.Chart, fc.Field, fc.Old, fc.New)
+	}
+}
+
+// marshalComparison returns a graph comparison as JSON
+func marshalComparison(gc *GraphComparison) ([]byte, error) {
+	b, err := json.MarshalIndent(gc, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling comparison")
+	}
+	return append(b, '\n'), nil
+}
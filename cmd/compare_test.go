@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompareGraphFiles(t *testing.T) {
+	base := "charts:\n  - name: db\n    path: ./c\n    values_path: values/db.yaml\n  - name: app\n    path: ./c\n    timeout: 5m\n    dependencies: [db]\n"
+	cases := []struct {
+		name    string
+		new     string
+		changes []FieldChange
+		edges   bool // dependencies changed
+	}{
+		{
+			name:    "same graph in another directory",
+			new:     base,
+			changes: []FieldChange{},
+		},
+		{
+			name:    "timeout",
+			new:     "charts:\n  - name: db\n    path: ./c\n    values_path: values/db.yaml\n  - name: app\n    path: ./c\n    timeout: 10m\n    dependencies: [db]\n",
+			changes: []FieldChange{{Chart: "app", Field: "timeout", Old: "5m", New: "10m"}},
+		},
+		{
+			name:    "nested helm flag",
+			new:     "charts:\n  - name: db\n    path: ./c\n    values_path: values/db.yaml\n  - name: app\n    path: ./c\n    timeout: 5m\n    dependencies: [db]\n    helm:\n      atomic: true\n",
+			changes: []FieldChange{{Chart: "app", Field: "helm.atomic", Old: "false", New: "true"}},
+		},
+		{
+			name: "added values source",
+			new: "charts:\n  - name: db\n    path: ./c\n    values_path: values/db.yaml\n    values_from:\n      - secret: {name: db-values, key: values.yaml}\n" +
+				"  - name: app\n    path: ./c\n    timeout: 5m\n    dependencies: [db]\n",
+			changes: []FieldChange{
+				{Chart: "db", Field: "values_from.0.secret.name", Old: "", New: "db-values"},
+				{Chart: "db", Field: "values_from.0.secret.key", Old: "", New: "values.yaml"},
+			},
+		},
+		{
+			name:    "dependencies are compared as edges",
+			new:     "charts:\n  - name: db\n    path: ./c\n    values_path: values/db.yaml\n  - name: app\n    path: ./c\n    timeout: 5m\n",
+			changes: []FieldChange{},
+			edges:   true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			files := func(graph string) map[string]string {
+				return map[string]string{
+					"graph.yaml":     graph,
+					"c/Chart.yaml":   "apiVersion: v2\nname: c\nversion: 0.1.0\n",
+					"values/db.yaml": "replicas: 1\n",
+				}
+			}
+			olddir, newdir := t.TempDir(), t.TempDir()
+			writeGraphFiles(t, olddir, files(base))
+			writeGraphFiles(t, newdir, files(c.new))
+			gc, err := compareGraphFiles(filepath.Join(olddir, "graph.yaml"), filepath.Join(newdir, "graph.yaml"), templateVars{})
+			if err != nil {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+			if !reflect.DeepEqual(gc.FieldChanges, c.changes) {
+				t.Fatalf("bad field changes: %+v", gc.FieldChanges)
+			}
+			if gc.Empty() == c.edges {
+				t.Fatalf("bad graph diff: %+v", gc.GraphDiff)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/graphext/metahelm/pkg/dag"
+	"github.com/graphext/metahelm/pkg/expr"
+	"github.com/pkg/errors"
+)
+
+// disabledChart is a chart definition removed from the graph because its enabled expression is false
+type disabledChart struct {
+	name, enabled, reason string
+}
+
+// cdNode adapts a ChartDefinition into a graph object
+type cdNode struct {
+	cd *ChartDefinition
+}
+
+func (n cdNode) Name() string {
+	return n.cd.Name
+}
+
+func (n cdNode) String() string {
+	return fmt.Sprintf("\"%v\"", n.cd.Name)
+}
+
+func (n cdNode) Dependencies() []string {
+	return n.cd.Dependencies
+}
+
+func (n cdNode) Priority() int {
+	return n.cd.Priority
+}
+
+func (n cdNode) Resources() map[string]int {
+	return n.cd.tokens()
+}
+
+// varLookup returns a lookup function for expression variables from the template variables (see templateVars), formatted as strings
+func varLookup(vars map[string]interface{}) expr.LookupFunc {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("%v", v), true
+	}
+}
+
+// applyConditions evaluates the enabled expressions of the chart definitions with the template variables vars and removes the disabled
+// ones. Dependencies on disabled charts are replaced by the dependencies of the disabled charts so that the ordering among the remaining
+// charts is preserved.
+func applyConditions(cds []ChartDefinition, vars map[string]interface{}) ([]ChartDefinition, []disabledChart, error) {
+	lookup := varLookup(vars)
+	removed := map[string]struct{}{}
+	disabled := []disabledChart{}
+	for _, cd := range cds {
+		if strings.TrimSpace(cd.Enabled) == "" {
+			continue
+		}
+		e, err := expr.Parse(cd.Enabled)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error in enabled expression of %v", cd.Name)
+		}
+		ok, err := e.Eval(lookup)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error evaluating enabled expression of %v", cd.Name)
+		}
+		if ok {
+			continue
+		}
+		vals := []string{}
+		for _, v := range e.Vars() {
+			val, _ := lookup(v)
+			vals = append(vals, fmt.Sprintf("%v=%q", v, val))
+		}
+		reason := "enabled is false"
+		if len(vals) > 0 {
+			reason = fmt.Sprintf("enabled is false with %v", strings.Join(vals, ", "))
+		}
+		removed[cd.Name] = struct{}{}
+		disabled = append(disabled, disabledChart{name: cd.Name, enabled: cd.Enabled, reason: reason})
+	}
+	if len(removed) == 0 {
+		return cds, nil, nil
+	}
+	objs := []dag.GraphObject{}
+	for i := range cds {
+		objs = append(objs, cdNode{cd: &cds[i]})
+	}
+	deps := dag.RewireDependencies(objs, removed)
+	out := []ChartDefinition{}
+	for _, cd := range cds {
+		if _, ok := removed[cd.Name]; ok {
+			continue
+		}
+		if len(cd.Dependencies) > 0 {
+			cd.Dependencies = deps[cd.Name]
+		}
+		out = append(out, cd)
+	}
+	if len(out) == 0 {
+		return nil, nil, errors.New("all charts are disabled")
+	}
+	return out, disabled, nil
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyConditions(t *testing.T) {
+	cds := []ChartDefinition{
+		{Name: "db"},
+		{Name: "cache"},
+		{Name: "migrations", Enabled: `env == "prod" && !skip`, Dependencies: []string{"db", "cache"}},
+		{Name: "app", Dependencies: []string{"migrations", "cache"}},
+		{Name: "docs", Enabled: "docs"},
+	}
+	cases := []struct {
+		name     string
+		vars     map[string]interface{}
+		deps     map[string][]string // dependencies of the remaining charts
+		disabled map[string]string   // reason by disabled chart name
+		errMsg   string
+	}{
+		{
+			name: "all enabled",
+			vars: map[string]interface{}{"env": "prod", "skip": "false", "docs": true},
+			deps: map[string][]string{
+				"db":         nil,
+				"cache":      nil,
+				"migrations": {"db", "cache"},
+				"app":        {"migrations", "cache"},
+				"docs":       nil,
+			},
+			disabled: map[string]string{},
+		},
+		{
+			name: "middle chart disabled",
+			vars: map[string]interface{}{"env": "dev", "skip": false, "docs": "yes"},
+			deps: map[string][]string{
+				"db":    nil,
+				"cache": nil,
+				"app":   {"db", "cache"},
+				"docs":  nil,
+			},
+			disabled: map[string]string{"migrations": `enabled is false with env="dev", skip="false"`},
+		},
+		{
+			name: "two charts disabled",
+			vars: map[string]interface{}{"env": "prod", "skip": true, "docs": 0},
+			deps: map[string][]string{
+				"db":    nil,
+				"cache": nil,
+				"app":   {"db", "cache"},
+			},
+			disabled: map[string]string{
+				"migrations": `enabled is false with env="prod", skip="true"`,
+				"docs":       `enabled is false with docs="0"`,
+			},
+		},
+		{
+			name:   "undefined variable",
+			vars:   map[string]interface{}{"env": "prod", "skip": false},
+			errMsg: "undefined variable: docs",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, disabled, err := applyConditions(cds, c.vars)
+			if c.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), c.errMsg) {
+					t.Fatalf("should have failed with %q: %v", c.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+			deps := map[string][]string{}
+			for _, cd := range out {
+				deps[cd.Name] = cd.Dependencies
+			}
+			if !reflect.DeepEqual(deps, c.deps) {
+				t.Fatalf("bad dependencies: %v", deps)
+			}
+			reasons := map[string]string{}
+			for _, dc := range disabled {
+				reasons[dc.name] = dc.reason
+			}
+			if !reflect.DeepEqual(reasons, c.disabled) {
+				t.Fatalf("bad disabled charts: %v", reasons)
+			}
+		})
+	}
+}
+
+func TestApplyConditionsAllDisabled(t *testing.T) {
+	cds := []ChartDefinition{
+		{Name: "db", Enabled: "false"},
+		{Name: "app", Enabled: `env == "prod"`, Dependencies: []string{"db"}},
+	}
+	if _, _, err := applyConditions(cds, map[string]interface{}{"env": "dev"}); err == nil || !strings.Contains(err.Error(), "all charts are disabled") {
+		t.Fatalf("should have failed with all charts disabled: %v", err)
+	}
+}
+
+func TestReadAndValidateFileConditions(t *testing.T) {
+	dir := t.TempDir()
+	writeGraphFiles(t, dir, map[string]string{
+		"graph.yaml":   "charts:\n  - name: db\n    path: ./c\n  - name: cache\n    path: ./c\n    enabled: env == \"prod\" && {{ .cache }}\n",
+		"c/Chart.yaml": "apiVersion: v2\nname: c\nversion: 0.1.0\n",
+		"vars.yaml":    "cache: true\n",
+	})
+	t.Setenv(varEnvPrefix+"env", "prod")
+	cases := []struct {
+		name   string
+		tv     templateVars
+		charts int
+	}{
+		{"environment", templateVars{files: []string{filepath.Join(dir, "vars.yaml")}}, 2},
+		{"var overrides environment", templateVars{vars: []string{"env=dev"}, files: []string{filepath.Join(dir, "vars.yaml")}}, 1},
+		{"var overrides var file", templateVars{vars: []string{"cache=false"}, files: []string{filepath.Join(dir, "vars.yaml")}}, 1},
+		{"deprecated set-var", templateVars{vars: []string{"cache=true"}, setVars: []string{"env=dev"}}, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gd, disabled, err := readAndValidateFile(filepath.Join(dir, "graph.yaml"), true, c.tv)
+			if err != nil {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+			if len(gd.Charts) != c.charts || len(gd.Charts)+len(disabled) != 2 {
+				t.Fatalf("bad charts: %v (disabled: %v)", len(gd.Charts), disabled)
+			}
+		})
+	}
+}
+
+func TestChartsToKeep(t *testing.T) {
+	cds := []ChartDefinition{
+		{Name: "db"},
+		{Name: "cache", Enabled: "cache"},
+		{Name: "app", Dependencies: []string{"db", "cache"}},
+	}
+	enabled, disabled, err := applyConditions(cds, map[string]interface{}{"cache": false})
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	cs, _, err := cd2c(enabled)
+	if err != nil {
+		t.Fatalf("error converting charts: %v", err)
+	}
+	titles := []string{}
+	for _, c := range chartsToKeep(cs, disabled) {
+		titles = append(titles, c.Title)
+	}
+	// the disabled chart isn't pruned
+	if strings.Join(titles, ",") != "db,app,cache" {
+		t.Fatalf("bad charts to keep: %v", titles)
+	}
+}
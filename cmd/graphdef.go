@@ -0,0 +1,525 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/graphext/metahelm/pkg/dag"
+	"github.com/graphext/metahelm/pkg/metahelm"
+	"github.com/pkg/errors"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// GraphDefinition models the YAML input file. The file may also be just the list of charts.
+type GraphDefinition struct {
+	// Name of the graph (overridden by --graph-name; defaults to the input file name without extension)
+	Name string `yaml:"name"`
+	// Defaults for all charts in the graph
+	Defaults *DefaultsDefinition `yaml:"defaults"`
+	// Limits of the shared resources and concurrency groups used by the charts (name: number of tokens). Undeclared concurrency groups have a limit of 1.
+	Resources map[string]int `yaml:"resources"`
+	// Other graph files whose charts are added to the graph
+	Include []IncludeDefinition `yaml:"include"`
+	// The charts (and non-chart steps) of the graph
+	Charts []ChartDefinition `yaml:"charts"`
+}
+
+// IncludeDefinition models an included graph file in the YAML input file
+type IncludeDefinition struct {
+	// Path of the graph file, relative to the including file
+	Path string `yaml:"path"`
+	// Prefix of the names of the included charts, joined with a slash (eg, data/mysql). If empty, the names are kept.
+	Prefix string `yaml:"prefix"`
+}
+
+// DefaultsDefinition models the graph-level defaults in the YAML input file
+type DefaultsDefinition struct {
+	// Default Helm install/upgrade flags. Flags set by a chart override these.
+	Helm *HelmDefinition `yaml:"helm"`
+}
+
+// HelmDefinition models the Helm install/upgrade flags of a chart in the YAML input file (see metahelm.HelmOptions)
+type HelmDefinition struct {
+	// On failure, uninstall a failed install or roll back a failed upgrade
+	Atomic *bool `yaml:"atomic"`
+	// Force resource updates through a replacement strategy
+	Force *bool `yaml:"force"`
+	// On upgrade, reset the values to the ones built into the chart
+	ResetValues *bool `yaml:"reset_values"`
+	// On upgrade, reuse the last release's values and merge in the overrides
+	ReuseValues *bool `yaml:"reuse_values"`
+	// Don't install the CRDs in the crds/ directory of the chart
+	SkipCRDs *bool `yaml:"skip_crds"`
+	// Don't run chart hooks
+	DisableHooks *bool `yaml:"disable_hooks"`
+	// Wait for all Jobs to complete before marking the release as successful
+	WaitForJobs *bool `yaml:"wait_for_jobs"`
+	// Maximum number of revisions saved per release on upgrade (0 means no limit)
+	MaxHistory *int `yaml:"max_history"`
+	// Custom description of the release revision
+	Description *string `yaml:"description"`
+	// Update missing chart dependencies (like helm dependency update) before installing
+	DependencyUpdate *bool `yaml:"dependency_update"`
+}
+
+// applyDefaults merges the graph defaults into the chart definitions
+func (gd *GraphDefinition) applyDefaults() {
+	if gd.Defaults == nil || gd.Defaults.Helm == nil {
+		return
+	}
+	for i := range gd.Charts {
+		gd.Charts[i].Helm = mergeHelm(gd.Defaults.Helm, gd.Charts[i].Helm)
+	}
+}
+
+// mergeHelm returns the flags of defaults overridden by those set in hd
+func mergeHelm(defaults, hd *HelmDefinition) *HelmDefinition {
+	if hd == nil {
+		out := *defaults
+		return &out
+	}
+	out := *hd
+	if out.Atomic == nil {
+		out.Atomic = defaults.Atomic
+	}
+	if out.Force == nil {
+		out.Force = defaults.Force
+	}
+	if out.ResetValues == nil {
+		out.ResetValues = defaults.ResetValues
+	}
+	if out.ReuseValues == nil {
+		out.ReuseValues = defaults.ReuseValues
+	}
+	if out.SkipCRDs == nil {
+		out.SkipCRDs = defaults.SkipCRDs
+	}
+	if out.DisableHooks == nil {
+		out.DisableHooks = defaults.DisableHooks
+	}
+	if out.WaitForJobs == nil {
+		out.WaitForJobs = defaults.WaitForJobs
+	}
+	if out.MaxHistory == nil {
+		out.MaxHistory = defaults.MaxHistory
+	}
+	if out.Description == nil {
+		out.Description = defaults.Description
+	}
+	if out.DependencyUpdate == nil {
+		out.DependencyUpdate = defaults.DependencyUpdate
+	}
+	return &out
+}
+
+// helmOptions converts a Helm definition (which may be nil) into Helm options
+func helmOptions(hd *HelmDefinition) *metahelm.HelmOptions {
+	if hd == nil {
+		return nil
+	}
+	b := func(v *bool) bool { return v != nil && *v }
+	ho := &metahelm.HelmOptions{
+		Atomic:           b(hd.Atomic),
+		Force:            b(hd.Force),
+		ResetValues:      b(hd.ResetValues),
+		ReuseValues:      b(hd.ReuseValues),
+		SkipCRDs:         b(hd.SkipCRDs),
+		DisableHooks:     b(hd.DisableHooks),
+		WaitForJobs:      b(hd.WaitForJobs),
+		DependencyUpdate: b(hd.DependencyUpdate),
+	}
+	if hd.MaxHistory != nil {
+		ho.MaxHistory = *hd.MaxHistory
+	}
+	if hd.Description != nil {
+		ho.Description = *hd.Description
+	}
+	return ho
+}
+
+// tokens returns the resource tokens held by the chart: its resource tokens plus one token of its concurrency group
+func (cd ChartDefinition) tokens() map[string]int {
+	if cd.ConcurrencyGroup == "" && len(cd.ResourceTokens) == 0 {
+		return nil
+	}
+	out := map[string]int{}
+	for r, n := range cd.ResourceTokens {
+		out[r] = n
+	}
+	if cd.ConcurrencyGroup != "" {
+		out[cd.ConcurrencyGroup]++
+	}
+	return out
+}
+
+// validateResources verifies that the resource limits are positive, that resource tokens refer to declared resources and that no chart
+// needs more tokens than a resource has
+func (gd *GraphDefinition) validateResources() error {
+	for r, n := range gd.Resources {
+		if n <= 0 {
+			return fmt.Errorf("limit of resource %v must be positive: %v", r, n)
+		}
+	}
+	for _, cd := range gd.Charts {
+		for r := range cd.ResourceTokens {
+			if _, ok := gd.Resources[r]; !ok {
+				return fmt.Errorf("chart %v: undeclared resource: %v", cd.Name, r)
+			}
+		}
+		for r, n := range cd.tokens() {
+			limit, ok := gd.Resources[r]
+			if !ok {
+				limit = 1
+			}
+			if n > limit {
+				return fmt.Errorf("chart %v: needs %v tokens of resource %v, which only has %v", cd.Name, n, r, limit)
+			}
+		}
+	}
+	return nil
+}
+
+// addExternalDependencies appends an external node for every dependency on a release or workload outside of the graph (see
+// metahelm.ParseExternalDependency) that isn't defined in cds
+func addExternalDependencies(cds []ChartDefinition) ([]ChartDefinition, error) {
+	defined := map[string]struct{}{}
+	for _, cd := range cds {
+		defined[cd.Name] = struct{}{}
+	}
+	out := append([]ChartDefinition{}, cds...)
+	for _, cd := range cds {
+		for _, ds := range cd.Dependencies {
+			d, err := dag.ParseDependency(ds)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error in dependencies of %v", cd.Name)
+			}
+			if _, ok := defined[d.Name]; ok {
+				continue
+			}
+			_, ok, err := metahelm.ParseExternalDependency(d.Name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error in dependencies of %v", cd.Name)
+			}
+			if !ok {
+				continue
+			}
+			defined[d.Name] = struct{}{}
+			out = append(out, ChartDefinition{Name: d.Name, Type: nodeTypeExternal})
+		}
+	}
+	return out, nil
+}
+
+// chartSource is the definition of a chart in a graph file
+type chartSource struct {
+	file string
+	node *yaml3.Node
+}
+
+// position returns the line of the chart definition, with the file name if it isn't f
+func (cs chartSource) position(f string) string {
+	if cs.file == f {
+		return fmt.Sprintf("line %v", cs.node.Line)
+	}
+	return fmt.Sprintf("%v:%v", cs.file, cs.node.Line)
+}
+
+// mappingValue returns the value node of key in the mapping node n, or nil
+func mappingValue(n *yaml3.Node, key string) *yaml3.Node {
+	if n == nil || n.Kind != yaml3.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// graphLoader reads graph files and the files they include, rendering them as templates (see renderGraphTemplate), and keeps the
+// position of every chart definition
+type graphLoader struct {
+	vars map[string]interface{}
+	// if set, the rendered files are written to it as YAML documents
+	rendered io.Writer
+	// if set, the problems found are reported to it with their file and node (if known), and loading continues past them where possible.
+	// Otherwise loading stops at the first problem, which is returned.
+	report func(f string, n *yaml3.Node, err error)
+	// definitions of the loaded charts by (prefixed) name, set by load
+	sources map[string]chartSource
+	// root nodes of the loaded files by path, set by load
+	roots map[string]*yaml3.Node
+}
+
+// fail handles the problem err found in the file f at the node n: it returns err, unless it is reported
+func (gl *graphLoader) fail(f string, n *yaml3.Node, err error) error {
+	if gl.report == nil {
+		return err
+	}
+	gl.report(f, n, err)
+	return nil
+}
+
+// load reads the graph definition in f with its included graphs, expands relative paths and applies the graph defaults to the
+// charts. If problems are reported, the returned graph definition only has the charts that could be loaded (and is nil if f couldn't be).
+func (gl *graphLoader) load(f string) (*GraphDefinition, error) {
+	gl.roots = map[string]*yaml3.Node{}
+	gd, sources, err := gl.loadFile(f, nil)
+	if err != nil || gd == nil {
+		return nil, err
+	}
+	gl.sources = sources
+	// included charts keep release name collisions when prefixed, so it is enough to check the whole graph
+	releases := map[string]string{}
+	for _, cd := range gd.Charts {
+		if cd.Type != "" && cd.Type != nodeTypeChart {
+			continue
+		}
+		rn := releaseNameOf(cd.Name)
+		if other, ok := releases[rn]; ok && other != cd.Name {
+			src := sources[cd.Name]
+			if err := gl.fail(src.file, mappingValue(src.node, "name"), fmt.Errorf("charts %v and %v have the same release name: %v", other, cd.Name, rn)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		releases[rn] = cd.Name
+	}
+	return gd, nil
+}
+
+// loadFile reads the graph definition in f (see load) and returns it with the definitions of its charts. stack holds the absolute paths
+// of the files including f, to detect include cycles.
+func (gl *graphLoader) loadFile(f string, stack []string) (*GraphDefinition, map[string]chartSource, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, nil, gl.fail(f, nil, errors.Wrap(err, "error reading file"))
+	}
+	// positions refer to the rendered file
+	b, err = renderGraphTemplate(f, b, gl.vars)
+	if err != nil {
+		return nil, nil, gl.fail(f, nil, err)
+	}
+	if gl.rendered != nil {
+		if len(stack) > 0 {
+			fmt.Fprintf(gl.rendered, "---\n")
+		}
+		fmt.Fprintf(gl.rendered, "# %v\n%s", f, b)
+		if len(b) > 0 && b[len(b)-1] != '\n' {
+			fmt.Fprintf(gl.rendered, "\n")
+		}
+	}
+	doc := yaml3.Node{}
+	if err := yaml3.Unmarshal(b, &doc); err != nil {
+		return nil, nil, gl.fail(f, nil, errors.Wrap(err, "error parsing YAML"))
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil, gl.fail(f, nil, errors.New("file is empty"))
+	}
+	root := doc.Content[0]
+	gl.roots[f] = root
+	gd := &GraphDefinition{}
+	chartsNode := root
+	switch root.Kind {
+	case yaml3.SequenceNode:
+	case yaml3.MappingNode:
+		fields := []struct {
+			key string
+			out interface{}
+		}{{"name", &gd.Name}, {"defaults", &gd.Defaults}, {"resources", &gd.Resources}, {"include", &gd.Include}}
+		for _, fld := range fields {
+			n := mappingValue(root, fld.key)
+			if n == nil {
+				continue
+			}
+			if err := n.Decode(fld.out); err != nil {
+				if fld.key == "include" {
+					gd.Include = nil // a bad include list isn't followed
+				}
+				if err := gl.fail(f, n, errors.Wrapf(err, "bad %v", fld.key)); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		chartsNode = mappingValue(root, "charts")
+		if chartsNode == nil {
+			chartsNode = &yaml3.Node{Kind: yaml3.SequenceNode}
+		}
+		if chartsNode.Kind != yaml3.SequenceNode {
+			return nil, nil, gl.fail(f, chartsNode, errors.New("charts must be a list"))
+		}
+	default:
+		return nil, nil, gl.fail(f, root, errors.New("expected a list of charts or a graph document"))
+	}
+	if len(chartsNode.Content) == 0 && len(gd.Include) == 0 {
+		return nil, nil, gl.fail(f, nil, errors.New("file is empty"))
+	}
+	sources := map[string]chartSource{}
+	for _, cn := range chartsNode.Content {
+		cd := ChartDefinition{}
+		if err := cn.Decode(&cd); err != nil {
+			if err := gl.fail(f, cn, errors.Wrap(err, "bad chart")); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if first, ok := sources[cd.Name]; ok && cd.Name != "" {
+			if err := gl.fail(f, mappingValue(cn, "name"), fmt.Errorf("duplicate chart name %q (first defined at %v)", cd.Name, first.position(f))); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		sources[cd.Name] = chartSource{file: f, node: cn}
+		gd.Charts = append(gd.Charts, cd)
+	}
+	expandChartFilesPath(gd.Charts, filepath.Dir(f))
+	abs, err := filepath.Abs(f)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error getting absolute path")
+	}
+	in := mappingValue(root, "include")
+	for i, inc := range gd.Include {
+		igd, isources, err := gl.include(f, inc, in.Content[i], append(stack, abs))
+		if err != nil {
+			return nil, nil, err
+		}
+		if igd == nil {
+			continue
+		}
+		charts := []ChartDefinition{}
+		for _, cd := range igd.Charts {
+			src := isources[cd.Name]
+			if first, ok := sources[cd.Name]; ok {
+				err := fmt.Errorf("duplicate chart name %q (first defined at %v)", cd.Name, first.position(src.file))
+				if err := gl.fail(src.file, mappingValue(src.node, "name"), err); err != nil {
+					return nil, nil, errors.Wrapf(err, "error including %v", inc.Path)
+				}
+				continue
+			}
+			sources[cd.Name] = src
+			charts = append(charts, cd)
+		}
+		igd.Charts = charts
+		gd.merge(igd)
+	}
+	gd.applyDefaults()
+	return gd, sources, nil
+}
+
+// releaseNameOf returns the Helm release name of a chart, without the release name prefix: slashes (eg, in the names of included charts)
+// are replaced by dashes (see metahelm.ReleaseName)
+func releaseNameOf(name string) string {
+	return strings.ReplaceAll(name, "/", "-")
+}
+
+// include reads the graph included by f in inc, at the node n, and prefixes the names of its charts
+func (gl *graphLoader) include(f string, inc IncludeDefinition, n *yaml3.Node, stack []string) (*GraphDefinition, map[string]chartSource, error) {
+	fail := func(n *yaml3.Node, err error) error {
+		if err := gl.fail(f, n, err); err != nil {
+			return errors.Wrapf(err, "error including %v", inc.Path)
+		}
+		return nil
+	}
+	if inc.Path == "" {
+		return nil, nil, fail(n, errors.New("include path is empty"))
+	}
+	if err := validatePrefix(inc.Prefix); err != nil {
+		return nil, nil, fail(mappingValue(n, "prefix"), err)
+	}
+	ip := expandFilePath(inc.Path, filepath.Dir(f))
+	abs, err := filepath.Abs(ip)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error getting absolute path")
+	}
+	for i, sf := range stack {
+		if sf == abs {
+			return nil, nil, fail(mappingValue(n, "path"), fmt.Errorf("include cycle: %v", strings.Join(append(stack[i:], abs), " -> ")))
+		}
+	}
+	gd, sources, err := gl.loadFile(ip, stack)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error including %v", inc.Path)
+	}
+	if gd == nil {
+		return nil, nil, nil
+	}
+	names := make([]string, len(gd.Charts))
+	for i, cd := range gd.Charts {
+		names[i] = cd.Name
+	}
+	if err := prefixCharts(gd.Charts, inc.Prefix); err != nil {
+		return nil, nil, fail(n, err)
+	}
+	out := map[string]chartSource{}
+	for i, cd := range gd.Charts {
+		out[cd.Name] = sources[names[i]]
+	}
+	return gd, out, nil
+}
+
+// validatePrefix verifies that prefixed chart names can be used as dependencies and aren't external dependency references
+func validatePrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if strings.ContainsAny(prefix, ":,") || strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("invalid prefix: %q", prefix)
+	}
+	if _, ok, _ := metahelm.ParseExternalDependency(prefix + "/x"); ok {
+		return fmt.Errorf("prefix is reserved for external dependencies: %v", prefix)
+	}
+	return nil
+}
+
+// prefixCharts adds prefix to the names of the charts and to the dependencies on them. Dependencies on other charts are kept, so that
+// included charts may depend on charts of the including graph.
+func prefixCharts(cds []ChartDefinition, prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	names := map[string]struct{}{}
+	for _, cd := range cds {
+		if cd.Type != nodeTypeExternal {
+			names[cd.Name] = struct{}{}
+		}
+	}
+	for i := range cds {
+		cd := &cds[i]
+		if cd.Type == nodeTypeExternal {
+			continue
+		}
+		cd.Name = prefix + "/" + cd.Name
+		deps := make([]string, len(cd.Dependencies))
+		for j, ds := range cd.Dependencies {
+			d, err := dag.ParseDependency(ds)
+			if err != nil {
+				return errors.Wrapf(err, "error in dependencies of %v", cd.Name)
+			}
+			if _, ok := names[d.Name]; ok {
+				d.Name = prefix + "/" + d.Name
+				ds = d.String()
+			}
+			deps[j] = ds
+		}
+		cd.Dependencies = deps
+	}
+	return nil
+}
+
+// merge adds the charts of the included graph igd, and the limits of the resources that gd doesn't declare
+func (gd *GraphDefinition) merge(igd *GraphDefinition) {
+	gd.Charts = append(gd.Charts, igd.Charts...)
+	for r, n := range igd.Resources {
+		if _, ok := gd.Resources[r]; ok {
+			continue
+		}
+		if gd.Resources == nil {
+			gd.Resources = map[string]int{}
+		}
+		gd.Resources[r] = n
+	}
+}
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeGraphFiles writes files (by path relative to dir) into dir
+func writeGraphFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("error creating directory: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+}
+
+func TestGraphLoaderInclude(t *testing.T) {
+	data := `charts:
+  - name: mysql
+    path: ./charts/mysql
+    values_path: values/mysql.yaml
+  - name: migrations
+    type: job
+    job_path: jobs/migrate.yaml
+    dependencies: [mysql, "mysql:started", config, release/infra/vault]
+`
+	cases := []struct {
+		name   string
+		files  map[string]string
+		charts map[string][]string // dependencies by chart name
+		paths  map[string]string   // path (or job_path) by chart name, relative to the test directory
+		errMsg string
+	}{
+		{
+			name: "prefix",
+			files: map[string]string{
+				"main.yaml": "include: [{path: data/data.yaml, prefix: data}]\ncharts:\n  - name: config\n    path: ./charts/config\n" +
+					"  - name: app\n    path: ./charts/app\n    dependencies: [data/mysql, config]\n",
+				"data/data.yaml": data,
+			},
+			charts: map[string][]string{
+				"config":          nil,
+				"app":             {"data/mysql", "config"},
+				"data/mysql":      nil,
+				"data/migrations": {"data/mysql", "data/mysql:started", "config", "release/infra/vault"},
+			},
+			paths: map[string]string{
+				"config":          "charts/config",
+				"app":             "charts/app",
+				"data/mysql":      "data/charts/mysql",
+				"data/migrations": "data/jobs/migrate.yaml",
+			},
+		},
+		{
+			name: "no prefix",
+			files: map[string]string{
+				"main.yaml":      "include: [{path: data/data.yaml}]\n",
+				"data/data.yaml": data,
+			},
+			charts: map[string][]string{
+				"mysql":      nil,
+				"migrations": {"mysql", "mysql:started", "config", "release/infra/vault"},
+			},
+			paths: map[string]string{"mysql": "data/charts/mysql"},
+		},
+		{
+			name: "nested prefixes",
+			files: map[string]string{
+				"main.yaml":        "include: [{path: tiers/tiers.yaml, prefix: shop}]\n",
+				"tiers/tiers.yaml": "include: [{path: ../data/data.yaml, prefix: data}]\ncharts:\n  - name: api\n    path: ./api\n    dependencies: [data/mysql]\n",
+				"data/data.yaml":   data,
+			},
+			charts: map[string][]string{
+				"shop/api":             {"shop/data/mysql"},
+				"shop/data/mysql":      nil,
+				"shop/data/migrations": {"shop/data/mysql", "shop/data/mysql:started", "config", "release/infra/vault"},
+			},
+			paths: map[string]string{"shop/api": "tiers/api", "shop/data/mysql": "data/charts/mysql"},
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"main.yaml": "include: [{path: a.yaml}]\ncharts: [{name: main, path: ./c}]\n",
+				"a.yaml":    "include: [{path: b.yaml, prefix: b}]\ncharts: [{name: a, path: ./c}]\n",
+				"b.yaml":    "include: [{path: a.yaml, prefix: a}]\ncharts: [{name: b, path: ./c}]\n",
+			},
+			errMsg: "include cycle",
+		},
+		{
+			name: "self include",
+			files: map[string]string{
+				"main.yaml": "include: [{path: ./main.yaml, prefix: x}]\ncharts: [{name: main, path: ./c}]\n",
+			},
+			errMsg: "include cycle",
+		},
+		{
+			name: "duplicate across includes",
+			files: map[string]string{
+				"main.yaml":      "include: [{path: data/data.yaml}, {path: other.yaml}]\n",
+				"data/data.yaml": data,
+				"other.yaml":     "charts: [{name: mysql, path: ./c}]\n",
+			},
+			errMsg: `duplicate chart name "mysql" (first defined at `,
+		},
+		{
+			name: "duplicate with including file",
+			files: map[string]string{
+				"main.yaml":      "include: [{path: data/data.yaml, prefix: data}]\ncharts: [{name: data/mysql, path: ./c}]\n",
+				"data/data.yaml": data,
+			},
+			errMsg: `duplicate chart name "data/mysql" (first defined at `,
+		},
+		{
+			name: "release name collision",
+			files: map[string]string{
+				"main.yaml":      "include: [{path: data/data.yaml, prefix: data}]\ncharts: [{name: data-mysql, path: ./c}]\n",
+				"data/data.yaml": data,
+			},
+			errMsg: "charts data-mysql and data/mysql have the same release name: data-mysql",
+		},
+		{
+			name: "reserved prefix",
+			files: map[string]string{
+				"main.yaml":      "include: [{path: data/data.yaml, prefix: release}]\n",
+				"data/data.yaml": data,
+			},
+			errMsg: "reserved for external dependencies",
+		},
+		{
+			name: "missing file",
+			files: map[string]string{
+				"main.yaml": "include: [{path: missing.yaml}]\n",
+			},
+			errMsg: "error including missing.yaml",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeGraphFiles(t, dir, c.files)
+			gl := &graphLoader{}
+			gd, err := gl.load(filepath.Join(dir, "main.yaml"))
+			if c.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), c.errMsg) {
+					t.Fatalf("should have failed with %q: %v", c.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+			charts := map[string][]string{}
+			paths := map[string]string{}
+			for _, cd := range gd.Charts {
+				if len(cd.Dependencies) > 0 {
+					charts[cd.Name] = cd.Dependencies
+				} else {
+					charts[cd.Name] = nil
+				}
+				p := cd.Path
+				if cd.JobPath != "" {
+					p = cd.JobPath
+				}
+				paths[cd.Name] = p
+				if src := gl.sources[cd.Name]; src.node == nil || !strings.HasPrefix(src.file, dir) {
+					t.Fatalf("missing definition of %v: %+v", cd.Name, src)
+				}
+			}
+			if !reflect.DeepEqual(charts, c.charts) {
+				t.Fatalf("bad charts: %v", charts)
+			}
+			for n, p := range c.paths {
+				if paths[n] != filepath.Join(dir, p) {
+					t.Fatalf("bad path for %v: %v", n, paths[n])
+				}
+			}
+		})
+	}
+}
@@ -11,47 +11,155 @@ import (
 	"strings"
 	"time"
 
+	"github.com/graphext/metahelm/pkg/dag"
 	"github.com/graphext/metahelm/pkg/metahelm"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
-	yaml "gopkg.in/yaml.v2"
 	"helm.sh/helm/v3/pkg/action"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
+	sigsyaml "sigs.k8s.io/yaml"
 )
 
-// ChartDefinition models a chart in the YAML input file
+// Node types for ChartDefinition
+const (
+	nodeTypeChart = "chart"
+	nodeTypeJob   = "job"
+	nodeTypeWait  = "wait"
+	// plain YAML manifests or a Kustomize directory in path, applied with server-side apply
+	nodeTypeManifest = "manifest"
+	// a release or workload outside of the graph, named by its reference (eg, release/infra/postgres). Added for every referenced
+	// dependency that isn't defined, or defined explicitly to set its timeout.
+	nodeTypeExternal = "external"
+)
+
+// ChartDefinition models a chart (or a non-chart step) in the YAML input file
 type ChartDefinition struct {
 	// Name of the chart (must be unique)
 	Name string `yaml:"name"`
-	// Local filesystem path to the chart (directory or archive file)
+	// Node type: "chart" (default), "manifest" (apply the manifests or Kustomize directory in path), "job" (run a Kubernetes Job to completion)
+	// or "wait" (wait for a resource to exist/have a condition)
+	Type string `yaml:"type"`
+	// Local filesystem path to the chart (directory or archive file), the chart name in the repository repo, an OCI reference (oci://...),
+	// or the path to the manifest file or directory for type manifest
 	Path string `yaml:"path"`
+	// Chart repository URL (path is then the chart name)
+	Repo string `yaml:"repo"`
+	// Chart version (exact or constraint) for repository and OCI charts. Empty means the latest version.
+	Version string `yaml:"version"`
 	// Path to the values YAML file for overrides
 	ValuesPath string `yaml:"values_path"`
+	// Values read at install time, overriding values_path in order: SOPS-encrypted files and keys of Secrets and ConfigMaps in the cluster
+	ValuesFrom []ValuesSourceDefinition `yaml:"values_from"`
 	// The name of the k8s deployment object created by the chart used to determine health (omit or leave empty to ignore chart health)
 	PrimaryDeployment string `yaml:"primary_deployment"`
 	// How long to wait for the chart to become healthy before failing. Use a string like "10m" or "90s".
 	Timeout string `yaml:"timeout"`
+	// Expected install duration (eg, "3m") for critical path estimates with plan --critical-path. Durations recorded by previous installs take precedence.
+	ExpectedDuration string `yaml:"expected_duration"`
 	// Wait for all pods of PrimaryDeployment to be healthy? If false, it will only wait for the first pod to become healthy
 	WaitForAllPods bool `yaml:"wait_for_all_pods"`
 	// Wait until Helm thinks the chart is ready (equivalent to the helm install --wait CLI flag). Overrides PrimaryDeployment.
 	WaitForHelm bool `yaml:"wait_for_helm"`
-	// The list of dependencies this chart has (names must be present in the same file)
+	// Run the chart Helm tests (equivalent to helm test) once the chart is healthy. A failing test fails the chart.
+	RunTests bool `yaml:"run_tests"`
+	// The list of dependencies this chart has (names must be present in the same file unless qualified as optional).
+	// A name may be followed by qualifiers (eg, "redis:optional,started"): optional (ignored if absent or disabled),
+	// order-only (wait for it to finish but don't fail if it fails) and started (only wait for its Helm install to return).
 	Dependencies []string `yaml:"dependencies"`
+	// Charts with higher priority are started first within a graph level (default 0; may be negative). Ties are ordered by name.
+	Priority int `yaml:"priority"`
+	// Charts in the same concurrency group don't install concurrently beyond the group limit in the graph resources (default 1).
+	// Equivalent to one token of the resource with the group name.
+	ConcurrencyGroup string `yaml:"concurrency_group"`
+	// Tokens of shared resources (declared with their limits in the graph resources) held while installing the chart
+	ResourceTokens map[string]int `yaml:"resource_tokens"`
+	// Boolean expression (eg, `env == "production" && !skip_cache`) over the template variables (--var, --var-file or METAHELM_VAR_<name> environment variables).
+	// If false, the chart is removed from the graph and charts that depend on it depend on its dependencies instead. Empty means enabled.
+	Enabled string `yaml:"enabled"`
+	// Helm install/upgrade flags (merged with the graph defaults)
+	Helm *HelmDefinition `yaml:"helm"`
+	// How to retry a failed Helm install/upgrade (by default it isn't retried)
+	Retry *RetryDefinition `yaml:"retry"`
+	// For type job: local filesystem path to the Kubernetes Job manifest (YAML)
+	JobPath string `yaml:"job_path"`
+	// For type wait: the resource to wait for
+	Resource *ResourceDefinition `yaml:"resource"`
+}
+
+// ResourceDefinition models a resource to wait for in the YAML input file
+type ResourceDefinition struct {
+	// API version of the resource (eg, "v1", "apiextensions.k8s.io/v1")
+	APIVersion string `yaml:"api_version"`
+	// Kind of the resource (eg, "Secret", "CustomResourceDefinition")
+	Kind string `yaml:"kind"`
+	// Name of the resource
+	Name string `yaml:"name"`
+	// Namespace of the resource (defaults to the install namespace; ignored for cluster-scoped resources)
+	Namespace string `yaml:"namespace"`
+	// Status condition type that must be True (eg, "Established", "Ready"). If empty, the resource only needs to exist.
+	Condition string `yaml:"condition"`
+}
+
+// ValuesSourceDefinition models a source of chart values in the YAML input file. Exactly one of sops, secret or config_map must be set.
+type ValuesSourceDefinition struct {
+	// Path to a SOPS-encrypted YAML values file, decrypted with the sops CLI (see --age-key-file)
+	SOPS string `yaml:"sops"`
+	// Key of a Secret
+	Secret *ObjectKeyDefinition `yaml:"secret"`
+	// Key of a ConfigMap
+	ConfigMap *ObjectKeyDefinition `yaml:"config_map"`
+}
+
+// ObjectKeyDefinition models a key of a Secret or ConfigMap in the YAML input file
+type ObjectKeyDefinition struct {
+	// Name of the Secret or ConfigMap
+	Name string `yaml:"name"`
+	// Namespace of the Secret or ConfigMap (defaults to the install namespace)
+	Namespace string `yaml:"namespace"`
+	// Key holding a YAML values document, or a single value if path is set
+	Key string `yaml:"key"`
+	// Values path (eg, postgres.auth.password) set to the value of the key
+	Path string `yaml:"path"`
+}
+
+// RetryDefinition models a chart retry policy in the YAML input file
+type RetryDefinition struct {
+	// Total number of attempts, including the first
+	Attempts uint `yaml:"attempts"`
+	// Delay before the first retry, doubled for each subsequent retry (eg, "10s"; default 5s)
+	Backoff string `yaml:"backoff"`
+	// Maximum delay between retries (eg, "2m")
+	MaxBackoff string `yaml:"max_backoff"`
+	// Error classes to retry: "api" (transient API server errors), "webhook" (admission webhook failures), "timeout" (Helm wait timeouts)
+	// or "any" (default: api and webhook)
+	On []string `yaml:"on"`
 }
 
 type installCfg struct {
 	upgrade           bool
+	prune             bool
+	dryRun            bool
 	tillerNS          string
 	tillerTimeout     time.Duration
 	k8sCtx            string
 	k8sNS             string
 	releaseNamePrefix string
+	graphName         string
+	templateVars      templateVars
+	pendingPolicyName string
+	pendingPolicy     metahelm.PendingReleasePolicy
+	lockFile          string
+	lockMismatch      string
+	concurrency       int
+	ageKeyFile        string
+	resourceLimits    map[string]int // from the graph definition
 	restConfig        rest.Config
 }
 
@@ -67,11 +175,23 @@ var installCmd = &cobra.Command{
 
 func init() {
 	installCmd.Flags().BoolVar(&instConfig.upgrade, "upgrade", false, "Upgrade release if release exists")
+	installCmd.Flags().BoolVar(&instConfig.prune, "prune", false, "After a successful install/upgrade, uninstall releases of charts that were removed from the graph definition "+
+		"(charts disabled by their enabled expressions are kept; steps such as manifests are not pruned)")
+	installCmd.Flags().BoolVar(&instConfig.dryRun, "dry-run", false, "With --prune, only print the releases that would be pruned (nothing is installed, upgraded or uninstalled)")
 	installCmd.Flags().DurationVar(&instConfig.tillerTimeout, "tiller-timeout", 90*time.Second, "Tiller connect timeout")
 	installCmd.Flags().StringVar(&instConfig.tillerNS, "tiller-namespace", "kube-system", "k8s namespace where Tiller can be found")
 	installCmd.Flags().StringVar(&instConfig.k8sNS, "k8s-namespace", "", "k8s namespace into which to install charts")
 	installCmd.Flags().StringVar(&instConfig.k8sCtx, "k8s-ctx", "", "k8s context")
 	installCmd.Flags().StringVar(&instConfig.releaseNamePrefix, "release-name-prefix", "", "Release name prefix")
+	installCmd.Flags().StringVar(&instConfig.graphName, "graph-name", "", "Graph name used to record the installed graph in the cluster (default: the name in the input file, or its file name without extension). "+
+		"Every install/upgrade records the graph in a ConfigMap in the install namespace; if it can't be written, a warning is logged")
+	installCmd.Flags().IntVar(&instConfig.concurrency, "concurrency", 0, "Maximum number of charts installed at once (0 means no limit); charts with higher priority start first")
+	installCmd.Flags().StringVar(&instConfig.pendingPolicyName, "pending-release-policy", metahelm.FailOnPending.String(), "What to do with releases left pending by an interrupted install/upgrade: fail, rollback (to the last deployed revision) or reinstall")
+	installCmd.Flags().StringVar(&instConfig.lockFile, "lock-file", "", "lock file to verify charts against, if it exists (default: metahelm.lock in the directory of the input file)")
+	installCmd.Flags().StringVar(&instConfig.lockMismatch, "lock-mismatch", lockMismatchFail, "What to do when a chart doesn't match the lock file: fail, warn or ignore (don't read the lock file)")
+	instConfig.templateVars.addFlags(installCmd)
+	instConfig.templateVars.addSetVarFlag(installCmd)
+	installCmd.Flags().StringVar(&instConfig.ageKeyFile, "age-key-file", "", "age key file to decrypt SOPS values files (default: the sops configuration, eg SOPS_AGE_KEY_FILE)")
 	installCmd.Flags().Float32Var(&instConfig.restConfig.QPS, "qps", 50, "Override maximum QPS to the master from this client")
 	installCmd.Flags().IntVar(&instConfig.restConfig.Burst, "burst", 100, "Override maximum burst for throttle")
 	RootCmd.AddCommand(installCmd)
@@ -81,62 +201,162 @@ func validateChart(c ChartDefinition) error {
 	if c.Name == "" {
 		return errors.New("name is empty")
 	}
-	if c.Path == "" {
-		return errors.New("path is empty")
-	}
-	if _, err := os.Stat(c.Path); err != nil {
-		return errors.Wrap(err, "error with path")
-	}
-	if c.ValuesPath != "" {
-		if _, err := os.Stat(c.ValuesPath); err != nil {
-			return errors.Wrap(err, "error with values_path")
-		}
-	}
 	if c.Timeout != "" {
 		if _, err := time.ParseDuration(c.Timeout); err != nil {
 			return errors.Wrap(err, "error with timeout")
 		}
 	}
+	if c.ExpectedDuration != "" {
+		if _, err := time.ParseDuration(c.ExpectedDuration); err != nil {
+			return errors.Wrap(err, "error with expected_duration")
+		}
+	}
 	for i, d := range c.Dependencies {
 		if len(d) == 0 {
 			return fmt.Errorf("empty string in dependencies at offset %v", i)
 		}
+		if _, err := dag.ParseDependency(d); err != nil {
+			return errors.Wrapf(err, "error in dependencies at offset %v", i)
+		}
+	}
+	for r, n := range c.ResourceTokens {
+		if n <= 0 {
+			return fmt.Errorf("tokens of resource %v must be positive: %v", r, n)
+		}
+	}
+	for i, vs := range c.ValuesFrom {
+		if err := valuesSource(vs).Validate(); err != nil {
+			return errors.Wrapf(err, "error in values_from at offset %v", i)
+		}
+		if vs.SOPS != "" {
+			if _, err := os.Stat(vs.SOPS); err != nil {
+				return errors.Wrapf(err, "error in values_from at offset %v", i)
+			}
+		}
+	}
+	if _, err := retryPolicy(c.Retry); err != nil {
+		return errors.Wrap(err, "error with retry")
+	}
+	if ho := helmOptions(c.Helm); ho != nil {
+		if err := ho.Validate(); err != nil {
+			return errors.Wrap(err, "error with helm")
+		}
+	}
+	switch c.Type {
+	case "", nodeTypeChart, nodeTypeManifest:
+	case nodeTypeJob:
+		if c.JobPath == "" {
+			return errors.New("job_path is empty")
+		}
+		if _, err := os.Stat(c.JobPath); err != nil {
+			return errors.Wrap(err, "error with job_path")
+		}
+		return nil
+	case nodeTypeWait:
+		if c.Resource == nil {
+			return errors.New("resource is missing")
+		}
+		if c.Resource.APIVersion == "" || c.Resource.Kind == "" || c.Resource.Name == "" {
+			return errors.New("resource api_version, kind and name are required")
+		}
+		return nil
+	case nodeTypeExternal:
+		if _, ok, err := metahelm.ParseExternalDependency(c.Name); !ok || err != nil {
+			return fmt.Errorf("name is not an external dependency reference (<kind>/<namespace>/<name>): %v", c.Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown type: %v", c.Type)
+	}
+	if c.Path == "" {
+		return errors.New("path is empty")
+	}
+	if c.remote() {
+		if c.Type == nodeTypeManifest {
+			return errors.New("repo and OCI references are only supported for charts")
+		}
+	} else if _, err := os.Stat(c.Path); err != nil {
+		return errors.Wrap(err, "error with path")
+	}
+	if c.ValuesPath != "" {
+		if _, err := os.Stat(c.ValuesPath); err != nil {
+			return errors.Wrap(err, "error with values_path")
+		}
 	}
 	return nil
 }
 
-func readAndValidateFile(f string, validate bool) ([]ChartDefinition, error) {
-	b, err := ioutil.ReadFile(f)
+// readGraphFile reads the graph definition in f with its included graphs (rendered as templates with vars), expands relative paths and
+// applies the graph defaults to the charts
+func readGraphFile(f string, vars map[string]interface{}) (*GraphDefinition, error) {
+	gd, err := (&graphLoader{vars: vars}).load(f)
 	if err != nil {
-		return nil, errors.Wrap(err, "error reading file")
-	}
-	charts := []ChartDefinition{}
-	if err := yaml.Unmarshal(b, &charts); err != nil {
-		return nil, errors.Wrap(err, "error unmarshaling YAML")
+		return nil, err
 	}
-	if len(charts) == 0 {
+	if len(gd.Charts) == 0 {
 		return nil, errors.New("file is empty")
 	}
+	return gd, nil
+}
+
+// readAndValidateFile reads the graph definition in f (see readGraphFile) and removes the charts that are disabled according to the
+// variables of tv (see applyConditions)
+func readAndValidateFile(f string, validate bool, tv templateVars) (*GraphDefinition, []disabledChart, error) {
+	vars, err := tv.values()
+	if err != nil {
+		return nil, nil, err
+	}
+	gd, err := readGraphFile(f, vars)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	baseDir := filepath.Dir(f)
-	expandChartFilesPath(charts, baseDir)
+	charts, disabled, err := applyConditions(gd.Charts, vars)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error evaluating conditions")
+	}
+	gd.Charts = charts
+	if gd.Charts, err = addExternalDependencies(gd.Charts); err != nil {
+		return nil, nil, err
+	}
 
 	if validate {
-		for i, c := range charts {
+		for _, c := range gd.Charts {
 			if err := validateChart(c); err != nil {
-				return nil, errors.Wrapf(err, "error validating chart at offset %v", i)
+				return nil, nil, errors.Wrapf(err, "error validating chart %v", c.Name)
 			}
 		}
+		if err := gd.validateResources(); err != nil {
+			return nil, nil, errors.Wrap(err, "error validating resources")
+		}
 	}
-	return charts, nil
+	return gd, disabled, nil
+}
+
+// defaultGraphName returns the graph name derived from the input file name (without directory or extension)
+func defaultGraphName(f string) string {
+	b := filepath.Base(f)
+	return strings.TrimSuffix(b, filepath.Ext(b))
 }
 
 // expandChartFilesPath expands relative file path for charts and values
 func expandChartFilesPath(charts []ChartDefinition, baseDir string) {
 	for i := range charts {
 		c := &charts[i]
-		c.ValuesPath = expandFilePath(c.ValuesPath, baseDir)
-		c.Path = expandFilePath(c.Path, baseDir)
+		if c.ValuesPath != "" {
+			c.ValuesPath = expandFilePath(c.ValuesPath, baseDir)
+		}
+		for j := range c.ValuesFrom {
+			if c.ValuesFrom[j].SOPS != "" {
+				c.ValuesFrom[j].SOPS = expandFilePath(c.ValuesFrom[j].SOPS, baseDir)
+			}
+		}
+		if c.Path != "" && !c.remote() {
+			c.Path = expandFilePath(c.Path, baseDir)
+		}
+		if c.JobPath != "" {
+			c.JobPath = expandFilePath(c.JobPath, baseDir)
+		}
 	}
 }
 
@@ -158,46 +378,185 @@ func chartDefToChart(cd ChartDefinition) (metahelm.Chart, error) {
 		}
 	}
 	var wt time.Duration
-	dhi := metahelm.IgnorePodHealth
-	if cd.PrimaryDeployment != "" {
-		if cd.WaitForAllPods {
-			dhi = metahelm.AllPodsHealthy
-		} else {
-			dhi = metahelm.AtLeastOnePodHealthy
-		}
-	}
 	if cd.Timeout != "" {
 		wt, err = time.ParseDuration(cd.Timeout)
 		if err != nil {
 			return metahelm.Chart{}, errors.Wrap(err, "error parsing timeout")
 		}
 	}
-	if cd.WaitForHelm {
-		cd.PrimaryDeployment = ""
-		dhi = metahelm.IgnorePodHealth
+	rp, err := retryPolicy(cd.Retry)
+	if err != nil {
+		return metahelm.Chart{}, errors.Wrap(err, "error parsing retry")
 	}
+	pd, dhi := deploymentHealth(cd)
 	return metahelm.Chart{
 		Title:                      cd.Name,
 		Location:                   cd.Path,
 		ValueOverrides:             b,
+		ValuesFrom:                 valuesSources(cd.ValuesFrom),
 		WaitUntilHelmSaysItsReady:  cd.WaitForHelm,
-		WaitUntilDeployment:        cd.PrimaryDeployment,
+		WaitUntilDeployment:        pd,
 		WaitTimeout:                wt,
 		DeploymentHealthIndication: dhi,
+		RunHelmTests:               cd.RunTests,
+		Helm:                       helmOptions(cd.Helm),
+		Retry:                      rp,
 		DependencyList:             cd.Dependencies,
+		StartPriority:              cd.Priority,
+		ResourceTokens:             cd.tokens(),
 	}, nil
 }
 
-func cd2c(cds []ChartDefinition) ([]metahelm.Chart, error) {
+// valuesSource converts a values source definition into a values source
+func valuesSource(vsd ValuesSourceDefinition) metahelm.ValuesSource {
+	ref := func(okd *ObjectKeyDefinition) *metahelm.ObjectKeyRef {
+		if okd == nil {
+			return nil
+		}
+		return &metahelm.ObjectKeyRef{Name: okd.Name, Namespace: okd.Namespace, Key: okd.Key, Path: okd.Path}
+	}
+	return metahelm.ValuesSource{SOPSFile: vsd.SOPS, Secret: ref(vsd.Secret), ConfigMap: ref(vsd.ConfigMap)}
+}
+
+// valuesSources converts values source definitions into values sources
+func valuesSources(vsds []ValuesSourceDefinition) []metahelm.ValuesSource {
+	var out []metahelm.ValuesSource
+	for _, vsd := range vsds {
+		out = append(out, valuesSource(vsd))
+	}
+	return out
+}
+
+// retryPolicy converts a retry definition (which may be nil) into a retry policy
+func retryPolicy(rd *RetryDefinition) (metahelm.RetryPolicy, error) {
+	rp := metahelm.RetryPolicy{}
+	if rd == nil {
+		return rp, nil
+	}
+	rp.MaxAttempts = rd.Attempts
+	var err error
+	if rd.Backoff != "" {
+		if rp.Backoff, err = time.ParseDuration(rd.Backoff); err != nil {
+			return rp, errors.Wrap(err, "error parsing backoff")
+		}
+	}
+	if rd.MaxBackoff != "" {
+		if rp.MaxBackoff, err = time.ParseDuration(rd.MaxBackoff); err != nil {
+			return rp, errors.Wrap(err, "error parsing max_backoff")
+		}
+	}
+	for _, ec := range rd.On {
+		switch metahelm.ErrorClass(ec) {
+		case metahelm.ErrorClassAPI, metahelm.ErrorClassWebhook, metahelm.ErrorClassTimeout, metahelm.ErrorClassAny:
+			rp.RetryOn = append(rp.RetryOn, metahelm.ErrorClass(ec))
+		default:
+			return rp, fmt.Errorf("unknown error class: %v", ec)
+		}
+	}
+	return rp, nil
+}
+
+// deploymentHealth returns the primary deployment and health indication for a chart definition
+func deploymentHealth(cd ChartDefinition) (string, metahelm.HealthIndication) {
+	if cd.WaitForHelm || cd.PrimaryDeployment == "" {
+		return "", metahelm.IgnorePodHealth
+	}
+	if cd.WaitForAllPods {
+		return cd.PrimaryDeployment, metahelm.AllPodsHealthy
+	}
+	return cd.PrimaryDeployment, metahelm.AtLeastOnePodHealthy
+}
+
+// cd2c converts chart definitions into charts and non-chart steps
+func cd2c(cds []ChartDefinition) ([]metahelm.Chart, []metahelm.Step, error) {
 	cs := []metahelm.Chart{}
+	steps := []metahelm.Step{}
 	for _, cd := range cds {
+		if cd.Type != "" && cd.Type != nodeTypeChart {
+			s, err := stepDefToStep(cd)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "error converting step %v", cd.Name)
+			}
+			steps = append(steps, s)
+			continue
+		}
 		c, err := chartDefToChart(cd)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		cs = append(cs, c)
 	}
-	return cs, nil
+	return cs, steps, nil
+}
+
+func stepDefToStep(cd ChartDefinition) (metahelm.Step, error) {
+	var wt time.Duration
+	if cd.Timeout != "" {
+		var err error
+		wt, err = time.ParseDuration(cd.Timeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing timeout")
+		}
+	}
+	switch cd.Type {
+	case nodeTypeJob:
+		b, err := ioutil.ReadFile(cd.JobPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading job manifest")
+		}
+		js := &metahelm.JobStep{Title: cd.Name, WaitTimeout: wt, DependencyList: cd.Dependencies, StartPriority: cd.Priority,
+			ResourceTokens: cd.tokens()}
+		if err := sigsyaml.UnmarshalStrict(b, &js.Job); err != nil {
+			return nil, errors.Wrap(err, "error unmarshaling job manifest")
+		}
+		if js.Job.Kind != "Job" {
+			return nil, fmt.Errorf("job manifest has unexpected kind: %v", js.Job.Kind)
+		}
+		return js, nil
+	case nodeTypeManifest:
+		pd, dhi := deploymentHealth(cd)
+		return &metahelm.ManifestStep{
+			Title:                      cd.Name,
+			Location:                   cd.Path,
+			WaitUntilReady:             cd.WaitForHelm,
+			WaitUntilDeployment:        pd,
+			WaitTimeout:                wt,
+			DeploymentHealthIndication: dhi,
+			DependencyList:             cd.Dependencies,
+			StartPriority:              cd.Priority,
+			ResourceTokens:             cd.tokens(),
+		}, nil
+	case nodeTypeWait:
+		if cd.Resource == nil {
+			return nil, errors.New("resource is missing")
+		}
+		return &metahelm.WaitForResource{
+			Title:          cd.Name,
+			APIVersion:     cd.Resource.APIVersion,
+			Kind:           cd.Resource.Kind,
+			ResourceName:   cd.Resource.Name,
+			Namespace:      cd.Resource.Namespace,
+			Condition:      cd.Resource.Condition,
+			WaitTimeout:    wt,
+			DependencyList: cd.Dependencies,
+			StartPriority:  cd.Priority,
+			ResourceTokens: cd.tokens(),
+		}, nil
+	case nodeTypeExternal:
+		ed, ok, err := metahelm.ParseExternalDependency(cd.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("not an external dependency reference: %v", cd.Name)
+		}
+		ed.WaitTimeout = wt
+		ed.DependencyList = cd.Dependencies
+		ed.StartPriority = cd.Priority
+		ed.ResourceTokens = cd.tokens()
+		return ed, nil
+	}
+	return nil, fmt.Errorf("unknown type: %v", cd.Type)
 }
 
 type restClientGetter struct {
@@ -229,7 +588,8 @@ func newRestClientGetter(context, namespace string, qps float32, burst int) (*re
 	if err != nil {
 		return nil, fmt.Errorf("could not get Kubernetes client: %w", err)
 	}
-	discoveryClient := &cachedDiscoveryInterface{clientset.DiscoveryClient}
+	// the discovery cache and REST mapper are invalidated/reset by metahelm when new CRDs are established
+	discoveryClient := memory.NewMemCacheClient(clientset.Discovery())
 	restMapper := restmapper.NewDeferredDiscoveryRESTMapper(discoveryClient)
 	return &restClientGetter{
 		restConfig:          restConfig,
@@ -255,18 +615,6 @@ func (g *restClientGetter) ToRawKubeConfigLoader() clientcmd.ClientConfig {
 	return g.rawKubeConfigLoader
 }
 
-type cachedDiscoveryInterface struct {
-	discovery.DiscoveryInterface
-}
-
-var _ discovery.CachedDiscoveryInterface = &cachedDiscoveryInterface{}
-
-func (d *cachedDiscoveryInterface) Fresh() bool {
-	return false
-}
-
-func (d *cachedDiscoveryInterface) Invalidate() {}
-
 func getHelmConfig(kctx string, k8sNS string, qps float32, burst int) (*action.Configuration, error) {
 	getter, err := newRestClientGetter(kctx, k8sNS, qps, burst)
 	if err != nil {
@@ -287,14 +635,46 @@ func install(cmd *cobra.Command, args []string) {
 		clierr("input file is required")
 	}
 	fp := args[len(args)-1]
-	cds, err := readAndValidateFile(fp, true)
+	pp, err := metahelm.ParsePendingReleasePolicy(instConfig.pendingPolicyName)
+	if err != nil {
+		clierr("error with --pending-release-policy: %v", err)
+	}
+	instConfig.pendingPolicy = pp
+	switch instConfig.lockMismatch {
+	case lockMismatchFail, lockMismatchWarn, lockMismatchIgnore:
+	default:
+		clierr("unknown --lock-mismatch value: %v", instConfig.lockMismatch)
+	}
+	if instConfig.concurrency < 0 {
+		clierr("--concurrency must not be negative")
+	}
+	gd, disabled, err := readAndValidateFile(fp, true, instConfig.templateVars)
 	if err != nil {
 		clierr("error reading input: %v", err)
 	}
-	cs, err := cd2c(cds)
+	if instConfig.graphName == "" {
+		instConfig.graphName = gd.Name
+	}
+	if instConfig.graphName == "" {
+		instConfig.graphName = defaultGraphName(fp)
+	}
+	instConfig.resourceLimits = gd.Resources
+	cds := gd.Charts
+	if err := resolveCharts(cds, lockFilePath(fp, instConfig.lockFile), instConfig.lockMismatch); err != nil {
+		clierr("error resolving charts: %v", err)
+	}
+	cs, steps, err := cd2c(cds)
 	if err != nil {
 		clierr("error converting chart definitions: %v", err)
 	}
+	if err := metahelm.ValidateCharts(cs, steps...); err != nil {
+		clierr("error validating graph: %v", err)
+	}
+	for _, s := range steps {
+		if ms, ok := s.(*metahelm.ManifestStep); ok {
+			ms.InventoryName = metahelm.ManifestInventoryName(instConfig.releaseNamePrefix, ms.Title)
+		}
+	}
 	cfg, err := getHelmConfig(instConfig.k8sCtx, instConfig.k8sNS, instConfig.restConfig.QPS, instConfig.restConfig.Burst)
 	if err != nil {
 		clierr("error getting Helm config: %v", err)
@@ -305,12 +685,28 @@ func install(cmd *cobra.Command, args []string) {
 		K8c:  clientset,
 		LogF: log.Printf,
 	}
+	if instConfig.dryRun {
+		if !instConfig.prune {
+			clierr("--dry-run requires --prune")
+		}
+		orphans, err := m.Orphans(context.Background(), chartsToKeep(cs, disabled), instConfig.ToInstallOptions()...)
+		if err != nil {
+			clierr("error getting releases to prune: %v", err)
+		}
+		if len(orphans) == 0 {
+			fmt.Printf("Nothing to prune\n")
+		}
+		for _, o := range orphans {
+			fmt.Printf("Would prune chart: %v => release: %v\n", o.Title, o.ReleaseName)
+		}
+		return
+	}
 	var rm metahelm.ReleaseMap
 	if instConfig.upgrade {
-		rm = buildReleaseMap(instConfig, cs)
-		err = m.Upgrade(context.Background(), rm, cs, instConfig.ToInstallOptions()...)
+		rm = buildReleaseMap(instConfig.releaseNamePrefix, cs)
+		err = m.Upgrade(context.Background(), rm, cs, append(instConfig.ToInstallOptions(), metahelm.WithSteps(steps...))...)
 	} else {
-		rm, err = m.Install(context.Background(), cs, instConfig.ToInstallOptions()...)
+		rm, err = m.Install(context.Background(), cs, append(instConfig.ToInstallOptions(), metahelm.WithSteps(steps...))...)
 	}
 
 	if err != nil {
@@ -323,14 +719,32 @@ func install(cmd *cobra.Command, args []string) {
 	for k, v := range rm {
 		fmt.Printf("Chart: %v => release: %v\n", k, v)
 	}
+	if instConfig.prune {
+		pruned, err := m.Prune(context.Background(), chartsToKeep(cs, disabled), instConfig.ToInstallOptions()...)
+		for _, p := range pruned {
+			fmt.Printf("Pruned chart: %v => release: %v\n", p.Title, p.ReleaseName)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error pruning releases: %v\n", err)
+		}
+	}
+}
+
+// chartsToKeep returns the charts whose releases are not pruned: the charts of the graph and the charts disabled by their enabled expressions
+func chartsToKeep(cs []metahelm.Chart, disabled []disabledChart) []metahelm.Chart {
+	out := append([]metahelm.Chart{}, cs...)
+	for _, dc := range disabled {
+		out = append(out, metahelm.Chart{Title: dc.name})
+	}
+	return out
 }
 
-// buildReleaseMap build the release title to releaseName map using user input and charts definitions
-func buildReleaseMap(instConfig installCfg, cs []metahelm.Chart) metahelm.ReleaseMap {
+// buildReleaseMap build the release title to releaseName map using the release name prefix and charts definitions
+func buildReleaseMap(releaseNamePrefix string, cs []metahelm.Chart) metahelm.ReleaseMap {
 	rm := make(map[string]string)
 	for _, c := range cs {
 		if _, ok := rm[c.Title]; !ok {
-			rm[c.Title] = metahelm.ReleaseName(instConfig.releaseNamePrefix + c.Title)
+			rm[c.Title] = metahelm.ReleaseName(releaseNamePrefix + c.Title)
 		}
 	}
 	return rm
@@ -341,6 +755,24 @@ func (instConfig *installCfg) ToInstallOptions() []metahelm.InstallOption {
 	if instConfig.k8sNS != "" {
 		options = append(options, metahelm.WithK8sNamespace(instConfig.k8sNS))
 	}
+	if instConfig.releaseNamePrefix != "" {
+		options = append(options, metahelm.WithReleaseNamePrefix(instConfig.releaseNamePrefix))
+	}
+	if instConfig.concurrency > 0 {
+		options = append(options, metahelm.WithConcurrency(instConfig.concurrency))
+	}
+	if instConfig.ageKeyFile != "" {
+		options = append(options, metahelm.WithAgeKeyFile(instConfig.ageKeyFile))
+	}
+	if len(instConfig.resourceLimits) > 0 {
+		options = append(options, metahelm.WithResourceLimits(instConfig.resourceLimits))
+	}
+	if instConfig.graphName != "" {
+		options = append(options, metahelm.WithGraphName(instConfig.graphName))
+	}
+	if instConfig.pendingPolicy != metahelm.FailOnPending {
+		options = append(options, metahelm.WithPendingReleasePolicy(instConfig.pendingPolicy))
+	}
 	return options
 }
 
@@ -349,46 +781,76 @@ func displayChartError(ce metahelm.ChartError) {
 		fmt.Printf("%v: %v\n", t, k)
 		for _, fp := range v {
 			fmt.Printf("\tPod: %v\n", fp.Name)
+			fmt.Printf("\tSummary: %v\n", fp.Summary)
 			fmt.Printf("\tPhase: %v\n", fp.Phase)
 			fmt.Printf("\tReason: %v\n", fp.Reason)
 			fmt.Printf("\tMessage: %v\n", fp.Message)
 			fmt.Printf("\tConditions: %+v\n", fp.Conditions)
-			fmt.Printf("\tContainer Statuses: %+v\n", fp.ContainerStatuses)
-			fmt.Printf("\tContainer Logs:")
-			if len(fp.Logs) == 0 {
-				fmt.Printf(" <none>")
+			if len(fp.InitContainerStatuses) > 0 {
+				fmt.Printf("\tInit Container Statuses: %+v\n", fp.InitContainerStatuses)
 			}
-			fmt.Printf("\n")
-			for name, logs := range fp.Logs {
-				fmt.Printf("\t\tContainer: %v\n", name)
-				fmt.Printf("\t\tLogs:\n")
-				if len(logs) > 0 {
-					fmt.Printf("\n====LOG START====\n")
-					os.Stdout.Write(logs)
-					fmt.Printf("\n====LOG END====\n")
-				} else {
-					fmt.Printf("<empty>\n")
+			fmt.Printf("\tContainer Statuses: %+v\n", fp.ContainerStatuses)
+			printEvents("\t", fp.Events)
+			printLogs := func(title string, lm map[string][]byte) {
+				fmt.Printf("\t%v:", title)
+				if len(lm) == 0 {
+					fmt.Printf(" <none>")
 				}
-				fmt.Printf("\n\n")
+				fmt.Printf("\n")
+				for name, logs := range lm {
+					fmt.Printf("\t\tContainer: %v\n", name)
+					fmt.Printf("\t\tLogs:\n")
+					if len(logs) > 0 {
+						fmt.Printf("\n====LOG START====\n")
+						os.Stdout.Write(logs)
+						fmt.Printf("\n====LOG END====\n")
+					} else {
+						fmt.Printf("<empty>\n")
+					}
+					fmt.Printf("\n\n")
+				}
+			}
+			printLogs("Container Logs", fp.Logs)
+			if len(fp.PreviousLogs) > 0 {
+				printLogs("Previous Container Logs", fp.PreviousLogs)
 			}
 		}
 	}
-	if len(ce.FailedDeployments) > 0 {
-		fmt.Printf("FAILED DEPLOYMENTS:\n===================\n")
-		for k, v := range ce.FailedDeployments {
-			printFailedPods("Deployment", k, v)
+	for _, fw := range []struct {
+		kind, title string
+		failed      map[string][]metahelm.FailedPod
+	}{
+		{"Deployment", "FAILED DEPLOYMENTS", ce.FailedDeployments},
+		{"StatefulSet", "FAILED STATEFULSETS", ce.FailedStatefulSets},
+		{"DaemonSet", "FAILED DAEMONSETS", ce.FailedDaemonSets},
+		{"ReplicaSet", "FAILED REPLICASETS", ce.FailedReplicaSets},
+		{"Job", "FAILED JOBS", ce.FailedJobs},
+		{"CronJob", "FAILED CRONJOBS", ce.FailedCronJobs},
+		{"Test", "FAILED TESTS", ce.FailedTests},
+	} {
+		if len(fw.failed) > 0 {
+			fmt.Printf("%v:\n===================\n", fw.title)
+			for k, v := range fw.failed {
+				printFailedPods(fw.kind, k, v)
+			}
 		}
 	}
-	if len(ce.FailedJobs) > 0 {
-		fmt.Printf("FAILED JOBS:\n===================\n")
-		for k, v := range ce.FailedJobs {
-			printFailedPods("Job", k, v)
+	if len(ce.Events) > 0 {
+		fmt.Printf("EVENTS:\n===================\n")
+		for k, v := range ce.Events {
+			fmt.Printf("%v\n", k)
+			printEvents("", v)
 		}
 	}
-	if len(ce.FailedDaemonSets) > 0 {
-		fmt.Printf("FAILED DAEMONSETS:\n===================\n")
-		for k, v := range ce.FailedDaemonSets {
-			printFailedPods("DaemonSet", k, v)
-		}
+}
+
+func printEvents(indent string, events []metahelm.Event) {
+	fmt.Printf("%vEvents:", indent)
+	if len(events) == 0 {
+		fmt.Printf(" <none>")
+	}
+	fmt.Printf("\n")
+	for _, e := range events {
+		fmt.Printf("%v\t%v\t%v\t%v (x%v, last seen %v)\n", indent, e.Type, e.Reason, e.Message, e.Count, e.LastSeen.Format(time.RFC3339))
 	}
 }
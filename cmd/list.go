@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/graphext/metahelm/pkg/metahelm"
+	"github.com/spf13/cobra"
+)
+
+type listCfg struct {
+	k8sCtx            string
+	k8sNS             string
+	releaseNamePrefix string
+	output            string
+	qps               float32
+	burst             int
+}
+
+var lsConfig listCfg
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list [options]",
+	Short: "List graphs of charts installed in the cluster",
+	Long: `Lists the graphs of charts recorded by metahelm install, across all namespaces by default,
+with the number of charts, overall release health and last update time of each.`,
+	Run: list,
+}
+
+func init() {
+	listCmd.Flags().StringVar(&lsConfig.k8sNS, "k8s-namespace", "", "only list graphs in this k8s namespace (default: all namespaces)")
+	listCmd.Flags().StringVar(&lsConfig.k8sCtx, "k8s-ctx", "", "k8s context")
+	listCmd.Flags().StringVar(&lsConfig.releaseNamePrefix, "release-name-prefix", "", "only list graphs with a release name prefix starting with this value")
+	listCmd.Flags().StringVarP(&lsConfig.output, "output", "o", "table", "output format (table or json)")
+	listCmd.Flags().Float32Var(&lsConfig.qps, "qps", 50, "Override maximum QPS to the master from this client")
+	listCmd.Flags().IntVar(&lsConfig.burst, "burst", 100, "Override maximum burst for throttle")
+	RootCmd.AddCommand(listCmd)
+}
+
+func list(cmd *cobra.Command, args []string) {
+	if lsConfig.output != "table" && lsConfig.output != "json" {
+		clierr("unknown output format: %v", lsConfig.output)
+	}
+	cfg, err := getHelmConfig(lsConfig.k8sCtx, lsConfig.k8sNS, lsConfig.qps, lsConfig.burst)
+	if err != nil {
+		clierr("error getting Helm config: %v", err)
+	}
+	clientset, err := cfg.KubernetesClientSet()
+	if err != nil {
+		clierr("error getting kubernetes client: %v", err)
+	}
+	m := metahelm.Manager{
+		HCfg: cfg,
+		K8c:  clientset,
+	}
+	var opts []metahelm.InstallOption
+	if lsConfig.k8sNS != "" {
+		opts = append(opts, metahelm.WithK8sNamespace(lsConfig.k8sNS))
+	}
+	if lsConfig.releaseNamePrefix != "" {
+		opts = append(opts, metahelm.WithReleaseNamePrefix(lsConfig.releaseNamePrefix))
+	}
+	gl, err := m.ListGraphs(context.Background(), opts...)
+	if err != nil {
+		clierr("error listing graphs: %v", err)
+	}
+	if lsConfig.output == "json" {
+		b, err := json.MarshalIndent(gl, "", "  ")
+		if err != nil {
+			clierr("error marshaling graphs: %v", err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tNAMESPACE\tPREFIX\tCHARTS\tHEALTH\tUPDATED\n")
+	for _, g := range gl {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", g.Name, g.Namespace, g.ReleaseNamePrefix, g.ChartCount, g.Health, g.Updated.Local().Format(time.RFC3339))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/graphext/metahelm/pkg/metahelm"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+)
+
+// Lock mismatch modes for install
+const (
+	lockMismatchFail   = "fail"
+	lockMismatchWarn   = "warn"
+	lockMismatchIgnore = "ignore"
+)
+
+var lockFile string
+var lockTemplateVars templateVars
+
+// lockCmd represents the lock command
+var lockCmd = &cobra.Command{
+	Use:   "lock [options] <file>",
+	Short: "Pin the chart versions and digests of a graph",
+	Long: `Resolves every chart of the graph (local directory or archive, repository or OCI reference) to an exact version
+and content digest and writes them to a lock file (metahelm.lock next to the input file by default).
+metahelm install verifies the charts against the lock file if it exists.`,
+	Run: lock,
+}
+
+func init() {
+	lockCmd.Flags().StringVar(&lockFile, "lock-file", "", "lock file path (default: metahelm.lock in the directory of the input file)")
+	lockTemplateVars.addFlags(lockCmd)
+	RootCmd.AddCommand(lockCmd)
+}
+
+// remote returns whether the chart is in a repository or an OCI registry (as opposed to the local filesystem)
+func (cd ChartDefinition) remote() bool {
+	return cd.Repo != "" || registry.IsOCI(cd.Path)
+}
+
+// lockFilePath returns the lock file path for the input file f
+func lockFilePath(f, lf string) string {
+	if lf != "" {
+		return lf
+	}
+	return filepath.Join(filepath.Dir(f), metahelm.DefaultLockFileName)
+}
+
+func newRegistryClient() (*registry.Client, error) {
+	return registry.NewClient(registry.ClientOptWriter(os.Stderr), registry.ClientOptCredentialsFile(cli.New().RegistryConfig))
+}
+
+func lock(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		clierr("input file is required")
+	}
+	fp := args[len(args)-1]
+	vars, err := lockTemplateVars.values()
+	if err != nil {
+		clierr("error getting template variables: %v", err)
+	}
+	// all charts are locked, regardless of whether they are enabled
+	gd, err := readGraphFile(fp, vars)
+	if err != nil {
+		clierr("error reading input: %v", err)
+	}
+	rc, err := newRegistryClient()
+	if err != nil {
+		clierr("error getting registry client: %v", err)
+	}
+	baseDir := filepath.Dir(fp)
+	lf := &metahelm.LockFile{Generated: time.Now().UTC()}
+	for _, cd := range gd.Charts {
+		if cd.Type != "" && cd.Type != nodeTypeChart {
+			continue
+		}
+		p, err := metahelm.LocateChart(cd.Path, cd.Repo, cd.Version, rc)
+		if err != nil {
+			clierr("error locating chart %v: %v", cd.Name, err)
+		}
+		v, d, err := metahelm.ChartDigest(p)
+		if err != nil {
+			clierr("error getting digest of chart %v: %v", cd.Name, err)
+		}
+		src := cd.Path
+		if !cd.remote() {
+			if rel, err := filepath.Rel(baseDir, cd.Path); err == nil {
+				src = rel
+			}
+		}
+		lf.Charts = append(lf.Charts, metahelm.LockedChart{Title: cd.Name, Source: src, RepoURL: cd.Repo, Version: v, Digest: d})
+		fmt.Printf("Locked chart: %v => version: %v, digest: %v\n", cd.Name, v, d)
+	}
+	lp := lockFilePath(fp, lockFile)
+	if err := metahelm.WriteLockFile(lp, lf); err != nil {
+		clierr("error writing lock file: %v", err)
+	}
+	fmt.Printf("Wrote %v\n", lp)
+}
+
+// resolveCharts replaces the paths of repository and OCI charts with the paths of the downloaded archives and, if the lock file exists,
+// pins them to the locked versions and verifies the digests of all charts according to mismatch (fail, warn or ignore)
+func resolveCharts(cds []ChartDefinition, lockPath, mismatch string) error {
+	var lf *metahelm.LockFile
+	if mismatch != lockMismatchIgnore {
+		if _, err := os.Stat(lockPath); err == nil {
+			lf, err = metahelm.ReadLockFile(lockPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	var rc *registry.Client
+	for i := range cds {
+		cd := &cds[i]
+		if cd.Type != "" && cd.Type != nodeTypeChart {
+			continue
+		}
+		if cd.remote() {
+			version := cd.Version
+			if lf != nil {
+				if lc, ok := lf.Get(cd.Name); ok {
+					version = lc.Version
+				}
+			}
+			if rc == nil {
+				var err error
+				if rc, err = newRegistryClient(); err != nil {
+					return errors.Wrap(err, "error getting registry client")
+				}
+			}
+			p, err := metahelm.LocateChart(cd.Path, cd.Repo, version, rc)
+			if err != nil {
+				return errors.Wrapf(err, "error locating chart %v", cd.Name)
+			}
+			cd.Path = p
+		}
+		if lf == nil {
+			continue
+		}
+		v, d, err := metahelm.ChartDigest(cd.Path)
+		if err != nil {
+			return errors.Wrapf(err, "error getting digest of chart %v", cd.Name)
+		}
+		if err := lf.Verify(cd.Name, v, d); err != nil {
+			if mismatch == lockMismatchWarn {
+				log.Printf("warning: %v", err)
+				continue
+			}
+			return errors.Wrap(err, "lock mismatch (run metahelm lock to update the lock file, or use --lock-mismatch warn)")
+		}
+	}
+	return nil
+}
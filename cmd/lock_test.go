@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/graphext/metahelm/pkg/metahelm"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// lockCharts writes a lock file at lp pinning the charts in cds at their current versions and digests
+func lockCharts(t *testing.T, lp string, cds []ChartDefinition) {
+	t.Helper()
+	lf := &metahelm.LockFile{Generated: time.Now().UTC()}
+	for _, cd := range cds {
+		v, d, err := metahelm.ChartDigest(cd.Path)
+		if err != nil {
+			t.Fatalf("error getting digest: %v", err)
+		}
+		lf.Charts = append(lf.Charts, metahelm.LockedChart{Title: cd.Name, Source: cd.Path, Version: v, Digest: d})
+	}
+	if err := metahelm.WriteLockFile(lp, lf); err != nil {
+		t.Fatalf("error writing lock file: %v", err)
+	}
+}
+
+func TestResolveChartsLocal(t *testing.T) {
+	cases := []struct {
+		name     string
+		mismatch string
+		modify   bool // modify the chart after locking
+		unlocked bool // add a chart that isn't in the lock file
+		errMsg   string
+	}{
+		{name: "match", mismatch: lockMismatchFail},
+		{name: "modified fail", mismatch: lockMismatchFail, modify: true, errMsg: "doesn't match the lock file"},
+		{name: "modified warn", mismatch: lockMismatchWarn, modify: true},
+		{name: "modified ignore", mismatch: lockMismatchIgnore, modify: true},
+		{name: "missing fail", mismatch: lockMismatchFail, unlocked: true, errMsg: "chart other is not in the lock file"},
+		{name: "missing warn", mismatch: lockMismatchWarn, unlocked: true},
+		{name: "missing ignore", mismatch: lockMismatchIgnore, unlocked: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeGraphFiles(t, dir, map[string]string{
+				"c/Chart.yaml":  "apiVersion: v2\nname: c\nversion: 0.1.0\n",
+				"c/values.yaml": "replicas: 1\n",
+			})
+			cds := []ChartDefinition{
+				{Name: "app", Path: filepath.Join(dir, "c")},
+				// non-chart nodes aren't locked
+				{Name: "migrations", Type: nodeTypeJob, JobPath: filepath.Join(dir, "job.yaml")},
+			}
+			lp := filepath.Join(dir, metahelm.DefaultLockFileName)
+			lockCharts(t, lp, cds[:1])
+			if c.modify {
+				writeGraphFiles(t, dir, map[string]string{"c/values.yaml": "replicas: 2\n"})
+			}
+			if c.unlocked {
+				cds = append(cds, ChartDefinition{Name: "other", Path: filepath.Join(dir, "c")})
+			}
+			err := resolveCharts(cds, lp, c.mismatch)
+			if c.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), c.errMsg) {
+					t.Fatalf("should have failed with %q: %v", c.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+		})
+	}
+}
+
+func TestResolveChartsNoLockFile(t *testing.T) {
+	dir := t.TempDir()
+	writeGraphFiles(t, dir, map[string]string{"c/Chart.yaml": "apiVersion: v2\nname: c\nversion: 0.1.0\n"})
+	cds := []ChartDefinition{{Name: "app", Path: filepath.Join(dir, "c")}}
+	if err := resolveCharts(cds, filepath.Join(dir, metahelm.DefaultLockFileName), lockMismatchFail); err != nil {
+		t.Fatalf("should have succeeded without a lock file: %v", err)
+	}
+}
+
+func TestResolveChartsRemotePinned(t *testing.T) {
+	helmHome := t.TempDir()
+	t.Setenv("HELM_CACHE_HOME", filepath.Join(helmHome, "cache"))
+	t.Setenv("HELM_CONFIG_HOME", filepath.Join(helmHome, "config"))
+	t.Setenv("HELM_DATA_HOME", filepath.Join(helmHome, "data"))
+	repoDir := t.TempDir()
+	for _, v := range []string{"0.1.0", "0.2.0"} {
+		ch := &chart.Chart{
+			Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "c", Version: v},
+			Values:   map[string]interface{}{},
+		}
+		if _, err := chartutil.Save(ch, repoDir); err != nil {
+			t.Fatalf("error saving chart: %v", err)
+		}
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(repoDir)))
+	defer srv.Close()
+	idx, err := repo.IndexDirectory(repoDir, srv.URL)
+	if err != nil {
+		t.Fatalf("error indexing repository: %v", err)
+	}
+	if err := idx.WriteFile(filepath.Join(repoDir, "index.yaml"), 0644); err != nil {
+		t.Fatalf("error writing index: %v", err)
+	}
+	v, d, err := metahelm.ChartDigest(filepath.Join(repoDir, "c-0.1.0.tgz"))
+	if err != nil {
+		t.Fatalf("error getting digest: %v", err)
+	}
+	dir := t.TempDir()
+	lp := filepath.Join(dir, metahelm.DefaultLockFileName)
+	lf := &metahelm.LockFile{Charts: []metahelm.LockedChart{{Title: "app", Source: "c", RepoURL: srv.URL, Version: v, Digest: d}}}
+	if err := metahelm.WriteLockFile(lp, lf); err != nil {
+		t.Fatalf("error writing lock file: %v", err)
+	}
+	// without a version the latest chart is used
+	cds := []ChartDefinition{{Name: "app", Path: "c", Repo: srv.URL}}
+	if err := resolveCharts(cds, lp, lockMismatchIgnore); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if v, _, err := metahelm.ChartDigest(cds[0].Path); err != nil || v != "0.2.0" {
+		t.Fatalf("the latest chart should have been used: %v (%v)", v, err)
+	}
+	cds = []ChartDefinition{{Name: "app", Path: "c", Repo: srv.URL}}
+	if err := resolveCharts(cds, lp, lockMismatchFail); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if v, _, err := metahelm.ChartDigest(cds[0].Path); err != nil || v != "0.1.0" {
+		t.Fatalf("chart should have been pinned to the locked version: %v (%v)", v, err)
+	}
+	if _, err := ioutil.ReadFile(cds[0].Path); err != nil {
+		t.Fatalf("chart should have been downloaded: %v", err)
+	}
+}
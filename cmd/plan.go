@@ -1,28 +1,65 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/graphext/metahelm/pkg/dag"
+	"github.com/graphext/metahelm/pkg/metahelm"
 	"github.com/spf13/cobra"
 )
 
 // planCmd represents the plan command
 var planCmd = &cobra.Command{
-	Use:   "plan <file>.yml",
+	Use:   "plan <file>.yml | plan --compare <old>.yml <new>.yml",
 	Short: "Display installation info about a graph of charts",
 	Long: `Generates the dependency graph from a list of charts and displays the installation
-order with graph levels, and optionally a visual image of the graph.`,
+order with graph levels, and optionally a visual image of the graph.
+With --critical-path, it also displays the expected total time, the earliest start and slack of each chart and the critical path,
+using the durations recorded in the cluster by the last install (with --recorded-durations) or the expected_duration of each chart.
+With --compare, it displays the differences between two graph definitions instead: added and removed charts and dependencies,
+changed dependency qualifiers and installation phases, and changed chart fields.`,
 	Run: plan,
 }
 
 var opencmd = "<unknown>"
 var dotcmd string
 var genpng, validate bool
+var planTemplateVars templateVars
+
+type planCfg struct {
+	criticalPath      bool
+	recordedDurations bool
+	graphName         string
+	k8sCtx            string
+	k8sNS             string
+	releaseNamePrefix string
+	format            string
+	out               string
+	compare           bool
+	render            bool
+}
+
+var plConfig planCfg
+
+// Graph rendering formats for plan --format
+const (
+	formatASCII   = "ascii"
+	formatMermaid = "mermaid"
+	formatDot     = "dot"
+	formatSVG     = "svg"
+	formatJSON    = "json"
+)
 
 func init() {
 	switch runtime.GOOS {
@@ -37,6 +74,18 @@ func init() {
 	planCmd.Flags().StringVar(&dotcmd, "dot-cmd", "dot", "dot CLI command (to generate PNG)")
 	planCmd.Flags().BoolVarP(&genpng, "gen-png", "g", false, "generate and display PNG graph")
 	planCmd.Flags().BoolVar(&validate, "validate", true, "validate charts")
+	planTemplateVars.addFlags(planCmd)
+	planTemplateVars.addSetVarFlag(planCmd)
+	planCmd.Flags().BoolVar(&plConfig.render, "render", false, "print the graph file and the files it includes rendered with the template variables, and exit")
+	planCmd.Flags().BoolVar(&plConfig.criticalPath, "critical-path", false, "display the expected schedule and critical path (highlighted in the rendered graph)")
+	planCmd.Flags().BoolVar(&plConfig.recordedDurations, "recorded-durations", false, "use the chart durations recorded in the cluster by the last install of the graph for --critical-path")
+	planCmd.Flags().StringVar(&plConfig.graphName, "graph-name", "", "graph name for --recorded-durations (default: the name in the input file, or its file name without extension)")
+	planCmd.Flags().StringVar(&plConfig.k8sCtx, "k8s-ctx", "", "k8s context for --recorded-durations")
+	planCmd.Flags().StringVar(&plConfig.k8sNS, "k8s-namespace", "", "k8s namespace where the graph is installed for --recorded-durations")
+	planCmd.Flags().StringVar(&plConfig.releaseNamePrefix, "release-name-prefix", "", "release name prefix for --recorded-durations")
+	planCmd.Flags().StringVar(&plConfig.format, "format", "", "render the graph in this format: ascii, mermaid, dot, svg or json (to stdout, or to --out; the plan summary is then written to stderr)")
+	planCmd.Flags().StringVar(&plConfig.out, "out", "", "file to write the rendered graph (or the comparison, with --compare) to")
+	planCmd.Flags().BoolVar(&plConfig.compare, "compare", false, "compare two graph definitions (plan --compare <old file> <new file>); use --format json for machine-readable output")
 	RootCmd.AddCommand(planCmd)
 }
 
@@ -44,12 +93,33 @@ func plan(cmd *cobra.Command, args []string) {
 	if len(args) == 0 {
 		clierr("input file is required")
 	}
+	switch plConfig.format {
+	case "", formatASCII, formatMermaid, formatDot, formatSVG, formatJSON:
+	default:
+		clierr("unknown format: %v", plConfig.format)
+	}
+	if plConfig.compare {
+		planCompare(args)
+		return
+	}
+	if plConfig.render {
+		planRender(args)
+		return
+	}
+	if plConfig.out != "" && plConfig.format == "" {
+		clierr("--out requires --format")
+	}
+	// keep stdout for the rendered graph
+	sw := io.Writer(os.Stdout)
+	if plConfig.format != "" && plConfig.out == "" {
+		sw = os.Stderr
+	}
 	fp := args[len(args)-1]
-	cds, err := readAndValidateFile(fp, validate)
+	gd, disabled, err := readAndValidateFile(fp, validate, planTemplateVars)
 	if err != nil {
 		clierr("error reading input: %v", err)
 	}
-	cs, err := cd2c(cds)
+	cs, steps, err := cd2c(gd.Charts)
 	if err != nil {
 		clierr("error converting chart definitions: %v", err)
 	}
@@ -57,6 +127,9 @@ func plan(cmd *cobra.Command, args []string) {
 	for i := range cs {
 		objs = append(objs, &cs[i])
 	}
+	for _, s := range steps {
+		objs = append(objs, s)
+	}
 	og := dag.ObjectGraph{}
 	err = og.Build(objs)
 	if err != nil {
@@ -66,14 +139,46 @@ func plan(cmd *cobra.Command, args []string) {
 	if err != nil {
 		clierr("error getting graph info: %v", err)
 	}
-	fmt.Printf("Graph Root: %v\n", r.Name())
+	fmt.Fprintf(sw, "Graph Root: %v\n", r.Name())
 	j := 1
 	for i := len(lvls) - 1; i >= 0; i-- {
-		fmt.Printf("Phase %v: %v\n", j, lvls[i])
+		fmt.Fprintf(sw, "Phase %v: %v\n", j, lvls[i])
 		j++
 	}
+	for _, dc := range disabled {
+		fmt.Fprintf(sw, "Disabled: %v (enabled: %v): %v\n", dc.name, dc.enabled, dc.reason)
+	}
+	og.ResourceLimits = gd.Resources
+	displayResources(sw, &og)
+	var highlight []string
+	if plConfig.criticalPath {
+		durations, err := planDurations(fp, gd)
+		if err != nil {
+			clierr("error getting durations: %v", err)
+		}
+		cp, err := og.CriticalPath(durations)
+		if err != nil {
+			clierr("error calculating critical path: %v", err)
+		}
+		displayCriticalPath(sw, cp, durations)
+		highlight = cp.Path
+	}
+	if plConfig.format != "" {
+		b, err := renderGraph(&og, plConfig.format, highlight)
+		if err != nil {
+			clierr("error rendering graph: %v", err)
+		}
+		if plConfig.out == "" {
+			os.Stdout.Write(b)
+		} else {
+			if err := ioutil.WriteFile(plConfig.out, b, 0644); err != nil {
+				clierr("error writing rendered graph: %v", err)
+			}
+			fmt.Fprintf(os.Stderr, "wrote %v output to %v\n", plConfig.format, plConfig.out)
+		}
+	}
 	if genpng {
-		b, err := og.Dot("metahelm_plan")
+		b, err := og.Dot("metahelm_plan", highlight...)
 		if err != nil {
 			clierr("error generating dot output: %v", err)
 		}
@@ -95,3 +200,155 @@ func plan(cmd *cobra.Command, args []string) {
 		}
 	}
 }
+
+// planRender prints the input file and the files it includes, rendered as templates
+func planRender(args []string) {
+	vars, err := planTemplateVars.values()
+	if err != nil {
+		clierr("error getting template variables: %v", err)
+	}
+	if _, err := (&graphLoader{vars: vars, rendered: os.Stdout}).load(args[len(args)-1]); err != nil {
+		clierr("error reading input: %v", err)
+	}
+}
+
+func planCompare(args []string) {
+	if len(args) != 2 {
+		clierr("--compare requires the old and new input files")
+	}
+	if plConfig.format != "" && plConfig.format != formatJSON {
+		clierr("unsupported format for --compare: %v (use json)", plConfig.format)
+	}
+	gc, err := compareGraphFiles(args[0], args[1], planTemplateVars)
+	if err != nil {
+		clierr("error comparing graphs: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if plConfig.format == formatJSON {
+		b, err := marshalComparison(gc)
+		if err != nil {
+			clierr("%v", err)
+		}
+		buf.Write(b)
+	} else {
+		displayComparison(buf, gc)
+	}
+	if plConfig.out == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	if err := ioutil.WriteFile(plConfig.out, buf.Bytes(), 0644); err != nil {
+		clierr("error writing comparison: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "wrote comparison to %v\n", plConfig.out)
+}
+
+// planDurations returns the expected duration of each chart: the one recorded in the cluster (with --recorded-durations) or its
+// expected_duration
+func planDurations(fp string, gd *GraphDefinition) (map[string]time.Duration, error) {
+	out := map[string]time.Duration{}
+	for _, cd := range gd.Charts {
+		if cd.ExpectedDuration == "" {
+			continue
+		}
+		d, err := time.ParseDuration(cd.ExpectedDuration)
+		if err != nil {
+			return nil, fmt.Errorf("bad expected_duration for chart %v: %w", cd.Name, err)
+		}
+		out[cd.Name] = d
+	}
+	if !plConfig.recordedDurations {
+		return out, nil
+	}
+	gn := plConfig.graphName
+	if gn == "" {
+		gn = gd.Name
+	}
+	if gn == "" {
+		gn = defaultGraphName(fp)
+	}
+	ns := plConfig.k8sNS
+	if ns == "" {
+		ns = metahelm.DefaultK8sNamespace
+	}
+	cfg, err := getHelmConfig(plConfig.k8sCtx, plConfig.k8sNS, 50, 100)
+	if err != nil {
+		return nil, fmt.Errorf("error getting Helm config: %w", err)
+	}
+	clientset, err := cfg.KubernetesClientSet()
+	if err != nil {
+		return nil, fmt.Errorf("error getting kubernetes client: %w", err)
+	}
+	m := metahelm.Manager{HCfg: cfg, K8c: clientset}
+	gs, err := m.GetGraphState(context.Background(), ns, gn, plConfig.releaseNamePrefix)
+	if err != nil {
+		return nil, err
+	}
+	if gs == nil {
+		fmt.Fprintf(os.Stderr, "no recorded state for graph %v in namespace %v; using expected durations\n", gn, ns)
+		return out, nil
+	}
+	for title, d := range gs.Durations() {
+		out[title] = d
+	}
+	return out, nil
+}
+
+// displayResources writes the resources used by the graph objects, with their limits and users
+func displayResources(w io.Writer, og *dag.ObjectGraph) {
+	users := og.ResourceUsers()
+	names := []string{}
+	for r := range users {
+		names = append(names, r)
+	}
+	sort.Strings(names)
+	for _, r := range names {
+		limit, ok := og.ResourceLimits[r]
+		if !ok {
+			limit = 1
+		}
+		fmt.Fprintf(w, "Resource %v (limit %v): %v\n", r, limit, strings.Join(users[r], ", "))
+	}
+}
+
+func displayCriticalPath(w io.Writer, cp *dag.CriticalPath, durations map[string]time.Duration) {
+	fmt.Fprintf(w, "\nExpected total time: %v\n", cp.Total)
+	fmt.Fprintf(w, "Critical path: %v\n\n", strings.Join(cp.Path, " -> "))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "CHART\tDURATION\tEARLIEST START\tSLACK\tCRITICAL\n")
+	unknown := []string{}
+	for _, ns := range cp.Nodes {
+		d := ns.Duration.String()
+		if _, ok := durations[ns.Name]; !ok {
+			d = "-"
+			unknown = append(unknown, ns.Name)
+		}
+		crit := ""
+		if ns.Critical {
+			crit = "*"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", ns.Name, d, ns.EarliestStart, ns.Slack, crit)
+	}
+	tw.Flush()
+	if len(unknown) > 0 {
+		fmt.Fprintf(w, "\nNo duration for: %v (assumed to take no time; set expected_duration)\n", strings.Join(unknown, ", "))
+	}
+}
+
+// renderGraph renders the graph in format, with the nodes in highlight highlighted (if the format supports it)
+func renderGraph(og *dag.ObjectGraph, format string, highlight []string) ([]byte, error) {
+	switch format {
+	case formatASCII:
+		return og.ASCII(), nil
+	case formatMermaid:
+		return og.Mermaid(highlight...), nil
+	case formatDot:
+		return og.Dot("metahelm_plan", highlight...)
+	case formatSVG:
+		return og.SVG(highlight...), nil
+	case formatJSON:
+		return og.JSON()
+	default:
+		return nil, fmt.Errorf("unknown format: %v", format)
+	}
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/graphext/metahelm/pkg/metahelm"
+	"github.com/spf13/cobra"
+)
+
+type statusCfg struct {
+	k8sCtx            string
+	k8sNS             string
+	releaseNamePrefix string
+	output            string
+	templateVars      templateVars
+	qps               float32
+	burst             int
+}
+
+var stConfig statusCfg
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status [options] <file>",
+	Short: "Display the live status of an installed graph of charts",
+	Long: `Displays the Helm release status and revision, the health of the primary deployment and any failing pods
+for each chart in the graph, in installation order.`,
+	Run: status,
+}
+
+func init() {
+	statusCmd.Flags().StringVar(&stConfig.k8sNS, "k8s-namespace", "", "k8s namespace where charts are installed")
+	statusCmd.Flags().StringVar(&stConfig.k8sCtx, "k8s-ctx", "", "k8s context")
+	statusCmd.Flags().StringVar(&stConfig.releaseNamePrefix, "release-name-prefix", "", "Release name prefix")
+	statusCmd.Flags().StringVarP(&stConfig.output, "output", "o", "table", "output format (table or json)")
+	stConfig.templateVars.addFlags(statusCmd)
+	stConfig.templateVars.addSetVarFlag(statusCmd)
+	statusCmd.Flags().Float32Var(&stConfig.qps, "qps", 50, "Override maximum QPS to the master from this client")
+	statusCmd.Flags().IntVar(&stConfig.burst, "burst", 100, "Override maximum burst for throttle")
+	RootCmd.AddCommand(statusCmd)
+}
+
+func status(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		clierr("input file is required")
+	}
+	if stConfig.output != "table" && stConfig.output != "json" {
+		clierr("unknown output format: %v", stConfig.output)
+	}
+	fp := args[len(args)-1]
+	gd, _, err := readAndValidateFile(fp, false, stConfig.templateVars)
+	if err != nil {
+		clierr("error reading input: %v", err)
+	}
+	cs, steps, err := cd2c(gd.Charts)
+	if err != nil {
+		clierr("error converting chart definitions: %v", err)
+	}
+	cfg, err := getHelmConfig(stConfig.k8sCtx, stConfig.k8sNS, stConfig.qps, stConfig.burst)
+	if err != nil {
+		clierr("error getting Helm config: %v", err)
+	}
+	clientset, err := cfg.KubernetesClientSet()
+	if err != nil {
+		clierr("error getting kubernetes client: %v", err)
+	}
+	m := metahelm.Manager{
+		HCfg: cfg,
+		K8c:  clientset,
+	}
+	opts := []metahelm.InstallOption{metahelm.WithSteps(steps...)}
+	if stConfig.k8sNS != "" {
+		opts = append(opts, metahelm.WithK8sNamespace(stConfig.k8sNS))
+	}
+	sl, err := m.Status(context.Background(), buildReleaseMap(stConfig.releaseNamePrefix, cs), cs, opts...)
+	if err != nil {
+		clierr("error getting status: %v", err)
+	}
+	if stConfig.output == "json" {
+		b, err := json.MarshalIndent(sl, "", "  ")
+		if err != nil {
+			clierr("error marshaling status: %v", err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	displayStatus(sl)
+}
+
+func displayStatus(sl []metahelm.ChartStatus) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "CHART\tRELEASE\tSTATUS\tREVISION\tREADY\tHEALTHY\tFAILED PODS\n")
+	for _, s := range sl {
+		ready := "-"
+		if s.HealthTarget != "" {
+			ready = fmt.Sprintf("%v/%v", s.ReadyReplicas, s.DesiredReplicas)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", s.Title, s.ReleaseName, s.ReleaseStatus, s.Revision, ready, s.Healthy, len(s.FailedPods))
+	}
+	tw.Flush()
+	for _, s := range sl {
+		if s.Error != "" {
+			fmt.Printf("\n%v: %v\n", s.Title, s.Error)
+		}
+		if len(s.FailedPods) == 0 {
+			continue
+		}
+		fmt.Printf("\n%v: failing pods (deployment: %v)\n", s.Title, s.HealthTarget)
+		for _, fp := range s.FailedPods {
+			fmt.Printf("\tPod: %v\n", fp.Name)
+			fmt.Printf("\tSummary: %v\n", fp.Summary)
+			fmt.Printf("\tPhase: %v\n", fp.Phase)
+			fmt.Printf("\tReason: %v\n", fp.Reason)
+			fmt.Printf("\tMessage: %v\n", fp.Message)
+		}
+	}
+}
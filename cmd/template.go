@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// varEnvPrefix is the prefix of environment variables that define variables (METAHELM_VAR_<name>)
+const varEnvPrefix = "METAHELM_VAR_"
+
+// templateVars are the variables of the graph file templates and the enabled expressions: METAHELM_VAR_<name> environment variables,
+// overridden by the variables in the --var-file files (in order), overridden by the --var values
+type templateVars struct {
+	vars    []string // name=value
+	files   []string // YAML files with a mapping of names to values
+	setVars []string // name=value from the deprecated --set-var flag, like vars
+}
+
+// addFlags adds the --var and --var-file flags to cmd
+func (tv *templateVars) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&tv.vars, "var", nil, "Set a variable for the graph file template and enabled expressions (name=value, may be repeated; overrides --var-file and METAHELM_VAR_<name>)")
+	cmd.Flags().StringArrayVar(&tv.files, "var-file", nil, "YAML file with variables for the graph file template and enabled expressions (may be repeated; later files override earlier ones)")
+}
+
+// addSetVarFlag adds the deprecated --set-var flag to cmd, which formerly set the variables of enabled expressions only
+func (tv *templateVars) addSetVarFlag(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&tv.setVars, "set-var", nil, "Set a variable (name=value, may be repeated)")
+	cmd.Flags().MarkDeprecated("set-var", "use --var instead")
+}
+
+// values returns the variables by name
+func (tv templateVars) values() (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, varEnvPrefix) {
+			kv := strings.SplitN(strings.TrimPrefix(kv, varEnvPrefix), "=", 2)
+			if len(kv) == 2 && kv[0] != "" {
+				out[kv[0]] = kv[1]
+			}
+		}
+	}
+	for _, f := range tv.files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading var file")
+		}
+		vars := map[string]interface{}{}
+		if err := yaml3.Unmarshal(b, &vars); err != nil {
+			return nil, errors.Wrapf(err, "error unmarshaling var file %v", f)
+		}
+		for k, v := range vars {
+			out[k] = v
+		}
+	}
+	for _, sv := range append(append([]string{}, tv.setVars...), tv.vars...) {
+		kv := strings.SplitN(sv, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("malformed variable (expected name=value): %v", sv)
+		}
+		out[kv[0]] = kv[1]
+	}
+	return out, nil
+}
+
+// renderGraphTemplate renders the contents b of the graph file f as a Go template (with the sprig functions) with vars as data, so that
+// variables are referenced as {{ .name }}. Undefined variables are errors.
+func renderGraphTemplate(f string, b []byte, vars map[string]interface{}) ([]byte, error) {
+	tmpl, err := template.New(filepath.Base(f)).Option("missingkey=error").Funcs(sprig.TxtFuncMap()).Parse(string(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing template")
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, vars); err != nil {
+		return nil, errors.Wrap(err, "error rendering template")
+	}
+	return buf.Bytes(), nil
+}
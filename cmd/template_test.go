@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTemplateVarsValues(t *testing.T) {
+	dir := t.TempDir()
+	writeGraphFiles(t, dir, map[string]string{
+		"a.yaml": "env: staging\nreplicas: 2\nregion: eu\n",
+		"b.yaml": "env: prod\ntags: [x, y]\n",
+	})
+	t.Setenv(varEnvPrefix+"env", "dev")
+	t.Setenv(varEnvPrefix+"region", "us")
+	t.Setenv(varEnvPrefix+"owner", "team")
+	t.Setenv(varEnvPrefix, "ignored")
+	cases := []struct {
+		name     string
+		tv       templateVars
+		expected map[string]interface{}
+		errMsg   string
+	}{
+		{
+			name:     "environment",
+			expected: map[string]interface{}{"env": "dev", "region": "us", "owner": "team"},
+		},
+		{
+			name:     "var files override environment",
+			tv:       templateVars{files: []string{filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.yaml")}},
+			expected: map[string]interface{}{"env": "prod", "region": "eu", "owner": "team", "replicas": 2, "tags": []interface{}{"x", "y"}},
+		},
+		{
+			name: "vars override var files",
+			tv: templateVars{
+				vars:  []string{"env=qa", "owner=a=b", "empty="},
+				files: []string{filepath.Join(dir, "a.yaml")},
+			},
+			expected: map[string]interface{}{"env": "qa", "region": "eu", "owner": "a=b", "replicas": 2, "empty": ""},
+		},
+		{
+			name: "deprecated set-var",
+			tv: templateVars{
+				vars:    []string{"env=qa"},
+				setVars: []string{"env=test", "owner=ops"},
+			},
+			expected: map[string]interface{}{"env": "qa", "region": "us", "owner": "ops"},
+		},
+		{
+			name:   "malformed var",
+			tv:     templateVars{vars: []string{"env"}},
+			errMsg: "malformed variable",
+		},
+		{
+			name:   "var without name",
+			tv:     templateVars{vars: []string{"=prod"}},
+			errMsg: "malformed variable",
+		},
+		{
+			name:   "missing var file",
+			tv:     templateVars{files: []string{filepath.Join(dir, "missing.yaml")}},
+			errMsg: "error reading var file",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vars, err := c.tv.values()
+			if c.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), c.errMsg) {
+					t.Fatalf("should have failed with %q: %v", c.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+			if !reflect.DeepEqual(vars, c.expected) {
+				t.Fatalf("bad vars: %v", vars)
+			}
+		})
+	}
+}
+
+func TestRenderGraphTemplate(t *testing.T) {
+	vars := map[string]interface{}{"env": "prod", "replicas": 3}
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+		errMsg   string
+	}{
+		{"no template", "charts: []\n", "charts: []\n", ""},
+		{"variables", "name: app-{{ .env }}\nreplicas: {{ .replicas }}\n", "name: app-prod\nreplicas: 3\n", ""},
+		{"sprig functions", "name: {{ .env | upper }}-{{ index . \"region\" | default \"eu\" }}\n", "name: PROD-eu\n", ""},
+		{"missing variable", "name: app-{{ .region }}\n", "", "map has no entry for key \"region\""},
+		{"parse error", "name: {{ .env \n", "", "error parsing template"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := renderGraphTemplate("graph.yaml", []byte(c.input), vars)
+			if c.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), c.errMsg) {
+					t.Fatalf("should have failed with %q: %v", c.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+			if string(b) != c.expected {
+				t.Fatalf("bad output: %q", b)
+			}
+		})
+	}
+}
+
+func TestGraphLoaderTemplateIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeGraphFiles(t, dir, map[string]string{
+		"main.yaml":         "include: [{path: data/data.yaml, prefix: \"{{ .env }}\"}]\ncharts: [{name: app, path: ./c, dependencies: [\"{{ .env }}/db\"]}]\n",
+		"data/data.yaml":    "charts: [{name: db, path: ./{{ .env }}}]\n",
+		"bad.yaml":          "include: [{path: data/missing.yaml}]\n",
+		"data/missing.yaml": "charts: [{name: {{ .nope }}, path: ./c}]\n",
+	})
+	buf := &bytes.Buffer{}
+	gl := &graphLoader{vars: map[string]interface{}{"env": "prod"}, rendered: buf}
+	gd, err := gl.load(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(gd.Charts) != 2 {
+		t.Fatalf("bad charts: %+v", gd.Charts)
+	}
+	if gd.Charts[1].Name != "prod/db" || gd.Charts[1].Path != filepath.Join(dir, "data", "prod") {
+		t.Fatalf("bad included chart: %+v", gd.Charts[1])
+	}
+	out := buf.String()
+	for _, s := range []string{"# " + filepath.Join(dir, "main.yaml"), "# " + filepath.Join(dir, "data", "data.yaml"), "path: ./prod"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("rendered output should contain %q: %v", s, out)
+		}
+	}
+	if _, err := gl.load(filepath.Join(dir, "bad.yaml")); err == nil || !strings.Contains(err.Error(), "map has no entry for key \"nope\"") {
+		t.Fatalf("should have failed with a missing variable in the included file: %v", err)
+	}
+}
@@ -0,0 +1,347 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/graphext/metahelm/pkg/dag"
+	"github.com/graphext/metahelm/pkg/expr"
+	"github.com/graphext/metahelm/pkg/metahelm"
+	"github.com/spf13/cobra"
+	yaml3 "gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/lint/support"
+)
+
+var validateLint bool
+var validateTemplateVars templateVars
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:     "validate [options] <file>",
+	Aliases: []string{"lint"},
+	Short:   "Validate a graph definition",
+	Long: `Strictly decodes a graph definition and reports all problems found with their file:line:column position: unknown keys,
+invalid values, duplicate chart names, unknown dependencies (suggesting near matches) and dependency cycles. Included files
+are validated as well, with positions in those files.
+With --lint, it also runs the Helm linter on every chart with its values. Charts are validated regardless of their enabled expressions.`,
+	Run: validateGraph,
+}
+
+func init() {
+	validateCmd.Flags().BoolVar(&validateLint, "lint", false, "run helm lint on every chart with its values")
+	validateTemplateVars.addFlags(validateCmd)
+	RootCmd.AddCommand(validateCmd)
+}
+
+// problem is an issue found in a graph definition
+type problem struct {
+	file      string // empty if the problem isn't in a file
+	line, col int
+	warning   bool
+	msg       string
+}
+
+// graphValidator accumulates the problems found in a graph definition
+type graphValidator struct {
+	problems []problem
+	vars     map[string]interface{} // template variables
+	file     string                 // file of the problems reported by errorf and warnf
+	sources  map[string]chartSource // definitions of the charts by name, set by validateFile
+}
+
+func (gv *graphValidator) errorf(n *yaml3.Node, msg string, args ...interface{}) {
+	p := problem{file: gv.file, msg: fmt.Sprintf(msg, args...)}
+	if n != nil {
+		p.line, p.col = n.Line, n.Column
+	}
+	gv.problems = append(gv.problems, p)
+}
+
+func (gv *graphValidator) warnf(n *yaml3.Node, msg string, args ...interface{}) {
+	gv.errorf(n, msg, args...)
+	gv.problems[len(gv.problems)-1].warning = true
+}
+
+// errors returns the number of problems that aren't warnings
+func (gv *graphValidator) errors() int {
+	n := 0
+	for _, p := range gv.problems {
+		if !p.warning {
+			n++
+		}
+	}
+	return n
+}
+
+// print writes the problems sorted by file and position, prefixed with the file name (f if not set)
+func (gv *graphValidator) print(f string) {
+	sort.SliceStable(gv.problems, func(i, j int) bool {
+		pi, pj := gv.problems[i], gv.problems[j]
+		if pi.file != pj.file {
+			return pi.file < pj.file
+		}
+		if pi.line != pj.line {
+			return pi.line < pj.line
+		}
+		return pi.col < pj.col
+	})
+	for _, p := range gv.problems {
+		sev := "error"
+		if p.warning {
+			sev = "warning"
+		}
+		pf := f
+		if p.file != "" {
+			pf = p.file
+		}
+		if p.line == 0 {
+			fmt.Printf("%v: %v: %v\n", pf, sev, p.msg)
+			continue
+		}
+		fmt.Printf("%v:%v:%v: %v: %v\n", pf, p.line, p.col, sev, p.msg)
+	}
+}
+
+// yamlKeys returns the YAML keys of the fields of struct type t
+func yamlKeys(t reflect.Type) map[string]reflect.Type {
+	out := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		k := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if k == "" || k == "-" {
+			continue
+		}
+		out[k] = f.Type
+	}
+	return out
+}
+
+// checkKeys reports unknown keys in the mapping node n (and the nodes nested in it) decoded into type t
+func (gv *graphValidator) checkKeys(n *yaml3.Node, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t.Kind() == reflect.Struct && n.Kind == yaml3.MappingNode:
+		keys := yamlKeys(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			ft, ok := keys[k.Value]
+			if !ok {
+				candidates := []string{}
+				for ck := range keys {
+					candidates = append(candidates, ck)
+				}
+				gv.errorf(k, "unknown key %q%v", k.Value, suggestion(k.Value, candidates))
+				continue
+			}
+			gv.checkKeys(v, ft)
+		}
+	case t.Kind() == reflect.Slice && n.Kind == yaml3.SequenceNode:
+		for _, item := range n.Content {
+			gv.checkKeys(item, t.Elem())
+		}
+	}
+}
+
+// suggestion returns a " (did you mean ...?)" suffix with the candidate closest to s, if any is close enough
+func suggestion(s string, candidates []string) string {
+	best, bestd := "", -1
+	for _, c := range candidates {
+		d := levenshtein(s, c)
+		if bestd < 0 || d < bestd || (d == bestd && c < best) {
+			best, bestd = c, d
+		}
+	}
+	max := len(s) / 3
+	if max < 2 {
+		max = 2
+	}
+	if bestd < 0 || bestd > max {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %q?)", best)
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = cur[j-1] + 1
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// validateFile validates the graph definition in f and the files it includes, and returns the chart definitions that could be loaded
+// (with relative paths expanded and defaults applied)
+func (gv *graphValidator) validateFile(f string) []ChartDefinition {
+	gl := &graphLoader{vars: gv.vars, report: func(file string, n *yaml3.Node, err error) {
+		gv.file = file
+		gv.errorf(n, "%v", err)
+	}}
+	gd, _ := gl.load(f)
+	// the graph is only built if the files could be loaded, to avoid errors about missing charts
+	ok := gv.errors() == 0
+	for file, root := range gl.roots {
+		gv.file = file
+		if root.Kind == yaml3.SequenceNode {
+			gv.checkKeys(root, reflect.TypeOf([]ChartDefinition{}))
+		} else {
+			gv.checkKeys(root, reflect.TypeOf(GraphDefinition{}))
+		}
+	}
+	gv.sources = gl.sources
+	if gd == nil {
+		return nil
+	}
+
+	names := []string{}
+	for _, cd := range gd.Charts {
+		names = append(names, cd.Name)
+	}
+	for _, cd := range gd.Charts {
+		// problems are reported in the file defining the chart
+		gv.file = gl.sources[cd.Name].file
+		cn := gl.sources[cd.Name].node
+		if err := validateChart(cd); err != nil {
+			gv.errorf(cn, "chart %v: %v", cd.Name, err)
+			ok = false
+		}
+		if cd.Enabled != "" {
+			if _, err := expr.Parse(cd.Enabled); err != nil {
+				gv.errorf(mappingValue(cn, "enabled"), "chart %v: %v", cd.Name, err)
+				ok = false
+			}
+		}
+		depsNode := mappingValue(cn, "dependencies")
+		for i, ds := range cd.Dependencies {
+			dn := cn
+			if depsNode != nil && i < len(depsNode.Content) {
+				dn = depsNode.Content[i]
+			}
+			d, err := dag.ParseDependency(ds)
+			if err != nil {
+				continue // reported by validateChart
+			}
+			if _, exists := gl.sources[d.Name]; exists {
+				continue // a chart defined in the graph (even if named like an external dependency)
+			}
+			if _, external, err := metahelm.ParseExternalDependency(d.Name); external {
+				if err != nil {
+					gv.errorf(dn, "chart %v: %v", cd.Name, err)
+					ok = false
+				}
+				continue
+			}
+			if !d.Optional {
+				gv.errorf(dn, "chart %v: unknown dependency %q%v", cd.Name, d.Name, suggestion(d.Name, names))
+				ok = false
+			}
+		}
+	}
+	gv.file = f
+	if err := gd.validateResources(); err != nil {
+		gv.errorf(mappingValue(gl.roots[f], "resources"), "%v", err)
+		ok = false
+	}
+	if ok {
+		charts, err := addExternalDependencies(gd.Charts)
+		if err != nil {
+			gv.errorf(nil, "%v", err)
+			return gd.Charts
+		}
+		objs := []dag.GraphObject{}
+		for i := range charts {
+			objs = append(objs, cdNode{cd: &charts[i]})
+		}
+		og := dag.ObjectGraph{}
+		if err := og.Build(objs); err != nil {
+			gv.errorf(nil, "%v", err)
+		}
+	}
+	return gd.Charts
+}
+
+// lint runs the Helm linter on the charts, reporting warnings and errors at the chart definitions found by validateFile
+func (gv *graphValidator) lint(cds []ChartDefinition) {
+	nodes := func(name string) *yaml3.Node { return gv.sources[name].node }
+	for _, cd := range cds {
+		if cd.Type != "" && cd.Type != nodeTypeChart {
+			continue
+		}
+		gv.file = gv.sources[cd.Name].file
+		path := cd.Path
+		if cd.remote() {
+			rc, err := newRegistryClient()
+			if err != nil {
+				gv.errorf(nil, "error getting registry client: %v", err)
+				return
+			}
+			if path, err = metahelm.LocateChart(cd.Path, cd.Repo, cd.Version, rc); err != nil {
+				gv.errorf(nodes(cd.Name), "chart %v: %v", cd.Name, err)
+				continue
+			}
+		}
+		vals := map[string]interface{}{}
+		if cd.ValuesPath != "" {
+			v, err := chartutil.ReadValuesFile(cd.ValuesPath)
+			if err != nil {
+				continue // reported by validateChart
+			}
+			vals = v
+		}
+		res := action.NewLint().Run([]string{path}, vals)
+		for _, msg := range res.Messages {
+			switch msg.Severity {
+			case support.ErrorSev:
+				gv.errorf(nodes(cd.Name), "chart %v: lint: %v", cd.Name, msg.Err)
+			case support.WarningSev:
+				gv.warnf(nodes(cd.Name), "chart %v: lint: %v", cd.Name, msg.Err)
+			}
+		}
+	}
+}
+
+func validateGraph(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		clierr("input file is required")
+	}
+	fp := args[len(args)-1]
+	vars, err := validateTemplateVars.values()
+	if err != nil {
+		clierr("error getting template variables: %v", err)
+	}
+	gv := &graphValidator{vars: vars}
+	cds := gv.validateFile(fp)
+	if validateLint && gv.errors() == 0 {
+		gv.lint(cds)
+	}
+	gv.print(fp)
+	if n := gv.errors(); n > 0 {
+		clierr("%v error(s) found", n)
+	}
+	fmt.Fprintf(os.Stderr, "%v: OK (%v charts)\n", fp, len(cds))
+}
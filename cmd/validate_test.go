@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validationErrors returns the errors found by gv as file:line:col: message, with file names (also in messages) relative to dir
+func validationErrors(gv *graphValidator, dir string) []string {
+	msgs := []string{}
+	for _, p := range gv.problems {
+		if p.warning {
+			continue
+		}
+		f, _ := filepath.Rel(dir, p.file)
+		msg := strings.ReplaceAll(p.msg, dir+string(filepath.Separator), "")
+		if p.line == 0 {
+			msgs = append(msgs, fmt.Sprintf("%v: %v", f, msg))
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("%v:%v:%v: %v", f, p.line, p.col, msg))
+	}
+	return msgs
+}
+
+func TestValidateFile(t *testing.T) {
+	cases := []struct {
+		name   string
+		graph  string
+		errMsg []string
+	}{
+		{
+			name:  "valid",
+			graph: "charts:\n  - name: db\n    path: ./c\n  - name: app\n    path: ./c\n    dependencies: [db]\n",
+		},
+		{
+			name:   "unknown key",
+			graph:  "charts:\n  - name: app\n    path: ./c\n    dependecies: [db]\n",
+			errMsg: []string{`graph.yaml:4:5: unknown key "dependecies" (did you mean "dependencies"?)`},
+		},
+		{
+			name:   "unknown nested key",
+			graph:  "charts:\n  - name: app\n    path: ./c\n    helm:\n      atomc: true\n",
+			errMsg: []string{`graph.yaml:5:7: unknown key "atomc" (did you mean "atomic"?)`},
+		},
+		{
+			name:   "unknown key without suggestion",
+			graph:  "charts:\n  - name: app\n    path: ./c\n    color: blue\n",
+			errMsg: []string{`graph.yaml:4:5: unknown key "color"`},
+		},
+		{
+			name:   "duplicate chart name",
+			graph:  "charts:\n  - name: app\n    path: ./c\n  - name: app\n    path: ./c\n",
+			errMsg: []string{`graph.yaml:4:11: duplicate chart name "app" (first defined at line 2)`},
+		},
+		{
+			name:   "type error",
+			graph:  "charts:\n  - name: app\n    path: ./c\n    priority: high\n",
+			errMsg: []string{"graph.yaml:2:5: bad chart: yaml: unmarshal errors:\n  line 4: cannot unmarshal !!str `high` into int"},
+		},
+		{
+			name:   "unknown dependency",
+			graph:  "charts:\n  - name: db\n    path: ./c\n  - name: app\n    path: ./c\n    dependencies: [dbb]\n",
+			errMsg: []string{`graph.yaml:6:20: chart app: unknown dependency "dbb" (did you mean "db"?)`},
+		},
+		{
+			name:   "cycle",
+			graph:  "charts:\n  - name: a\n    path: ./c\n    dependencies: [b]\n  - name: b\n    path: ./c\n    dependencies: [a]\n",
+			errMsg: []string{"graph.yaml: error populating graph: dependency cycles found (1): a -> b -> a"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeGraphFiles(t, dir, map[string]string{
+				"graph.yaml":   c.graph,
+				"c/Chart.yaml": "apiVersion: v2\nname: c\nversion: 0.1.0\n",
+			})
+			gv := &graphValidator{}
+			gv.validateFile(filepath.Join(dir, "graph.yaml"))
+			msgs := validationErrors(gv, dir)
+			if len(msgs) != len(c.errMsg) {
+				t.Fatalf("bad errors: %q", msgs)
+			}
+			for i := range msgs {
+				if !strings.HasPrefix(msgs[i], c.errMsg[i]) {
+					t.Fatalf("bad error: %q (expected %q)", msgs[i], c.errMsg[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSuggestion(t *testing.T) {
+	candidates := []string{"dependencies", "dependency_update", "path"}
+	cases := []struct {
+		s, out string
+	}{
+		{"dependecies", ` (did you mean "dependencies"?)`},
+		{"pth", ` (did you mean "path"?)`},
+		{"dependency-update", ` (did you mean "dependency_update"?)`},
+		{"name", ""},
+	}
+	for _, c := range cases {
+		if out := suggestion(c.s, candidates); out != c.out {
+			t.Fatalf("%v: bad suggestion: %q", c.s, out)
+		}
+	}
+}
+
+func TestValidateInclude(t *testing.T) {
+	cases := []struct {
+		name   string
+		files  map[string]string
+		errMsg string
+	}{
+		{
+			name: "only includes",
+			files: map[string]string{
+				"graph.yaml":        "include: [{path: data/data.yaml, prefix: data}]\n",
+				"data/data.yaml":    "charts:\n  - name: mysql\n    path: ./c\n",
+				"data/c/Chart.yaml": "apiVersion: v2\nname: c\nversion: 0.1.0\n",
+			},
+		},
+		{
+			name: "duplicate chart name",
+			files: map[string]string{
+				"graph.yaml":        "include: [{path: data/data.yaml}]\ncharts:\n  - name: mysql\n    path: ./data/c\n",
+				"data/data.yaml":    "charts:\n  - name: mysql\n    path: ./c\n",
+				"data/c/Chart.yaml": "apiVersion: v2\nname: c\nversion: 0.1.0\n",
+			},
+			errMsg: `data/data.yaml:2:11: duplicate chart name "mysql" (first defined at graph.yaml:3)`,
+		},
+		{
+			name: "release name collision",
+			files: map[string]string{
+				"graph.yaml":        "charts:\n  - name: data-mysql\n    path: ./data/c\ninclude: [{path: data/data.yaml, prefix: data}]\n",
+				"data/data.yaml":    "charts:\n  - name: mysql\n    path: ./c\n",
+				"data/c/Chart.yaml": "apiVersion: v2\nname: c\nversion: 0.1.0\n",
+			},
+			errMsg: "data/data.yaml:2:11: charts data-mysql and data/mysql have the same release name: data-mysql",
+		},
+		{
+			name: "unknown key in included file",
+			files: map[string]string{
+				"graph.yaml":        "include: [{path: data/data.yaml, prefix: data}]\n",
+				"data/data.yaml":    "charts:\n  - name: mysql\n    path: ./c\n    dependecies: [config]\n",
+				"data/c/Chart.yaml": "apiVersion: v2\nname: c\nversion: 0.1.0\n",
+			},
+			errMsg: `data/data.yaml:4:5: unknown key "dependecies" (did you mean "dependencies"?)`,
+		},
+		{
+			name: "unknown dependency in included file",
+			files: map[string]string{
+				"graph.yaml":        "include: [{path: data/data.yaml, prefix: data}]\ncharts:\n  - name: config\n    path: ./data/c\n",
+				"data/data.yaml":    "charts:\n  - name: mysql\n    path: ./c\n    dependencies: [config, confg]\n",
+				"data/c/Chart.yaml": "apiVersion: v2\nname: c\nversion: 0.1.0\n",
+			},
+			errMsg: `data/data.yaml:4:28: chart data/mysql: unknown dependency "confg" (did you mean "config"?)`,
+		},
+		{
+			name: "nested include",
+			files: map[string]string{
+				"graph.yaml":        "include: [{path: tiers/tiers.yaml, prefix: shop}]\n",
+				"tiers/tiers.yaml":  "include: [{path: ../data/data.yaml, prefix: data}]\n",
+				"data/data.yaml":    "charts:\n  - name: mysql\n    path: ./c\n    timeout: soon\n",
+				"data/c/Chart.yaml": "apiVersion: v2\nname: c\nversion: 0.1.0\n",
+			},
+			errMsg: "data/data.yaml:2:5: chart shop/data/mysql: ",
+		},
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"graph.yaml":     "include: [{path: data/data.yaml}]\n",
+				"data/data.yaml": "include:\n  - path: ../graph.yaml\n    prefix: x\n",
+			},
+			errMsg: "data/data.yaml:2:11: include cycle: ",
+		},
+		{
+			name: "missing included file",
+			files: map[string]string{
+				"graph.yaml": "include: [{path: data/missing.yaml}]\n",
+			},
+			errMsg: "data/missing.yaml: error reading file: ",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeGraphFiles(t, dir, c.files)
+			gv := &graphValidator{}
+			gv.validateFile(filepath.Join(dir, "graph.yaml"))
+			msgs := validationErrors(gv, dir)
+			if c.errMsg == "" {
+				if len(msgs) > 0 {
+					t.Fatalf("should have succeeded: %v", msgs)
+				}
+				return
+			}
+			if len(msgs) != 1 || !strings.HasPrefix(msgs[0], c.errMsg) {
+				t.Fatalf("should have failed with %q: %v", c.errMsg, msgs)
+			}
+		})
+	}
+}
+
+func TestValidateExternalDependencies(t *testing.T) {
+	cases := []struct {
+		name   string
+		graph  string
+		errMsg string
+	}{
+		{
+			name:  "external",
+			graph: "charts:\n  - name: app\n    path: ./c\n    dependencies: [release/infra/vault, deployment/ingress]\n",
+		},
+		{
+			name:  "chart named like an external dependency",
+			graph: "charts:\n  - name: release/a/b/c\n    path: ./c\n  - name: app\n    path: ./c\n    dependencies: [release/a/b/c]\n",
+		},
+		{
+			name:   "malformed external",
+			graph:  "charts:\n  - name: app\n    path: ./c\n    dependencies: [release/a/b/c]\n",
+			errMsg: "malformed external dependency",
+		},
+		{
+			name:   "unknown",
+			graph:  "charts:\n  - name: app\n    path: ./c\n    dependencies: [vault]\n",
+			errMsg: "unknown dependency",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeGraphFiles(t, dir, map[string]string{
+				"graph.yaml":   c.graph,
+				"c/Chart.yaml": "apiVersion: v2\nname: c\nversion: 0.1.0\n",
+			})
+			gv := &graphValidator{}
+			gv.validateFile(filepath.Join(dir, "graph.yaml"))
+			msgs := []string{}
+			for _, p := range gv.problems {
+				if !p.warning {
+					msgs = append(msgs, p.msg)
+				}
+			}
+			if c.errMsg == "" {
+				if len(msgs) > 0 {
+					t.Fatalf("should have succeeded: %v", msgs)
+				}
+				return
+			}
+			if len(msgs) != 1 || !strings.Contains(msgs[0], c.errMsg) {
+				t.Fatalf("should have failed with %q: %v", c.errMsg, msgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package dag
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Edge is a dependency edge of a graph, from a dependent to its dependency
+type Edge struct {
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Qualifiers []string `json:"qualifiers,omitempty"`
+}
+
+// QualifierChange is an edge present in both graphs with different qualifiers
+type QualifierChange struct {
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	Old  []string `json:"old"`
+	New  []string `json:"new"`
+}
+
+// PhaseChange is an object present in both graphs that is installed in a different phase (phases start at 1 and are installed in order)
+type PhaseChange struct {
+	Name string `json:"name"`
+	Old  int    `json:"old"`
+	New  int    `json:"new"`
+}
+
+// GraphDiff is the structural difference between two graphs. All lists are sorted.
+type GraphDiff struct {
+	AddedNodes       []string          `json:"added_nodes"`
+	RemovedNodes     []string          `json:"removed_nodes"`
+	AddedEdges       []Edge            `json:"added_edges"`
+	RemovedEdges     []Edge            `json:"removed_edges"`
+	QualifierChanges []QualifierChange `json:"qualifier_changes"`
+	PhaseChanges     []PhaseChange     `json:"phase_changes"`
+}
+
+// Empty returns whether the graphs are structurally identical
+func (gd *GraphDiff) Empty() bool {
+	return len(gd.AddedNodes) == 0 && len(gd.RemovedNodes) == 0 && len(gd.AddedEdges) == 0 && len(gd.RemovedEdges) == 0 &&
+		len(gd.QualifierChanges) == 0 && len(gd.PhaseChanges) == 0
+}
+
+// edges returns the edges of the graph (without the synthetic root) by dependent and dependency
+func (og *ObjectGraph) edges() map[[2]string]Edge {
+	out := map[[2]string]Edge{}
+	for _, n := range og.renderNames() {
+		for _, d := range og.renderDeps(n) {
+			k := [2]string{n, d.Name}
+			e, ok := out[k]
+			if !ok {
+				e = Edge{From: n, To: d.Name}
+			}
+			e.Qualifiers = mergeQualifiers(e.Qualifiers, d.Qualifiers())
+			out[k] = e
+		}
+	}
+	return out
+}
+
+// mergeQualifiers returns the qualifiers of a dependency listed more than once (any unqualified listing wins)
+func mergeQualifiers(a, b []string) []string {
+	if a == nil {
+		return b
+	}
+	qs := []string{}
+	for _, q := range a {
+		for _, q2 := range b {
+			if q == q2 {
+				qs = append(qs, q)
+			}
+		}
+	}
+	return qs
+}
+
+// phaseOf returns the installation phase of every object in the graph (without the synthetic root)
+func (og *ObjectGraph) phaseOf() map[string]int {
+	out := map[string]int{}
+	for i, p := range og.phases() {
+		for _, n := range p {
+			out[n] = i + 1
+		}
+	}
+	return out
+}
+
+// Compare returns the structural difference between the built graphs old and new: the objects and edges added and removed, the edges
+// whose qualifiers changed and the objects installed in a different phase
+func Compare(old, new *ObjectGraph) *GraphDiff {
+	gd := &GraphDiff{
+		AddedNodes:       []string{},
+		RemovedNodes:     []string{},
+		AddedEdges:       []Edge{},
+		RemovedEdges:     []Edge{},
+		QualifierChanges: []QualifierChange{},
+		PhaseChanges:     []PhaseChange{},
+	}
+	op, np := old.phaseOf(), new.phaseOf()
+	for _, n := range new.renderNames() {
+		if _, ok := op[n]; !ok {
+			gd.AddedNodes = append(gd.AddedNodes, n)
+			continue
+		}
+		if op[n] != np[n] {
+			gd.PhaseChanges = append(gd.PhaseChanges, PhaseChange{Name: n, Old: op[n], New: np[n]})
+		}
+	}
+	for _, n := range old.renderNames() {
+		if _, ok := np[n]; !ok {
+			gd.RemovedNodes = append(gd.RemovedNodes, n)
+		}
+	}
+	oe, ne := old.edges(), new.edges()
+	for k, e := range ne {
+		e2, ok := oe[k]
+		if !ok {
+			gd.AddedEdges = append(gd.AddedEdges, e)
+			continue
+		}
+		if !reflect.DeepEqual(e.Qualifiers, e2.Qualifiers) {
+			gd.QualifierChanges = append(gd.QualifierChanges, QualifierChange{From: e.From, To: e.To, Old: e2.Qualifiers, New: e.Qualifiers})
+		}
+	}
+	for k, e := range oe {
+		if _, ok := ne[k]; !ok {
+			gd.RemovedEdges = append(gd.RemovedEdges, e)
+		}
+	}
+	sortEdges := func(es []Edge) {
+		sort.Slice(es, func(i, j int) bool {
+			if es[i].From != es[j].From {
+				return es[i].From < es[j].From
+			}
+			return es[i].To < es[j].To
+		})
+	}
+	sortEdges(gd.AddedEdges)
+	sortEdges(gd.RemovedEdges)
+	sort.Slice(gd.QualifierChanges, func(i, j int) bool {
+		if gd.QualifierChanges[i].From != gd.QualifierChanges[j].From {
+			return gd.QualifierChanges[i].From < gd.QualifierChanges[j].From
+		}
+		return gd.QualifierChanges[i].To < gd.QualifierChanges[j].To
+	})
+	return gd
+}
@@ -0,0 +1,152 @@
+package dag
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"gonum.org/v1/gonum/graph/topo"
+)
+
+// NodeSchedule is the expected schedule of a node during a Walk
+type NodeSchedule struct {
+	Name          string
+	Duration      time.Duration
+	EarliestStart time.Duration // from the start of the walk
+	Slack         time.Duration // how long the node can be delayed without delaying the walk
+	Critical      bool          // the node has no slack
+}
+
+// CriticalPath is the expected schedule of a Walk
+type CriticalPath struct {
+	// Total is the expected duration of the walk
+	Total time.Duration
+	// Path are the names of the nodes on the critical path, in execution order
+	Path []string
+	// Nodes is the schedule of every node, ordered by earliest start and name
+	Nodes []NodeSchedule
+}
+
+// schedConstraint is a node that must start (or finish, if finish is set) before another node can start
+type schedConstraint struct {
+	id     int64
+	finish bool
+}
+
+// CriticalPath calculates the expected schedule of a Walk given the duration of each node (missing nodes take no time).
+// It models the Walk scheduler: a node starts once every node at a higher level has finished and, within its level, once the
+// dependencies qualified as started have started. The critical path is the longest chain of nodes that determines the total duration.
+// MaxConcurrency and resource limits aren't taken into account.
+func (og *ObjectGraph) CriticalPath(durations map[string]time.Duration) (*CriticalPath, error) {
+	if len(og.objs) == 0 {
+		return nil, errors.New("graph is empty")
+	}
+	sorted, err := topo.Sort(og.g)
+	if err != nil {
+		return nil, errors.Wrap(err, "error sorting graph")
+	}
+	// execution order: descending level, then dependencies before dependents
+	level := map[int64]int{}
+	for i, l := range og.levels {
+		for _, o := range l {
+			level[og.namemap[o.Name()]] = i
+		}
+	}
+	order := []int64{}
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if id := sorted[i].ID(); og.idmap[id] != rootName {
+			order = append(order, id)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return level[order[i]] > level[order[j]] })
+	isdep := map[[2]int64]bool{}
+	preds := map[int64][]schedConstraint{}
+	for _, id := range order {
+		name := og.idmap[id]
+		for _, d := range og.deps[name] {
+			did := og.namemap[d.Name]
+			isdep[[2]int64{id, did}] = true
+			if d.Started && level[did] == level[id] {
+				preds[id] = append(preds[id], schedConstraint{id: did})
+			}
+		}
+		for _, oid := range order {
+			if level[oid] > level[id] {
+				preds[id] = append(preds[id], schedConstraint{id: oid, finish: true})
+			}
+		}
+	}
+	dur := func(id int64) time.Duration { return durations[og.idmap[id]] }
+	lag := func(c schedConstraint) time.Duration {
+		if c.finish {
+			return dur(c.id)
+		}
+		return 0
+	}
+	es := map[int64]time.Duration{}
+	cp := &CriticalPath{}
+	for _, id := range order {
+		for _, p := range preds[id] {
+			if t := es[p.id] + lag(p); t > es[id] {
+				es[id] = t
+			}
+		}
+		if t := es[id] + dur(id); t > cp.Total {
+			cp.Total = t
+		}
+	}
+	ls := map[int64]time.Duration{}
+	for _, id := range order {
+		ls[id] = cp.Total - dur(id)
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		id := order[i]
+		for _, p := range preds[id] {
+			if t := ls[id] - lag(p); t < ls[p.id] {
+				ls[p.id] = t
+			}
+		}
+	}
+	for _, id := range order {
+		cp.Nodes = append(cp.Nodes, NodeSchedule{
+			Name:          og.idmap[id],
+			Duration:      dur(id),
+			EarliestStart: es[id],
+			Slack:         ls[id] - es[id],
+			Critical:      ls[id] == es[id],
+		})
+	}
+	sort.SliceStable(cp.Nodes, func(i, j int) bool {
+		if cp.Nodes[i].EarliestStart != cp.Nodes[j].EarliestStart {
+			return cp.Nodes[i].EarliestStart < cp.Nodes[j].EarliestStart
+		}
+		return cp.Nodes[i].Name < cp.Nodes[j].Name
+	})
+	// trace the critical path back from the last node to finish, preferring actual dependencies over level barriers
+	var cur int64 = -1
+	for _, id := range order {
+		if es[id]+dur(id) == cp.Total && ls[id] == es[id] && (cur < 0 || level[id] < level[cur] ||
+			(level[id] == level[cur] && og.idmap[id] < og.idmap[cur])) {
+			cur = id
+		}
+	}
+	for cur >= 0 {
+		cp.Path = append([]string{og.idmap[cur]}, cp.Path...)
+		next := int64(-1)
+		for _, p := range preds[cur] {
+			if ls[p.id] != es[p.id] || es[p.id]+lag(p) != es[cur] {
+				continue
+			}
+			switch {
+			case next < 0:
+			case isdep[[2]int64{cur, p.id}] && !isdep[[2]int64{cur, next}]:
+			case isdep[[2]int64{cur, p.id}] == isdep[[2]int64{cur, next}] && og.idmap[p.id] < og.idmap[next]:
+			default:
+				continue
+			}
+			next = p.id
+		}
+		cur = next
+	}
+	return cp, nil
+}
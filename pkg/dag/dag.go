@@ -3,11 +3,14 @@ package dag
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 	"gonum.org/v1/gonum/graph"
+	"gonum.org/v1/gonum/graph/encoding"
 	"gonum.org/v1/gonum/graph/encoding/dot"
 	gpath "gonum.org/v1/gonum/graph/path"
 	"gonum.org/v1/gonum/graph/simple"
@@ -18,12 +21,76 @@ import (
 type labeledNode struct {
 	simple.Node
 	label string
+	attrs []encoding.Attribute
 }
 
 func (ln *labeledNode) DOTID() string {
 	return ln.label
 }
 
+// Attributes returns the DOT attributes of the node
+func (ln *labeledNode) Attributes() []encoding.Attribute {
+	return ln.attrs
+}
+
+// attrEdge is an edge with DOT attributes
+type attrEdge struct {
+	simple.Edge
+	attrs []encoding.Attribute
+}
+
+// Attributes returns the DOT attributes of the edge
+func (ae attrEdge) Attributes() []encoding.Attribute {
+	return ae.attrs
+}
+
+var highlightAttrs = []encoding.Attribute{{Key: "color", Value: "red"}, {Key: "penwidth", Value: "2"}}
+
+// dotGraph returns a copy of the graph without the synthetic root and with the nodes in names and the edges between consecutive ones
+// highlighted
+func (og *ObjectGraph) dotGraph(names []string) *simple.DirectedGraph {
+	hn := map[int64]bool{}
+	he := map[[2]int64]bool{}
+	for i, n := range names {
+		id, ok := og.namemap[n]
+		if !ok {
+			continue
+		}
+		hn[id] = true
+		if i > 0 {
+			if prev, ok := og.namemap[names[i-1]]; ok {
+				he[[2]int64{id, prev}] = true
+			}
+		}
+	}
+	hg := simple.NewDirectedGraph()
+	nodes := og.g.Nodes()
+	for nodes.Next() {
+		ln := *nodes.Node().(*labeledNode)
+		if og.idmap[ln.ID()] == rootName {
+			continue
+		}
+		ln.attrs = nil
+		if hn[ln.ID()] {
+			ln.attrs = highlightAttrs
+		}
+		hg.AddNode(&ln)
+	}
+	edges := og.g.Edges()
+	for edges.Next() {
+		e := edges.Edge()
+		if og.idmap[e.From().ID()] == rootName {
+			continue
+		}
+		ae := attrEdge{Edge: simple.Edge{F: hg.Node(e.From().ID()), T: hg.Node(e.To().ID())}}
+		if he[[2]int64{e.From().ID(), e.To().ID()}] {
+			ae.attrs = highlightAttrs
+		}
+		hg.SetEdge(ae)
+	}
+	return hg
+}
+
 // GraphObject describes an object that will become a node in the graph
 type GraphObject interface {
 	Name() string   // the unique name for the object
@@ -36,18 +103,41 @@ type GraphObject interface {
 	Dependencies() []string // names of dependencies, in any order
 }
 
+// Prioritizer is implemented by graph objects that have a priority. Within a level, objects are ordered (and started by Walk) by descending
+// priority, then by name. Objects that don't implement it have priority zero.
+type Prioritizer interface {
+	Priority() int
+}
+
+// priority returns the priority of o
+func priority(o GraphObject) int {
+	if p, ok := o.(Prioritizer); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
 // LogFunc is a function that logs a formatted string somewhere
 type LogFunc func(string, ...interface{})
 
 // ObjectGraph builds and analyzes a graph of the supplied objects
 type ObjectGraph struct {
-	LogF    LogFunc
+	LogF LogFunc
+	// MaxConcurrency is the maximum number of actions that Walk executes at once (zero means no limit)
+	MaxConcurrency int
+	// ResourceLimits are the number of tokens of each resource used by the objects (see ResourceUser). Resources without a limit have
+	// one token.
+	ResourceLimits map[string]int
+
 	objs    []GraphObject
 	g       *simple.DirectedGraph
 	root    int64
 	idmap   map[int64]string
 	namemap map[string]int64
 	levels  [][]GraphObject
+	deps    map[string][]Dependency // dependencies present in the graph, by object name
+	mtx     sync.Mutex
+	events  chan walkEvent // events of the walk in progress, if any
 }
 
 func (og *ObjectGraph) log(msg string, args ...interface{}) {
@@ -60,6 +150,7 @@ func (og *ObjectGraph) init() {
 	og.idmap = make(map[int64]string)
 	og.namemap = make(map[string]int64)
 	og.levels = [][]GraphObject{}
+	og.deps = make(map[string][]Dependency)
 }
 
 func (og *ObjectGraph) populate(objs []GraphObject) error {
@@ -73,6 +164,9 @@ func (og *ObjectGraph) populate(objs []GraphObject) error {
 		if o.Name() == rootName {
 			return fmt.Errorf("reserved name at offset %v: %v", i, rootName)
 		}
+		if _, ok := og.namemap[o.Name()]; ok {
+			return fmt.Errorf("duplicate object name at offset %v: %v", i, o.Name())
+		}
 		og.idmap[offset] = o.Name()
 		og.namemap[o.Name()] = offset
 		dg.AddNode(&labeledNode{Node: simple.Node(offset), label: o.String()})
@@ -80,14 +174,23 @@ func (og *ObjectGraph) populate(objs []GraphObject) error {
 	// add all edges
 	for i, o := range objs {
 		offset := int64(i)
-		for _, d := range o.Dependencies() {
-			if _, ok := og.namemap[d]; !ok {
-				return fmt.Errorf("unknown dependency (of %v): %v", o.Name(), d)
+		for _, ds := range o.Dependencies() {
+			d, err := ParseDependency(ds)
+			if err != nil {
+				return fmt.Errorf("bad dependency (of %v): %w", o.Name(), err)
+			}
+			if _, ok := og.namemap[d.Name]; !ok {
+				if d.Optional {
+					og.log("%v: ignoring absent optional dependency: %v", o.Name(), d.Name)
+					continue
+				}
+				return fmt.Errorf("unknown dependency (of %v): %v", o.Name(), d.Name)
 			}
-			if offset == og.namemap[d] { // SetEdge panics on this
-				return fmt.Errorf("dependency references itself on %v", d)
+			if offset == og.namemap[d.Name] { // SetEdge panics on this
+				return fmt.Errorf("dependency references itself on %v", d.Name)
 			}
-			dg.SetEdge(dg.NewEdge(dg.Node(offset), dg.Node(og.namemap[d])))
+			dg.SetEdge(dg.NewEdge(dg.Node(offset), dg.Node(og.namemap[d.Name])))
+			og.deps[o.Name()] = append(og.deps[o.Name()], d)
 		}
 	}
 	if cycles := topo.DirectedCyclesIn(dg); len(cycles) > 0 {
@@ -152,7 +255,18 @@ func (og *ObjectGraph) setRoot() error {
 
 // calcLevels finds the level (layer) of each node in the DAG by calculating the longest path to each node
 // https://en.wikipedia.org/wiki/Longest_path_problem#Acyclic_graphs_and_critical_paths
+// Edges of dependencies that only need to be started don't count, so those dependencies share the level of their dependents.
+// The objects of each level are sorted by descending priority, then by name.
 func (og *ObjectGraph) calcLevels() {
+	startedOnly := map[[2]int64]bool{}
+	for name, deps := range og.deps {
+		for _, d := range deps {
+			k := [2]int64{og.namemap[name], og.namemap[d.Name]}
+			if so, ok := startedOnly[k]; !ok || so {
+				startedOnly[k] = d.Started
+			}
+		}
+	}
 	wdg := simple.NewWeightedDirectedGraph(0, 0)
 	var _ graph.Nodes
 	nodes := og.g.Nodes()
@@ -163,20 +277,31 @@ func (og *ObjectGraph) calcLevels() {
 	edges := og.g.Edges()
 	for edges.Next() {
 		e := edges.Edge()
-		wdg.SetWeightedEdge(wdg.NewWeightedEdge(e.From(), e.To(), -1))
+		w := -1.0
+		if startedOnly[[2]int64{e.From().ID(), e.To().ID()}] {
+			w = 0
+		}
+		wdg.SetWeightedEdge(wdg.NewWeightedEdge(e.From(), e.To(), w))
 	}
 	pt, _ := gpath.BellmanFordFrom(wdg.Node(og.root), wdg) // negative cycles are impossible because this is a DAG
 	wdgNodes := wdg.Nodes()
 	for wdgNodes.Next() {
 		c := wdgNodes.Node()
-		pth, _ := pt.To(c.ID())
-		lvl := len(pth) - 1
+		lvl := int(-pt.WeightTo(c.ID()))
 		if lvl+1 > len(og.levels) {
 			og.levels = append(og.levels, make([][]GraphObject, (lvl+1)-len(og.levels))...)
 			og.levels[lvl] = []GraphObject{}
 		}
 		og.levels[lvl] = append(og.levels[lvl], og.objs[c.ID()])
 	}
+	for _, l := range og.levels {
+		sort.Slice(l, func(i, j int) bool {
+			if pi, pj := priority(l[i]), priority(l[j]); pi != pj {
+				return pi > pj
+			}
+			return l[i].Name() < l[j].Name()
+		})
+	}
 }
 
 // Build populates the graph with the supplied objects
@@ -205,9 +330,10 @@ func (og *ObjectGraph) Info() (root GraphObject, levels [][]GraphObject, err err
 	return og.objs[og.root], og.levels, nil
 }
 
-// Dot returns the GraphWiz DOT output for the graph
-func (og *ObjectGraph) Dot(name string) ([]byte, error) {
-	b, err := dot.Marshal(og.g, name, "", "    ")
+// Dot returns the GraphWiz DOT output for the graph (without the synthetic root, if any). The nodes named in highlight (for example,
+// a critical path) and the edges between consecutive ones are drawn in red.
+func (og *ObjectGraph) Dot(name string, highlight ...string) ([]byte, error) {
+	b, err := dot.Marshal(og.dotGraph(highlight), name, "", "    ")
 	if err != nil {
 		return nil, errors.Wrap(err, "error marshaling graph to dot")
 	}
@@ -230,11 +356,207 @@ func (we WalkError) Error() string {
 	return fmt.Sprintf("error executing level %v: %v", we.Level, we.Err)
 }
 
-// Walk traverses the graph levels in decending order, executing af for every node in a given level concurrently
+// Unwrap returns the original error
+func (we WalkError) Unwrap() error {
+	return we.Err
+}
+
+// walkEvent is sent by the actions of a Walk when they start or finish
+type walkEvent struct {
+	name string
+	done bool
+	err  error
+}
+
+// walkState is the state of a node during a Walk
+type walkState int
+
+const (
+	walkPending walkState = iota
+	walkRunning
+	walkStarted
+	walkSucceeded
+	walkFailed
+)
+
+// Walk traverses the graph levels in decending order, executing af for every node in a given level concurrently. Within a level, nodes
+// that depend on others in the same level (which is only the case for dependencies qualified as started) are executed once those have
+// started (see Started) or succeeded. Nodes are started in level order (descending priority, then name), at most MaxConcurrency at once,
+// and only when the resource tokens they need are available (see ResourceUser).
+//
+// An error returned by af aborts the walk once the current level finishes, unless every dependent of the failed node depends on it
+// order-only, in which case the walk continues and the error is returned when it finishes. If ctx is cancelled, no further nodes are started
+// and the walk returns once the running actions have returned.
 func (og *ObjectGraph) Walk(ctx context.Context, af ActionFunc) error {
+	if err := og.checkResources(); err != nil {
+		return WalkError{Level: uint(len(og.levels) - 1), Err: err}
+	}
+	tokens := &tokenPool{og: og, inUse: map[string]int{}}
+	objs := map[string]GraphObject{}
+	state := map[string]walkState{}
+	levels := map[string]uint{}
+	order := []GraphObject{}
+	for i := len(og.levels) - 1; i >= 0; i-- {
+		for _, o := range og.levels[i] {
+			if o.Name() != rootName {
+				state[o.Name()] = walkPending
+				levels[o.Name()] = uint(i)
+				order = append(order, o)
+				objs[o.Name()] = o
+			}
+		}
+	}
+	events := make(chan walkEvent, 2*len(state))
+	og.mtx.Lock()
+	og.events = events
+	og.mtx.Unlock()
+	defer func() {
+		og.mtx.Lock()
+		og.events = nil
+		og.mtx.Unlock()
+	}()
+	ready := func(name string) bool {
+		for n, st := range state {
+			if levels[n] > levels[name] && (st == walkPending || st == walkRunning || st == walkStarted) {
+				return false
+			}
+		}
+		for _, d := range og.deps[name] {
+			switch state[d.Name] {
+			case walkSucceeded:
+			case walkFailed:
+				if !d.OrderOnly {
+					return false
+				}
+			case walkStarted:
+				if !d.Started {
+					return false
+				}
+			default:
+				return false
+			}
+		}
+		return true
+	}
+	// tolerated returns whether a failure of name can be tolerated because all of its dependents depend on it order-only
+	tolerated := func(name string) bool {
+		dependents := 0
+		for _, deps := range og.deps {
+			for _, d := range deps {
+				if d.Name != name {
+					continue
+				}
+				if !d.OrderOnly {
+					return false
+				}
+				dependents++
+			}
+		}
+		return dependents > 0
+	}
+	cancelled := func() error {
+		var lvl uint
+		for name, st := range state {
+			if (st == walkPending || st == walkRunning || st == walkStarted) && levels[name] > lvl {
+				lvl = levels[name]
+			}
+		}
+		return WalkError{Level: lvl, Err: errors.New("context was cancelled")}
+	}
+	var werr, tolerr, cerr error
+	done := ctx.Done()
+	running := 0
+	for {
+		if cerr == nil && ctx.Err() != nil {
+			cerr = cancelled()
+		}
+		if werr == nil && cerr == nil {
+			for _, obj := range order {
+				if og.MaxConcurrency > 0 && running >= og.MaxConcurrency {
+					break
+				}
+				if st, ok := state[obj.Name()]; !ok || st != walkPending || !ready(obj.Name()) || !tokens.acquire(obj) {
+					continue
+				}
+				state[obj.Name()] = walkRunning
+				running++
+				obj := obj
+				go func() {
+					events <- walkEvent{name: obj.Name(), done: true, err: af(obj)}
+				}()
+			}
+		}
+		if running == 0 {
+			break
+		}
+		select {
+		case <-done:
+			cerr = cancelled()
+			done = nil
+		case ev := <-events:
+			if !ev.done {
+				if state[ev.name] == walkRunning {
+					state[ev.name] = walkStarted
+				}
+				continue
+			}
+			running--
+			tokens.release(objs[ev.name])
+			if ev.err == nil {
+				state[ev.name] = walkSucceeded
+				continue
+			}
+			state[ev.name] = walkFailed
+			err := WalkError{Level: levels[ev.name], Err: ev.err}
+			if tolerated(ev.name) {
+				og.log("%v: failed, continuing (only order-only dependents): %v", ev.name, ev.err)
+				if tolerr == nil {
+					tolerr = err
+				}
+				continue
+			}
+			if werr == nil {
+				werr = err
+			}
+		}
+	}
+	if cerr != nil {
+		return cerr
+	}
+	if werr != nil {
+		return werr
+	}
+	return tolerr
+}
+
+// Started signals, from an ActionFunc during a Walk, that the action for the object named name has started (for example, an installation
+// has been submitted). This satisfies dependents that depend on the object with the started qualifier. It has no effect outside of a Walk.
+func (og *ObjectGraph) Started(name string) {
+	og.mtx.Lock()
+	defer og.mtx.Unlock()
+	if og.events == nil {
+		return
+	}
+	select {
+	case og.events <- walkEvent{name: name}:
+	default:
+	}
+}
+
+// WalkReverse traverses the graph levels in ascending order (dependents before their dependencies), executing af for every node in a given level concurrently.
+// This is useful for tearing down a graph.
+func (og *ObjectGraph) WalkReverse(ctx context.Context, af ActionFunc) error {
+	order := make([]int, len(og.levels))
+	for i := range order {
+		order[i] = i
+	}
+	return og.walk(ctx, af, order)
+}
+
+func (og *ObjectGraph) walk(ctx context.Context, af ActionFunc, order []int) error {
 	var g errgroup.Group
 	var werr WalkError
-	for i := len(og.levels) - 1; i >= 0; i-- {
+	for _, i := range order {
 		werr.Level = uint(i)
 		for j := range og.levels[i] {
 			select {
@@ -256,3 +578,62 @@ func (og *ObjectGraph) Walk(ctx context.Context, af ActionFunc) error {
 	}
 	return nil
 }
+
+// RewireDependencies returns the dependencies of each object in objs that is not in removed, with every dependency on a removed object
+// replaced by the (transitive) dependencies of that object. This preserves the ordering among the remaining objects when objects are
+// removed from a graph. Optional dependencies on removed objects are dropped, and dependencies reached through an order-only dependency
+// become order-only. Unknown or malformed dependencies are retained as-is.
+func RewireDependencies(objs []GraphObject, removed map[string]struct{}) map[string][]string {
+	omap := map[string]GraphObject{}
+	for _, o := range objs {
+		omap[o.Name()] = o
+	}
+	var resolve func(ds string, visiting map[string]struct{}) []string
+	resolve = func(ds string, visiting map[string]struct{}) []string {
+		d, err := ParseDependency(ds)
+		if err != nil {
+			return []string{ds}
+		}
+		if _, ok := removed[d.Name]; !ok {
+			return []string{ds}
+		}
+		o, ok := omap[d.Name]
+		// guard against cycles among removed objects (reported when the graph is built)
+		if _, v := visiting[d.Name]; !ok || v || d.Optional {
+			return nil
+		}
+		visiting[d.Name] = struct{}{}
+		defer delete(visiting, d.Name)
+		out := []string{}
+		for _, dd := range o.Dependencies() {
+			for _, rd := range resolve(dd, visiting) {
+				if d.OrderOnly {
+					if pd, err := ParseDependency(rd); err == nil {
+						pd.OrderOnly = true
+						rd = pd.String()
+					}
+				}
+				out = append(out, rd)
+			}
+		}
+		return out
+	}
+	out := map[string][]string{}
+	for _, o := range objs {
+		if _, ok := removed[o.Name()]; ok {
+			continue
+		}
+		deps := []string{}
+		seen := map[string]struct{}{}
+		for _, d := range o.Dependencies() {
+			for _, rd := range resolve(d, map[string]struct{}{}) {
+				if _, ok := seen[rd]; !ok {
+					seen[rd] = struct{}{}
+					deps = append(deps, rd)
+				}
+			}
+		}
+		out[o.Name()] = deps
+	}
+	return out
+}
@@ -2,9 +2,14 @@ package dag
 
 import (
 	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -139,6 +144,27 @@ func TestDAGBuildMissingName(t *testing.T) {
 	t.Logf(err.Error())
 }
 
+func TestDAGBuildDuplicateName(t *testing.T) {
+	objs := []GraphObject{
+		&testObj{
+			name: "a",
+			deps: []string{"b"},
+		},
+		&testObj{
+			name: "b",
+		},
+		&testObj{
+			name: "a",
+		},
+	}
+	og := ObjectGraph{}
+	err := og.Build(objs)
+	if err == nil {
+		t.Fatalf("should have failed")
+	}
+	t.Logf(err.Error())
+}
+
 func TestDAGUnknownDependency(t *testing.T) {
 	objs := []GraphObject{
 		&testObj{
@@ -357,3 +383,591 @@ func TestDAGDot(t *testing.T) {
 	exec.Command("/bin/bash", "-c", "dot ./testcharts.dot -Tpng -o ./testcharts.png && open ./testcharts.png").Run()
 	exec.Command("/bin/bash", "-c", "dot ./testchartsNoRoot.dot -Tpng -o ./testchartsNoRoot.png && open ./testchartsNoRoot.png").Run()
 }
+
+func TestDAGWalkReverse(t *testing.T) {
+	og := ObjectGraph{}
+	if err := og.Build(testobjs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	m := lockingMap{m: make(map[string]time.Time)}
+	af := func(gobj GraphObject) error {
+		time.Sleep(1 * time.Millisecond)
+		m.Lock()
+		m.m[gobj.Name()] = time.Now().UTC()
+		m.Unlock()
+		return nil
+	}
+	if err := og.WalkReverse(context.Background(), af); err != nil {
+		t.Fatalf("error in WalkReverse: %v", err)
+	}
+	if len(m.m) != len(testobjs) {
+		t.Fatalf("bad results length: %v (wanted %v)", len(m.m), len(testobjs))
+	}
+	for _, o := range testobjs {
+		for _, d := range o.Dependencies() {
+			if !m.m[o.Name()].Before(m.m[d]) {
+				t.Fatalf("%v not before %v", o.Name(), d)
+			}
+		}
+	}
+}
+
+func TestRewireDependencies(t *testing.T) {
+	objs := []GraphObject{
+		&testObj{name: "a", deps: []string{"b", "c"}},
+		&testObj{name: "b", deps: []string{"d"}},
+		&testObj{name: "c", deps: []string{"d", "e"}},
+		&testObj{name: "d", deps: []string{"f"}},
+		&testObj{name: "e"},
+		&testObj{name: "f"},
+	}
+	deps := RewireDependencies(objs, map[string]struct{}{"c": struct{}{}, "d": struct{}{}})
+	if len(deps) != 4 {
+		t.Fatalf("bad length: %v", len(deps))
+	}
+	if !reflect.DeepEqual(deps["a"], []string{"b", "f", "e"}) {
+		t.Fatalf("bad deps for a: %v", deps["a"])
+	}
+	if !reflect.DeepEqual(deps["b"], []string{"f"}) {
+		t.Fatalf("bad deps for b: %v", deps["b"])
+	}
+	if len(deps["e"]) != 0 || len(deps["f"]) != 0 {
+		t.Fatalf("leaves should have no dependencies: %v", deps)
+	}
+	rewired := []GraphObject{}
+	for _, n := range []string{"a", "b", "e", "f"} {
+		rewired = append(rewired, &testObj{name: n, deps: deps[n]})
+	}
+	og := ObjectGraph{}
+	if err := og.Build(rewired); err != nil {
+		t.Fatalf("rewired graph should have built: %v", err)
+	}
+}
+
+func TestRewireDependenciesQualifiers(t *testing.T) {
+	objs := []GraphObject{
+		&testObj{name: "a", deps: []string{"b:optional", "c:order-only"}},
+		&testObj{name: "b", deps: []string{"d"}},
+		&testObj{name: "c", deps: []string{"d:started"}},
+		&testObj{name: "d"},
+	}
+	deps := RewireDependencies(objs, map[string]struct{}{"b": struct{}{}, "c": struct{}{}})
+	if !reflect.DeepEqual(deps["a"], []string{"d:order-only,started"}) {
+		t.Fatalf("bad deps for a: %v", deps["a"])
+	}
+}
+
+func TestParseDependency(t *testing.T) {
+	cases := []struct {
+		name, input string
+		output      Dependency
+		isErr       bool
+	}{
+		{"plain", "redis", Dependency{Name: "redis"}, false},
+		{"optional", "redis:optional", Dependency{Name: "redis", Optional: true}, false},
+		{"multiple", "redis: order-only, started", Dependency{Name: "redis", OrderOnly: true, Started: true}, false},
+		{"unknown qualifier", "redis:maybe", Dependency{}, true},
+		{"empty name", ":optional", Dependency{}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d, err := ParseDependency(c.input)
+			if err != nil {
+				if !c.isErr {
+					t.Fatalf("should have succeeded: %v", err)
+				}
+				return
+			}
+			if c.isErr {
+				t.Fatalf("should have failed")
+			}
+			if d != c.output {
+				t.Fatalf("bad output: %+v (expected %+v)", d, c.output)
+			}
+			if d2, _ := ParseDependency(d.String()); d2 != d {
+				t.Fatalf("String() doesn't round trip: %v", d.String())
+			}
+		})
+	}
+}
+
+func TestDAGOptionalDependency(t *testing.T) {
+	og := ObjectGraph{}
+	objs := []GraphObject{
+		&testObj{name: "a", deps: []string{"b", "missing:optional"}},
+		&testObj{name: "b"},
+	}
+	if err := og.Build(objs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	_, levels, _ := og.Info()
+	if len(levels) != 2 {
+		t.Fatalf("bad levels: %v", levels)
+	}
+	objs[0].(*testObj).deps = []string{"b:sometimes"}
+	if err := og.Build(objs); err == nil {
+		t.Fatalf("unknown qualifier should have failed")
+	}
+}
+
+func TestDAGWalkQualifiers(t *testing.T) {
+	objs := []GraphObject{
+		&testObj{name: "a", deps: []string{"b:order-only"}},
+		&testObj{name: "b"},
+		&testObj{name: "c", deps: []string{"d:started"}},
+		&testObj{name: "d"},
+		&testObj{name: "e", deps: []string{"f"}},
+		&testObj{name: "f"},
+	}
+	og := ObjectGraph{}
+	if err := og.Build(objs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	_, levels, _ := og.Info()
+	for _, l := range levels {
+		names := map[string]bool{}
+		for _, o := range l {
+			names[o.Name()] = true
+		}
+		if names["c"] != names["d"] {
+			t.Fatalf("c and d should share a level: %v", levels)
+		}
+	}
+	var mtx sync.Mutex
+	ran := map[string]bool{}
+	cstarted := make(chan struct{})
+	af := func(obj GraphObject) error {
+		mtx.Lock()
+		ran[obj.Name()] = true
+		mtx.Unlock()
+		switch obj.Name() {
+		case "b":
+			return errors.New("b failed")
+		case "d":
+			og.Started("d")
+			// d only finishes once c (which only needs d to have started) has run
+			select {
+			case <-cstarted:
+			case <-time.After(5 * time.Second):
+				return errors.New("c did not start")
+			}
+		case "c":
+			close(cstarted)
+		}
+		return nil
+	}
+	err := og.Walk(context.Background(), af)
+	if err == nil {
+		t.Fatalf("should have returned the error of b")
+	}
+	if we, ok := err.(WalkError); !ok || we.Err.Error() != "b failed" {
+		t.Fatalf("bad error: %v", err)
+	}
+	for _, n := range []string{"a", "b", "c", "d", "e", "f"} {
+		if !ran[n] {
+			t.Fatalf("%v should have run", n)
+		}
+	}
+	// a hard dependency failure aborts the walk
+	objs[0].(*testObj).deps = []string{"b"}
+	if err := og.Build(objs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	ran = map[string]bool{}
+	af2 := func(obj GraphObject) error {
+		mtx.Lock()
+		ran[obj.Name()] = true
+		mtx.Unlock()
+		if obj.Name() == "b" {
+			return errors.New("b failed")
+		}
+		return nil
+	}
+	if err := og.Walk(context.Background(), af2); err == nil {
+		t.Fatalf("should have failed")
+	}
+	if ran["a"] {
+		t.Fatalf("a should not have run")
+	}
+}
+
+func TestDAGCriticalPath(t *testing.T) {
+	objs := []GraphObject{
+		&testObj{name: "app", deps: []string{"db", "cache"}},
+		&testObj{name: "db", deps: []string{"storage"}},
+		&testObj{name: "cache"},
+		&testObj{name: "storage"},
+		&testObj{name: "sidecar", deps: []string{"app:started"}},
+	}
+	og := ObjectGraph{}
+	if err := og.Build(objs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	durations := map[string]time.Duration{
+		"storage": time.Minute,
+		"db":      2 * time.Minute,
+		"cache":   5 * time.Minute,
+		"app":     3 * time.Minute,
+		"sidecar": time.Minute,
+	}
+	cp, err := og.CriticalPath(durations)
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if cp.Total != 9*time.Minute {
+		t.Errorf("bad total: %v", cp.Total)
+	}
+	if !reflect.DeepEqual(cp.Path, []string{"storage", "cache", "app"}) {
+		t.Errorf("bad path: %v", cp.Path)
+	}
+	expected := map[string]NodeSchedule{
+		"storage": {Name: "storage", Duration: time.Minute, Critical: true},
+		"cache":   {Name: "cache", Duration: 5 * time.Minute, EarliestStart: time.Minute, Critical: true},
+		"db":      {Name: "db", Duration: 2 * time.Minute, EarliestStart: time.Minute, Slack: 3 * time.Minute},
+		"app":     {Name: "app", Duration: 3 * time.Minute, EarliestStart: 6 * time.Minute, Critical: true},
+		"sidecar": {Name: "sidecar", Duration: time.Minute, EarliestStart: 6 * time.Minute, Slack: 2 * time.Minute},
+	}
+	if len(cp.Nodes) != len(expected) {
+		t.Fatalf("bad node count: %v", cp.Nodes)
+	}
+	for _, ns := range cp.Nodes {
+		if ns != expected[ns.Name] {
+			t.Errorf("bad schedule for %v: %+v", ns.Name, ns)
+		}
+	}
+	// without durations, everything starts immediately
+	cp, err = og.CriticalPath(nil)
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if cp.Total != 0 {
+		t.Errorf("bad total: %v", cp.Total)
+	}
+}
+
+func TestDAGDotHighlight(t *testing.T) {
+	og := ObjectGraph{}
+	if err := og.Build(testobjs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	b, err := og.Dot("testcharts", "h", "g", "c")
+	if err != nil {
+		t.Fatalf("dot failed: %v", err)
+	}
+	out := string(b)
+	for _, s := range []string{"c [\n", "c -> g [\n", "g -> h [\n", "color=red"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("missing %q in output:\n%v", s, out)
+		}
+	}
+	if !strings.Contains(out, "a -> c;\n") || !strings.Contains(out, "i;\n") {
+		t.Errorf("node or edge shouldn't be highlighted:\n%v", out)
+	}
+}
+
+func TestDAGRender(t *testing.T) {
+	objs := []GraphObject{
+		&testObj{name: "app", deps: []string{"db", "cache"}},
+		&testObj{name: "db", deps: []string{"storage"}},
+		&testObj{name: "cache", deps: []string{"storage:order-only"}},
+		&testObj{name: "storage"},
+		&testObj{name: "worker", deps: []string{"db"}},
+	}
+	og := ObjectGraph{}
+	if err := og.Build(objs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	ascii := `app
+├── cache
+│   └── storage [order-only]
+└── db
+    └── storage
+worker
+└── db (*)
+
+(*) dependencies shown above
+`
+	if out := string(og.ASCII()); out != ascii {
+		t.Errorf("bad ascii output:\n%v", out)
+	}
+	mermaid := string(og.Mermaid("storage", "db", "app"))
+	for _, s := range []string{"flowchart TD\n", `n0["app"]`, "n0 --> n2\n", "n1 -.->|order-only| n3\n", "class n3,n2,n0 highlight\n"} {
+		if !strings.Contains(mermaid, s) {
+			t.Errorf("missing %q in mermaid output:\n%v", s, mermaid)
+		}
+	}
+	if strings.Contains(mermaid, rootName) {
+		t.Errorf("synthetic root should be hidden:\n%v", mermaid)
+	}
+	svg := og.SVG("storage", "db", "app")
+	if err := xml.Unmarshal(svg, new(interface{})); err != nil {
+		t.Errorf("bad svg: %v", err)
+	}
+	if n := strings.Count(string(svg), "<rect "); n != len(objs) {
+		t.Errorf("bad svg node count: %v", n)
+	}
+	if n := strings.Count(string(svg), "<line "); n != 5 {
+		t.Errorf("bad svg edge count: %v", n)
+	}
+	b, err := og.JSON()
+	if err != nil {
+		t.Fatalf("json failed: %v", err)
+	}
+	jg := jsonGraph{}
+	if err := json.Unmarshal(b, &jg); err != nil {
+		t.Fatalf("bad json: %v", err)
+	}
+	if !reflect.DeepEqual(jg.Phases, [][]string{{"storage"}, {"cache", "db"}, {"app", "worker"}}) {
+		t.Errorf("bad phases: %v", jg.Phases)
+	}
+	if len(jg.Nodes) != len(objs) || len(jg.Edges) != 5 {
+		t.Errorf("bad nodes or edges: %+v", jg)
+	}
+	for _, e := range jg.Edges {
+		if e.OrderOnly != (e.From == "cache") {
+			t.Errorf("bad edge: %+v", e)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	old := ObjectGraph{}
+	if err := old.Build([]GraphObject{
+		&testObj{name: "app", deps: []string{"db", "cache"}},
+		&testObj{name: "db"},
+		&testObj{name: "cache"},
+		&testObj{name: "legacy", deps: []string{"db"}},
+	}); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	new := ObjectGraph{}
+	if err := new.Build([]GraphObject{
+		&testObj{name: "app", deps: []string{"db", "cache:started"}},
+		&testObj{name: "db", deps: []string{"storage"}},
+		&testObj{name: "cache"},
+		&testObj{name: "storage"},
+	}); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	diff := Compare(&old, &new)
+	expected := &GraphDiff{
+		AddedNodes:       []string{"storage"},
+		RemovedNodes:     []string{"legacy"},
+		AddedEdges:       []Edge{{From: "db", To: "storage", Qualifiers: []string{}}},
+		RemovedEdges:     []Edge{{From: "legacy", To: "db", Qualifiers: []string{}}},
+		QualifierChanges: []QualifierChange{{From: "app", To: "cache", Old: []string{}, New: []string{"started"}}},
+		PhaseChanges:     []PhaseChange{{Name: "app", Old: 2, New: 3}, {Name: "cache", Old: 1, New: 3}, {Name: "db", Old: 1, New: 2}},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("bad diff: %+v", diff)
+	}
+	if diff.Empty() {
+		t.Errorf("diff shouldn't be empty")
+	}
+	if diff := Compare(&new, &new); !diff.Empty() {
+		t.Errorf("diff should be empty: %+v", diff)
+	}
+}
+
+type testPrioObj struct {
+	testObj
+	priority int
+}
+
+func (tpo *testPrioObj) Priority() int {
+	return tpo.priority
+}
+
+func TestDAGLevelOrder(t *testing.T) {
+	objs := []GraphObject{
+		&testObj{name: "app", deps: []string{"db", "cache", "queue", "search"}},
+		&testPrioObj{testObj: testObj{name: "search"}, priority: -1},
+		&testObj{name: "queue"},
+		&testPrioObj{testObj: testObj{name: "db"}, priority: 10},
+		&testObj{name: "cache"},
+	}
+	expected := [][]string{{"app"}, {"db", "cache", "queue", "search"}}
+	for i := 0; i < 20; i++ {
+		og := ObjectGraph{}
+		if err := og.Build(objs); err != nil {
+			t.Fatalf("should have succeeded: %v", err)
+		}
+		_, levels, _ := og.Info()
+		names := [][]string{}
+		for _, l := range levels {
+			ln := []string{}
+			for _, o := range l {
+				ln = append(ln, o.Name())
+			}
+			names = append(names, ln)
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Fatalf("bad levels (build %v): %v", i, names)
+		}
+	}
+}
+
+func TestDAGPhasesPriority(t *testing.T) {
+	objs := []GraphObject{
+		&testObj{name: "app", deps: []string{"db", "cache", "queue", "search"}},
+		&testPrioObj{testObj: testObj{name: "search"}, priority: -1},
+		&testObj{name: "queue"},
+		&testPrioObj{testObj: testObj{name: "db"}, priority: 10},
+		&testObj{name: "cache"},
+	}
+	og := ObjectGraph{}
+	if err := og.Build(objs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	b, err := og.JSON()
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	jg := jsonGraph{}
+	if err := json.Unmarshal(b, &jg); err != nil {
+		t.Fatalf("error unmarshaling: %v", err)
+	}
+	expected := [][]string{{"db", "cache", "queue", "search"}, {"app"}}
+	if !reflect.DeepEqual(jg.Phases, expected) {
+		t.Fatalf("bad phases: %v", jg.Phases)
+	}
+}
+
+func TestDAGWalkPriority(t *testing.T) {
+	objs := []GraphObject{
+		&testObj{name: "app", deps: []string{"db", "cache", "queue"}},
+		&testObj{name: "queue"},
+		&testPrioObj{testObj: testObj{name: "db"}, priority: 10},
+		&testObj{name: "cache"},
+		&testPrioObj{testObj: testObj{name: "worker"}, priority: 5},
+	}
+	og := ObjectGraph{MaxConcurrency: 1}
+	if err := og.Build(objs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	var mtx sync.Mutex
+	running, maxRunning := 0, 0
+	order := []string{}
+	af := func(obj GraphObject) error {
+		mtx.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		order = append(order, obj.Name())
+		mtx.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mtx.Lock()
+		running--
+		mtx.Unlock()
+		return nil
+	}
+	if err := og.Walk(context.Background(), af); err != nil {
+		t.Fatalf("walk should have succeeded: %v", err)
+	}
+	if maxRunning != 1 {
+		t.Errorf("concurrency limit exceeded: %v", maxRunning)
+	}
+	if !reflect.DeepEqual(order, []string{"db", "cache", "queue", "worker", "app"}) {
+		t.Errorf("bad order: %v", order)
+	}
+}
+
+type testResObj struct {
+	testObj
+	res map[string]int
+}
+
+func (tro *testResObj) Resources() map[string]int {
+	return tro.res
+}
+
+func TestDAGWalkResources(t *testing.T) {
+	objs := []GraphObject{
+		&testResObj{testObj: testObj{name: "migrate-a"}, res: map[string]int{"db": 1}},
+		&testResObj{testObj: testObj{name: "migrate-b"}, res: map[string]int{"db": 1}},
+		&testResObj{testObj: testObj{name: "migrate-c"}, res: map[string]int{"db": 1}},
+		&testResObj{testObj: testObj{name: "big-a"}, res: map[string]int{"pool": 2}},
+		&testResObj{testObj: testObj{name: "big-b"}, res: map[string]int{"pool": 2}},
+		&testObj{name: "free"},
+	}
+	og := ObjectGraph{ResourceLimits: map[string]int{"pool": 3}}
+	if err := og.Build(objs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	var mtx sync.Mutex
+	running := map[string]bool{}
+	overlaps := map[[2]string]bool{}
+	af := func(obj GraphObject) error {
+		mtx.Lock()
+		for n := range running {
+			overlaps[[2]string{n, obj.Name()}] = true
+			overlaps[[2]string{obj.Name(), n}] = true
+		}
+		running[obj.Name()] = true
+		mtx.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mtx.Lock()
+		delete(running, obj.Name())
+		mtx.Unlock()
+		return nil
+	}
+	if err := og.Walk(context.Background(), af); err != nil {
+		t.Fatalf("walk should have succeeded: %v", err)
+	}
+	for _, pair := range [][2]string{{"migrate-a", "migrate-b"}, {"migrate-a", "migrate-c"}, {"migrate-b", "migrate-c"}, {"big-a", "big-b"}} {
+		if overlaps[pair] {
+			t.Errorf("%v and %v shouldn't have run concurrently", pair[0], pair[1])
+		}
+	}
+	if !overlaps[[2]string{"free", "migrate-a"}] || !overlaps[[2]string{"big-a", "migrate-a"}] {
+		t.Errorf("objects without shared resources should have run concurrently: %v", overlaps)
+	}
+	if users := og.ResourceUsers(); !reflect.DeepEqual(users["db"], []string{"migrate-a", "migrate-b", "migrate-c"}) {
+		t.Errorf("bad resource users: %v", users)
+	}
+	og = ObjectGraph{}
+	if err := og.Build(objs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if err := og.Walk(context.Background(), af); err == nil {
+		t.Fatalf("walk should have failed (pool has one token)")
+	}
+}
+
+func TestDAGWalkCancel(t *testing.T) {
+	og := ObjectGraph{}
+	if err := og.Build(testobjs); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mtx sync.Mutex
+	started := map[string]bool{}
+	// finished is read after Walk returns without locking, so a walk that doesn't wait for the running actions is reported by the race detector
+	finished := map[string]bool{}
+	af := func(obj GraphObject) error {
+		mtx.Lock()
+		started[obj.Name()] = true
+		mtx.Unlock()
+		cancel()
+		time.Sleep(20 * time.Millisecond)
+		mtx.Lock()
+		finished[obj.Name()] = true
+		mtx.Unlock()
+		return nil
+	}
+	err := og.Walk(ctx, af)
+	if err == nil {
+		t.Fatalf("walk should have been cancelled")
+	}
+	if we, ok := err.(WalkError); !ok || !strings.Contains(we.Err.Error(), "cancelled") {
+		t.Fatalf("bad error: %v", err)
+	}
+	if len(finished) == 0 || len(finished) != len(started) {
+		t.Fatalf("walk should have waited for the running actions: started: %v, finished: %v", started, finished)
+	}
+	if finished["a"] || finished["b"] {
+		t.Fatalf("no actions should have been started after cancellation: %v", finished)
+	}
+}
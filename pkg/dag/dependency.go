@@ -0,0 +1,73 @@
+package dag
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dependency qualifiers, appended to a dependency name after a colon and separated by commas (eg, "redis:optional,order-only")
+const (
+	// QualifierOptional means the dependency is ignored if it isn't present in the graph
+	QualifierOptional = "optional"
+	// QualifierOrderOnly means the dependent waits for the dependency to finish but doesn't require it to succeed
+	QualifierOrderOnly = "order-only"
+	// QualifierStarted means the dependent only waits for the dependency to start (see ObjectGraph.Started)
+	QualifierStarted = "started"
+)
+
+// Dependency is a parsed dependency of a graph object
+type Dependency struct {
+	Name      string
+	Optional  bool
+	OrderOnly bool
+	Started   bool
+}
+
+// Qualifiers returns the qualifiers of the dependency
+func (d Dependency) Qualifiers() []string {
+	qs := []string{}
+	if d.Optional {
+		qs = append(qs, QualifierOptional)
+	}
+	if d.OrderOnly {
+		qs = append(qs, QualifierOrderOnly)
+	}
+	if d.Started {
+		qs = append(qs, QualifierStarted)
+	}
+	return qs
+}
+
+// String returns the dependency in the form accepted by ParseDependency
+func (d Dependency) String() string {
+	qs := d.Qualifiers()
+	if len(qs) == 0 {
+		return d.Name
+	}
+	return d.Name + ":" + strings.Join(qs, ",")
+}
+
+// ParseDependency parses a dependency of the form "name" or "name:qualifier[,qualifier...]"
+func ParseDependency(s string) (Dependency, error) {
+	parts := strings.SplitN(s, ":", 2)
+	d := Dependency{Name: strings.TrimSpace(parts[0])}
+	if d.Name == "" {
+		return d, fmt.Errorf("empty dependency name: %q", s)
+	}
+	if len(parts) == 1 {
+		return d, nil
+	}
+	for _, q := range strings.Split(parts[1], ",") {
+		switch strings.TrimSpace(q) {
+		case QualifierOptional:
+			d.Optional = true
+		case QualifierOrderOnly:
+			d.OrderOnly = true
+		case QualifierStarted:
+			d.Started = true
+		default:
+			return d, fmt.Errorf("unknown qualifier in dependency %q: %q", s, q)
+		}
+	}
+	return d, nil
+}
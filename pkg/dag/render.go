@@ -0,0 +1,306 @@
+package dag
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// renderNames returns the names of the objects in the graph (without the synthetic root), sorted
+func (og *ObjectGraph) renderNames() []string {
+	names := []string{}
+	for _, o := range og.objs {
+		if o.Name() != rootName {
+			names = append(names, o.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderDeps returns the dependencies of name present in the graph, sorted by name
+func (og *ObjectGraph) renderDeps(name string) []Dependency {
+	deps := append([]Dependency{}, og.deps[name]...)
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Name < deps[j].Name })
+	return deps
+}
+
+// phases returns the names of the objects in installation order: phase 1 (the highest level) first, each in the start order of its level
+// (by descending priority, then by name). The synthetic root is omitted.
+func (og *ObjectGraph) phases() [][]string {
+	out := [][]string{}
+	for i := len(og.levels) - 1; i >= 0; i-- {
+		p := []string{}
+		for _, o := range og.levels[i] {
+			if o.Name() != rootName {
+				p = append(p, o.Name())
+			}
+		}
+		if len(p) > 0 {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// ASCII returns a text tree of the graph: each object without dependents followed by its dependencies, recursively. Objects that were
+// already expanded are marked with (*) instead of being expanded again.
+func (og *ObjectGraph) ASCII() []byte {
+	dependents := map[string]int{}
+	for _, deps := range og.deps {
+		for _, d := range deps {
+			dependents[d.Name]++
+		}
+	}
+	buf := &bytes.Buffer{}
+	expanded := map[string]bool{}
+	repeated := false
+	var render func(name, q, prefix, childPrefix string)
+	render = func(name, q, prefix, childPrefix string) {
+		fmt.Fprintf(buf, "%v%v", prefix, name)
+		if q != "" {
+			fmt.Fprintf(buf, " [%v]", q)
+		}
+		deps := og.renderDeps(name)
+		if expanded[name] && len(deps) > 0 {
+			buf.WriteString(" (*)\n")
+			repeated = true
+			return
+		}
+		buf.WriteString("\n")
+		expanded[name] = true
+		for i, d := range deps {
+			if i == len(deps)-1 {
+				render(d.Name, strings.Join(d.Qualifiers(), ","), childPrefix+"└── ", childPrefix+"    ")
+			} else {
+				render(d.Name, strings.Join(d.Qualifiers(), ","), childPrefix+"├── ", childPrefix+"│   ")
+			}
+		}
+	}
+	for _, n := range og.renderNames() {
+		if dependents[n] == 0 {
+			render(n, "", "", "")
+		}
+	}
+	if repeated {
+		buf.WriteString("\n(*) dependencies shown above\n")
+	}
+	return buf.Bytes()
+}
+
+// Mermaid returns a Mermaid flowchart of the graph, with edges from dependents to their dependencies. Qualified dependencies are
+// dashed and labeled, and the nodes named in highlight are highlighted.
+func (og *ObjectGraph) Mermaid(highlight ...string) []byte {
+	names := og.renderNames()
+	ids := map[string]string{}
+	buf := &bytes.Buffer{}
+	buf.WriteString("flowchart TD\n")
+	for i, n := range names {
+		ids[n] = fmt.Sprintf("n%v", i)
+		fmt.Fprintf(buf, "    %v[\"%v\"]\n", ids[n], strings.ReplaceAll(n, `"`, "#quot;"))
+	}
+	for _, n := range names {
+		for _, d := range og.renderDeps(n) {
+			if q := strings.Join(d.Qualifiers(), ","); q != "" {
+				fmt.Fprintf(buf, "    %v -.->|%v| %v\n", ids[n], q, ids[d.Name])
+				continue
+			}
+			fmt.Fprintf(buf, "    %v --> %v\n", ids[n], ids[d.Name])
+		}
+	}
+	hids := []string{}
+	for _, n := range highlight {
+		if id, ok := ids[n]; ok {
+			hids = append(hids, id)
+		}
+	}
+	if len(hids) > 0 {
+		buf.WriteString("    classDef highlight stroke:#d00,stroke-width:3px\n")
+		fmt.Fprintf(buf, "    class %v highlight\n", strings.Join(hids, ","))
+	}
+	return buf.Bytes()
+}
+
+// SVG layout parameters
+const (
+	svgNodeHeight = 30
+	svgCharWidth  = 8
+	svgMinWidth   = 60
+	svgHGap       = 20
+	svgVGap       = 60
+	svgMargin     = 20
+)
+
+type svgNode struct {
+	name    string
+	x, y, w int
+}
+
+// SVG returns an SVG image of the graph, laid out in rows by level with the objects installed last at the top and edges from dependents
+// to their dependencies. Qualified dependencies are dashed, and the nodes named in highlight (and the edges between consecutive ones) are
+// drawn in red.
+func (og *ObjectGraph) SVG(highlight ...string) []byte {
+	rows := og.phases()
+	// the objects installed last go at the top, like the DOT output
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+	// order each row by the mean position of its dependents in the rows above, to reduce crossings
+	pos := map[string]float64{}
+	dependents := map[string][]string{}
+	for n, deps := range og.deps {
+		for _, d := range deps {
+			dependents[d.Name] = append(dependents[d.Name], n)
+		}
+	}
+	for _, row := range rows {
+		bary := map[string]float64{}
+		for _, n := range row {
+			sum, cnt := 0.0, 0
+			for _, dn := range dependents[n] {
+				if p, ok := pos[dn]; ok {
+					sum += p
+					cnt++
+				}
+			}
+			if cnt > 0 {
+				bary[n] = sum / float64(cnt)
+			}
+		}
+		sort.SliceStable(row, func(i, j int) bool { return bary[row[i]] < bary[row[j]] })
+		for i, n := range row {
+			pos[n] = float64(i)
+		}
+	}
+	nodes := map[string]*svgNode{}
+	rowWidths := make([]int, len(rows))
+	width := 0
+	for i, row := range rows {
+		for j, n := range row {
+			w := len([]rune(n))*svgCharWidth + 20
+			if w < svgMinWidth {
+				w = svgMinWidth
+			}
+			nodes[n] = &svgNode{name: n, w: w, y: svgMargin + i*(svgNodeHeight+svgVGap)}
+			if j > 0 {
+				rowWidths[i] += svgHGap
+			}
+			rowWidths[i] += w
+		}
+		if rowWidths[i] > width {
+			width = rowWidths[i]
+		}
+	}
+	for i, row := range rows {
+		x := svgMargin + (width-rowWidths[i])/2
+		for _, n := range row {
+			nodes[n].x = x
+			x += nodes[n].w + svgHGap
+		}
+	}
+	hn := map[string]bool{}
+	he := map[[2]string]bool{}
+	for i, n := range highlight {
+		hn[n] = true
+		if i > 0 {
+			he[[2]string{n, highlight[i-1]}] = true
+		}
+	}
+	height := 2*svgMargin + len(rows)*svgNodeHeight
+	if len(rows) > 1 {
+		height += (len(rows) - 1) * svgVGap
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%v\" height=\"%v\" viewBox=\"0 0 %v %v\" font-family=\"sans-serif\" font-size=\"13\">\n",
+		width+2*svgMargin, height, width+2*svgMargin, height)
+	buf.WriteString("  <defs>\n")
+	for _, c := range []string{"black", "red"} {
+		fmt.Fprintf(buf, "    <marker id=\"arrow-%v\" viewBox=\"0 0 10 10\" refX=\"10\" refY=\"5\" markerWidth=\"8\" markerHeight=\"8\" orient=\"auto\">"+
+			"<path d=\"M0,0 L10,5 L0,10 z\" fill=\"%v\"/></marker>\n", c, c)
+	}
+	buf.WriteString("  </defs>\n")
+	for _, n := range og.renderNames() {
+		from := nodes[n]
+		for _, d := range og.renderDeps(n) {
+			to := nodes[d.Name]
+			color, sw := "black", 1
+			if he[[2]string{n, d.Name}] {
+				color, sw = "red", 2
+			}
+			dash := ""
+			if len(d.Qualifiers()) > 0 {
+				dash = ` stroke-dasharray="5,4"`
+			}
+			x1, y1, x2, y2 := from.x+from.w/2, from.y+svgNodeHeight, to.x+to.w/2, to.y
+			if from.y == to.y { // started dependencies may be in the same row
+				y1, y2 = from.y+svgNodeHeight/2, to.y+svgNodeHeight/2
+				if from.x < to.x {
+					x1, x2 = from.x+from.w, to.x
+				} else {
+					x1, x2 = from.x, to.x+to.w
+				}
+			}
+			fmt.Fprintf(buf, "  <line x1=\"%v\" y1=\"%v\" x2=\"%v\" y2=\"%v\" stroke=\"%v\" stroke-width=\"%v\"%v marker-end=\"url(#arrow-%v)\"/>\n",
+				x1, y1, x2, y2, color, sw, dash, color)
+		}
+	}
+	for _, n := range og.renderNames() {
+		sn := nodes[n]
+		color, sw := "black", 1
+		if hn[n] {
+			color, sw = "red", 2
+		}
+		fmt.Fprintf(buf, "  <g><rect x=\"%v\" y=\"%v\" width=\"%v\" height=\"%v\" rx=\"6\" fill=\"white\" stroke=\"%v\" stroke-width=\"%v\"/>"+
+			"<text x=\"%v\" y=\"%v\" text-anchor=\"middle\" dominant-baseline=\"central\">%v</text></g>\n",
+			sn.x, sn.y, sn.w, svgNodeHeight, color, sw, sn.x+sn.w/2, sn.y+svgNodeHeight/2, html.EscapeString(n))
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes()
+}
+
+type jsonGraph struct {
+	Phases [][]string `json:"phases"`
+	Nodes  []jsonNode `json:"nodes"`
+	Edges  []jsonEdge `json:"edges"`
+}
+
+type jsonNode struct {
+	Name  string `json:"name"`
+	Phase int    `json:"phase"`
+}
+
+type jsonEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Optional  bool   `json:"optional,omitempty"`
+	OrderOnly bool   `json:"order_only,omitempty"`
+	Started   bool   `json:"started,omitempty"`
+}
+
+// JSON returns a JSON document with the installation phases, the nodes (with their phase, starting at 1) and the edges (from dependents
+// to their dependencies, with their qualifiers) of the graph
+func (og *ObjectGraph) JSON() ([]byte, error) {
+	jg := jsonGraph{Phases: og.phases(), Nodes: []jsonNode{}, Edges: []jsonEdge{}}
+	phase := map[string]int{}
+	for i, p := range jg.Phases {
+		for _, n := range p {
+			phase[n] = i + 1
+		}
+	}
+	for _, n := range og.renderNames() {
+		jg.Nodes = append(jg.Nodes, jsonNode{Name: n, Phase: phase[n]})
+		for _, d := range og.renderDeps(n) {
+			jg.Edges = append(jg.Edges, jsonEdge{From: n, To: d.Name, Optional: d.Optional, OrderOnly: d.OrderOnly, Started: d.Started})
+		}
+	}
+	b, err := json.MarshalIndent(jg, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling graph to json")
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,91 @@
+package dag
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ResourceUser is implemented by graph objects that use shared resources (for example, a database that only tolerates one schema
+// migration at a time). During a Walk, an object only starts once the tokens it needs of every resource are available, and it holds them
+// until its action finishes. This limits concurrency without adding dependencies between the objects.
+type ResourceUser interface {
+	Resources() map[string]int // tokens needed, by resource name
+}
+
+// resources returns the tokens needed by o
+func resources(o GraphObject) map[string]int {
+	if ru, ok := o.(ResourceUser); ok {
+		return ru.Resources()
+	}
+	return nil
+}
+
+// resourceCapacity returns the number of tokens of resource available during a Walk: its limit in ResourceLimits, or one if it has none
+// (so that objects using the resource run one at a time)
+func (og *ObjectGraph) resourceCapacity(resource string) int {
+	if n, ok := og.ResourceLimits[resource]; ok {
+		return n
+	}
+	return 1
+}
+
+// checkResources verifies that every object needs a positive number of tokens of each resource, and no more than its capacity
+func (og *ObjectGraph) checkResources() error {
+	for _, o := range og.objs {
+		res := resources(o)
+		names := make([]string, 0, len(res))
+		for r := range res {
+			names = append(names, r)
+		}
+		sort.Strings(names)
+		for _, r := range names {
+			if res[r] <= 0 {
+				return fmt.Errorf("%v: tokens of resource %v must be positive: %v", o.Name(), r, res[r])
+			}
+			if c := og.resourceCapacity(r); res[r] > c {
+				return fmt.Errorf("%v: needs %v tokens of resource %v, which only has %v", o.Name(), res[r], r, c)
+			}
+		}
+	}
+	return nil
+}
+
+// ResourceUsers returns the names of the objects that use each resource, in level order
+func (og *ObjectGraph) ResourceUsers() map[string][]string {
+	out := map[string][]string{}
+	for i := len(og.levels) - 1; i >= 0; i-- {
+		for _, o := range og.levels[i] {
+			for r := range resources(o) {
+				out[r] = append(out[r], o.Name())
+			}
+		}
+	}
+	return out
+}
+
+// tokenPool tracks the resource tokens in use during a Walk
+type tokenPool struct {
+	og    *ObjectGraph
+	inUse map[string]int
+}
+
+// acquire takes the tokens needed by o if they are all available, and returns whether it did
+func (tp *tokenPool) acquire(o GraphObject) bool {
+	res := resources(o)
+	for r, n := range res {
+		if tp.inUse[r]+n > tp.og.resourceCapacity(r) {
+			return false
+		}
+	}
+	for r, n := range res {
+		tp.inUse[r] += n
+	}
+	return true
+}
+
+// release returns the tokens held by o
+func (tp *tokenPool) release(o GraphObject) {
+	for r, n := range resources(o) {
+		tp.inUse[r] -= n
+	}
+}
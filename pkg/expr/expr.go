@@ -0,0 +1,391 @@
+/*
+Package expr implements a small boolean expression language used to conditionally enable charts in a graph.
+
+Expressions are made of variables, string literals ('single' or "double" quoted), the literals true and false,
+comparisons (== and !=), negation (!), conjunction (&&), disjunction (||) and parentheses. For example:
+
+	env == "production" && !disable_cache
+	region != 'eu' || (with_cdn && tier == "premium")
+
+A variable or literal used as a boolean must have one of the values true/false, yes/no, on/off or 1/0 (case insensitive).
+Referencing an undefined variable is an error.
+*/
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// LookupFunc returns the value of the variable name and whether it is defined
+type LookupFunc func(name string) (string, bool)
+
+// Expr is a parsed expression
+type Expr struct {
+	src  string
+	root node
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Vars returns the names of the variables referenced by the expression, in order of first appearance
+func (e *Expr) Vars() []string {
+	out := []string{}
+	seen := map[string]struct{}{}
+	var walk func(n node)
+	walk = func(n node) {
+		switch v := n.(type) {
+		case *varNode:
+			if _, ok := seen[v.name]; !ok {
+				seen[v.name] = struct{}{}
+				out = append(out, v.name)
+			}
+		case *notNode:
+			walk(v.x)
+		case *binNode:
+			walk(v.l)
+			walk(v.r)
+		}
+	}
+	walk(e.root)
+	return out
+}
+
+// Eval evaluates the expression to a boolean, looking up variables with lookup
+func (e *Expr) Eval(lookup LookupFunc) (bool, error) {
+	v, err := e.root.eval(lookup)
+	if err != nil {
+		return false, err
+	}
+	return v.boolean()
+}
+
+// Eval parses and evaluates the expression s
+func Eval(s string, lookup LookupFunc) (bool, error) {
+	e, err := Parse(s)
+	if err != nil {
+		return false, err
+	}
+	return e.Eval(lookup)
+}
+
+// MapLookup returns a LookupFunc for a map of variables
+func MapLookup(vars map[string]string) LookupFunc {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+// value is either a boolean (the result of an operator) or a string (a variable or literal)
+type value struct {
+	isBool bool
+	b      bool
+	s      string
+}
+
+func (v value) boolean() (bool, error) {
+	if v.isBool {
+		return v.b, nil
+	}
+	switch strings.ToLower(v.s) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("not a boolean: %q", v.s)
+}
+
+func (v value) String() string {
+	if v.isBool {
+		return fmt.Sprintf("%v", v.b)
+	}
+	return v.s
+}
+
+type node interface {
+	eval(LookupFunc) (value, error)
+}
+
+type varNode struct {
+	name string
+}
+
+func (n *varNode) eval(lookup LookupFunc) (value, error) {
+	v, ok := lookup(n.name)
+	if !ok {
+		return value{}, fmt.Errorf("undefined variable: %v", n.name)
+	}
+	return value{s: v}, nil
+}
+
+type litNode struct {
+	v value
+}
+
+func (n *litNode) eval(LookupFunc) (value, error) {
+	return n.v, nil
+}
+
+type notNode struct {
+	x node
+}
+
+func (n *notNode) eval(lookup LookupFunc) (value, error) {
+	v, err := n.x.eval(lookup)
+	if err != nil {
+		return value{}, err
+	}
+	b, err := v.boolean()
+	if err != nil {
+		return value{}, err
+	}
+	return value{isBool: true, b: !b}, nil
+}
+
+type binNode struct {
+	op   string
+	l, r node
+}
+
+func (n *binNode) eval(lookup LookupFunc) (value, error) {
+	l, err := n.l.eval(lookup)
+	if err != nil {
+		return value{}, err
+	}
+	switch n.op {
+	case "&&", "||":
+		lb, err := l.boolean()
+		if err != nil {
+			return value{}, err
+		}
+		// short circuit
+		if (n.op == "&&" && !lb) || (n.op == "||" && lb) {
+			return value{isBool: true, b: lb}, nil
+		}
+		r, err := n.r.eval(lookup)
+		if err != nil {
+			return value{}, err
+		}
+		rb, err := r.boolean()
+		if err != nil {
+			return value{}, err
+		}
+		return value{isBool: true, b: rb}, nil
+	}
+	r, err := n.r.eval(lookup)
+	if err != nil {
+		return value{}, err
+	}
+	eq := l.String() == r.String()
+	if l.isBool || r.isBool {
+		// compare as booleans, so that (yes == true) holds
+		lb, err := l.boolean()
+		if err != nil {
+			return value{}, err
+		}
+		rb, err := r.boolean()
+		if err != nil {
+			return value{}, err
+		}
+		eq = lb == rb
+	}
+	if n.op == "!=" {
+		eq = !eq
+	}
+	return value{isBool: true, b: eq}, nil
+}
+
+// token kinds
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind int
+	s    string
+	pos  int
+}
+
+func lex(s string) ([]token, error) {
+	toks := []token{}
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != r {
+				j++
+			}
+			if j == len(rs) {
+				return nil, fmt.Errorf("unterminated string at position %v", i+1)
+			}
+			toks = append(toks, token{kind: tokString, s: string(rs[i+1 : j]), pos: i + 1})
+			i = j + 1
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_' || rs[j] == '-' || rs[j] == '.') {
+				j++
+			}
+			toks = append(toks, token{kind: tokIdent, s: string(rs[i:j]), pos: i + 1})
+			i = j
+		default:
+			var op string
+			for _, o := range []string{"&&", "||", "==", "!=", "!", "(", ")"} {
+				if strings.HasPrefix(string(rs[i:]), o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %v", r, i+1)
+			}
+			toks = append(toks, token{kind: tokOp, s: op, pos: i + 1})
+			i += len([]rune(op))
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(rs) + 1}), nil
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) isOp(s string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.s == s
+}
+
+// Parse parses the expression s
+func Parse(s string) (*Expr, error) {
+	toks, err := lex(s)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing expression %q: %w", s, err)
+	}
+	p := &parser{toks: toks}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokEOF {
+		err = fmt.Errorf("unexpected %q at position %v", p.peek().s, p.peek().pos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing expression %q: %w", s, err)
+	}
+	return &Expr{src: s, root: root}, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &binNode{op: "||", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &binNode{op: "&&", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.isOp("!") {
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x: x}, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *parser) parseCmp() (node, error) {
+	l, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("==") || p.isOp("!=") {
+		op := p.next().s
+		r, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &binNode{op: op, l: l, r: r}, nil
+	}
+	return l, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return &litNode{v: value{s: t.s}}, nil
+	case tokIdent:
+		switch t.s {
+		case "true":
+			return &litNode{v: value{isBool: true, b: true}}, nil
+		case "false":
+			return &litNode{v: value{isBool: true, b: false}}, nil
+		}
+		if unicode.IsDigit([]rune(t.s)[0]) {
+			return &litNode{v: value{s: t.s}}, nil
+		}
+		return &varNode{name: t.s}, nil
+	case tokOp:
+		if t.s == "(" {
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.isOp(")") {
+				return nil, fmt.Errorf("expected ) at position %v", p.peek().pos)
+			}
+			p.next()
+			return x, nil
+		}
+		return nil, fmt.Errorf("unexpected %q at position %v", t.s, t.pos)
+	}
+	return nil, fmt.Errorf("unexpected end of expression")
+}
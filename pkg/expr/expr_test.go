@@ -0,0 +1,78 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	vars := map[string]string{
+		"env":      "production",
+		"region":   "eu-west-1",
+		"cache":    "true",
+		"debug":    "no",
+		"replicas": "3",
+		"empty":    "",
+	}
+	cases := []struct {
+		name, input string
+		output      bool
+		errstr      string
+	}{
+		{"literal true", "true", true, ""},
+		{"literal false", "false", false, ""},
+		{"variable", "cache", true, ""},
+		{"variable false", "debug", false, ""},
+		{"negation", "!debug", true, ""},
+		{"double negation", "!!cache", true, ""},
+		{"equality", `env == "production"`, true, ""},
+		{"single quotes", `env == 'staging'`, false, ""},
+		{"inequality", `region != "us-east-1"`, true, ""},
+		{"number", "replicas == 3", true, ""},
+		{"bool comparison", "debug == false", true, ""},
+		{"and", `env == "production" && cache`, true, ""},
+		{"or", `debug || env == "staging"`, false, ""},
+		{"precedence", `debug && cache || true`, true, ""},
+		{"parens", `debug && (cache || true)`, false, ""},
+		{"short circuit", `debug && undefined`, false, ""},
+		{"empty string", `empty == ""`, true, ""},
+		{"undefined", "undefined", false, "undefined variable: undefined"},
+		{"not a boolean", "env", false, "not a boolean"},
+		{"unterminated", `env == "prod`, false, "unterminated string"},
+		{"trailing", "cache cache", false, "unexpected"},
+		{"unbalanced", "(cache", false, "expected )"},
+		{"bad character", "cache & debug", false, "unexpected character"},
+		{"empty", "", false, "unexpected end"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, err := Eval(c.input, MapLookup(vars))
+			if err != nil {
+				if c.errstr == "" {
+					t.Fatalf("should have succeeded: %v", err)
+				}
+				if !strings.Contains(err.Error(), c.errstr) {
+					t.Fatalf("error %q should have contained %q", err, c.errstr)
+				}
+				return
+			}
+			if c.errstr != "" {
+				t.Fatalf("should have failed with %q", c.errstr)
+			}
+			if out != c.output {
+				t.Fatalf("bad output: %v (wanted %v)", out, c.output)
+			}
+		})
+	}
+}
+
+func TestVars(t *testing.T) {
+	e, err := Parse(`env == "production" && (!debug || env != region)`)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if vars := e.Vars(); !reflect.DeepEqual(vars, []string{"env", "debug", "region"}) {
+		t.Fatalf("bad vars: %v", vars)
+	}
+}
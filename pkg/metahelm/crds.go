@@ -0,0 +1,100 @@
+package metahelm
+
+import (
+	"context"
+	"time"
+
+	"github.com/graphext/metahelm/pkg/manifest"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+const crdKind = "CustomResourceDefinition"
+
+// releaseCRDs returns the names of the CustomResourceDefinitions of a release: those rendered from the chart templates and those in the crds/ directory
+// of the chart (and its subcharts). If skipCRDDir is set (Helm skipped the crds/ directory), only those rendered from the templates are returned.
+func releaseCRDs(rel *release.Release, skipCRDDir bool) []string {
+	if rel == nil {
+		return nil
+	}
+	names := crdNames(rel.Manifest)
+	if rel.Chart != nil && !skipCRDDir {
+		for _, crd := range rel.Chart.CRDObjects() {
+			if crd.File != nil {
+				names = append(names, crdNames(string(crd.File.Data))...)
+			}
+		}
+	}
+	out := []string{}
+	seen := map[string]struct{}{}
+	for _, n := range names {
+		if _, ok := seen[n]; !ok {
+			seen[n] = struct{}{}
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// crdNames returns the names of the CustomResourceDefinitions in a YAML stream
+func crdNames(docs string) []string {
+	names := []string{}
+	for _, doc := range releaseutil.SplitManifests(docs) {
+		km := manifest.K8sManifest{}
+		if err := yaml.Unmarshal([]byte(doc), &km); err != nil {
+			continue
+		}
+		if km.Kind == crdKind && km.Metadata.Name != "" {
+			names = append(names, km.Metadata.Name)
+		}
+	}
+	return names
+}
+
+// waitForCRDs waits for the CustomResourceDefinitions with names to be Established and then refreshes the discovery and REST mapper caches,
+// so that custom resources of the new kinds can be created by dependents. If no dynamic client is available, the wait is skipped.
+func (m *Manager) waitForCRDs(ctx context.Context, title string, names []string, timeout time.Duration) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if _, _, err := m.dynamicClient(); err != nil {
+		m.log("%v: cannot wait for CRDs (%v); skipping", title, err)
+		return nil
+	}
+	for _, n := range names {
+		wr := &WaitForResource{
+			Title:        title,
+			APIVersion:   "apiextensions.k8s.io/v1",
+			Kind:         crdKind,
+			ResourceName: n,
+			Condition:    "Established",
+			WaitTimeout:  timeout,
+		}
+		if err := wr.Run(ctx, m, ""); err != nil {
+			return errors.Wrap(err, "error waiting for CRD")
+		}
+	}
+	m.refreshDiscovery()
+	return nil
+}
+
+// refreshDiscovery invalidates the cached API discovery information and resets the REST mappers of the Manager and the Helm configuration
+func (m *Manager) refreshDiscovery() {
+	mappers := []meta.RESTMapper{m.RESTMapper}
+	if m.HCfg != nil && m.HCfg.RESTClientGetter != nil {
+		if dc, err := m.HCfg.RESTClientGetter.ToDiscoveryClient(); err == nil && dc != nil {
+			dc.Invalidate()
+		}
+		if rm, err := m.HCfg.RESTClientGetter.ToRESTMapper(); err == nil {
+			mappers = append(mappers, rm)
+		}
+	}
+	for _, rm := range mappers {
+		if rrm, ok := rm.(meta.ResettableRESTMapper); ok {
+			rrm.Reset()
+		}
+	}
+}
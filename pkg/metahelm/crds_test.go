@@ -0,0 +1,137 @@
+package metahelm
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynfake "k8s.io/client-go/dynamic/fake"
+)
+
+// resetCountingMapper is a REST mapper that counts resets
+type resetCountingMapper struct {
+	meta.RESTMapper
+	resets int
+}
+
+func (rcm *resetCountingMapper) Reset() {
+	rcm.resets++
+}
+
+func TestCRDNames(t *testing.T) {
+	docs := `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+data:
+  kind: CustomResourceDefinition
+---
+# comment only
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: bars.example.com
+`
+	names := crdNames(docs)
+	if !reflect.DeepEqual(names, []string{"foos.example.com", "bars.example.com"}) && !reflect.DeepEqual(names, []string{"bars.example.com", "foos.example.com"}) {
+		t.Fatalf("bad names: %v", names)
+	}
+}
+
+func TestGraphInstallWaitsForCRDs(t *testing.T) {
+	charts := []Chart{
+		Chart{
+			Title:                      "operator",
+			Location:                   "testdata/crdchart",
+			DeploymentHealthIndication: IgnorePodHealth,
+			WaitTimeout:                2 * time.Second,
+		},
+	}
+	cases := []struct {
+		name             string
+		widgets, gadgets bool
+		isErr            bool
+	}{
+		{"established", true, true, false},
+		{"crds directory not established", false, true, true},
+		{"template not established", true, false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dc := dynfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{crdGVR: "CustomResourceDefinitionList"},
+				testCRD("widgets.example.com", c.widgets), testCRD("gadgets.example.com", c.gadgets))
+			rm := &resetCountingMapper{RESTMapper: testRESTMapper()}
+			m := Manager{
+				LogF:       t.Logf,
+				K8c:        fakeKubernetesClientset(t, DefaultK8sNamespace, charts),
+				HCfg:       fakeHelmConfiguration(t),
+				Dynamic:    dc,
+				RESTMapper: rm,
+			}
+			ChartWaitPollInterval = 1 * time.Second
+			_, err := m.Install(context.Background(), charts)
+			if err != nil && !c.isErr {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+			if err == nil && c.isErr {
+				t.Fatalf("should have failed")
+			}
+			if !c.isErr && rm.resets == 0 {
+				t.Fatalf("REST mapper should have been reset")
+			}
+		})
+	}
+}
+
+func TestGraphInstallSkipCRDs(t *testing.T) {
+	charts := []Chart{
+		Chart{
+			Title:                      "operator",
+			Location:                   "testdata/crdchart",
+			DeploymentHealthIndication: IgnorePodHealth,
+			WaitTimeout:                2 * time.Second,
+			Helm:                       &HelmOptions{SkipCRDs: true},
+		},
+	}
+	// the CRD in the crds/ directory isn't created by Helm and must not be waited for
+	dc := dynfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{crdGVR: "CustomResourceDefinitionList"},
+		testCRD("gadgets.example.com", true))
+	m := Manager{
+		LogF:       t.Logf,
+		K8c:        fakeKubernetesClientset(t, DefaultK8sNamespace, charts),
+		HCfg:       fakeHelmConfiguration(t),
+		Dynamic:    dc,
+		RESTMapper: &resetCountingMapper{RESTMapper: testRESTMapper()},
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	if _, err := m.Install(context.Background(), charts); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	// graph-level defaults apply as well
+	charts[0].Helm = nil
+	m.HCfg = fakeHelmConfiguration(t)
+	if _, err := m.Install(context.Background(), charts, WithHelmDefaults(HelmOptions{SkipCRDs: true})); err != nil {
+		t.Fatalf("should have succeeded with defaults: %v", err)
+	}
+}
+
+func TestReleaseCRDsWithoutDynamicClient(t *testing.T) {
+	m := Manager{
+		LogF: t.Logf,
+		HCfg: fakeHelmConfiguration(t),
+	}
+	// no dynamic client available: waiting is skipped
+	if err := m.waitForCRDs(context.Background(), "foo", []string{"foos.example.com"}, time.Second); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// Event models a Kubernetes event related to a failed object
+type Event struct {
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	Count   int32  `json:"count"`
+	// LastSeen is the most recent time the event occurred
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// MaxEvents is the maximum number of (most recent) events to return for each failed object
+var MaxEvents = 25
+
+// getevents returns the most recent events for the object of kind with name, in chronological order
+func getevents(ctx context.Context, namespace, kind, name string, kc K8sClient) ([]Event, error) {
+	fs := fields.Set{"involvedObject.kind": kind, "involvedObject.name": name}
+	el, err := kc.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{FieldSelector: fs.String()})
+	if err != nil || el == nil {
+		return nil, errors.Wrapf(err, "error listing events for %v/%v", kind, name)
+	}
+	events := []Event{}
+	for _, e := range el.Items {
+		// not all clients honor field selectors
+		if e.InvolvedObject.Kind != kind || e.InvolvedObject.Name != name {
+			continue
+		}
+		last := e.LastTimestamp.Time
+		if last.IsZero() {
+			last = e.EventTime.Time
+		}
+		events = append(events, Event{Type: e.Type, Reason: e.Reason, Message: e.Message, Count: e.Count, LastSeen: last})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].LastSeen.Before(events[j].LastSeen) })
+	if len(events) > MaxEvents {
+		events = events[len(events)-MaxEvents:]
+	}
+	return events, nil
+}
+
+// populateEvents adds the events for the object of kind with name to ce, as well as those of the controllers (owners) of the failed pods
+func (ce ChartError) populateEvents(ctx context.Context, namespace, kind, name string, pods []corev1.Pod, failedpods []FailedPod, kc K8sClient) {
+	failed := map[string]struct{}{}
+	for _, fp := range failedpods {
+		failed[fp.Name] = struct{}{}
+	}
+	objs := [][2]string{{kind, name}}
+	for _, p := range pods {
+		if _, ok := failed[p.Name]; !ok {
+			continue
+		}
+		if ref := metav1.GetControllerOf(&p); ref != nil && !(ref.Kind == kind && ref.Name == name) {
+			objs = append(objs, [2]string{ref.Kind, ref.Name})
+		}
+	}
+	for _, o := range objs {
+		key := o[0] + "/" + o[1]
+		if _, ok := ce.Events[key]; ok {
+			continue
+		}
+		events, err := getevents(ctx, namespace, o[0], o[1], kc)
+		if err != nil {
+			events = []Event{{Type: corev1.EventTypeWarning, Reason: "MetahelmError", Message: err.Error()}}
+		}
+		if len(events) > 0 {
+			ce.Events[key] = events
+		}
+	}
+}
+
+// image pull waiting reasons
+var imagePullReasons = map[string]struct{}{
+	"ErrImagePull":      {},
+	"ImagePullBackOff":  {},
+	"InvalidImageName":  {},
+	"ErrImageNeverPull": {},
+}
+
+// summarizePod returns a short human-readable explanation of why pod is failing
+func summarizePod(pod corev1.Pod, events []Event) string {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse {
+			msg := cond.Message
+			for i := len(events) - 1; msg == "" && i >= 0; i-- {
+				if events[i].Reason == "FailedScheduling" {
+					msg = events[i].Message
+				}
+			}
+			return "unschedulable: " + summarizeScheduling(msg)
+		}
+	}
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, cs := range statuses {
+		if w := cs.State.Waiting; w != nil {
+			if _, ok := imagePullReasons[w.Reason]; ok {
+				return fmt.Sprintf("image pull failed: container %v: %v", cs.Name, strings.TrimSpace(w.Reason+": "+w.Message))
+			}
+			switch w.Reason {
+			case "CrashLoopBackOff":
+				s := fmt.Sprintf("crash loop: container %v restarted %v times", cs.Name, cs.RestartCount)
+				if t := cs.LastTerminationState.Terminated; t != nil {
+					s += fmt.Sprintf(", last exit code %v", t.ExitCode)
+					if t.Reason != "" {
+						s += " (" + t.Reason + ")"
+					}
+				}
+				return s
+			case "CreateContainerConfigError", "CreateContainerError", "RunContainerError":
+				return fmt.Sprintf("container %v could not be started: %v", cs.Name, strings.TrimSpace(w.Reason+": "+w.Message))
+			}
+		}
+		if t := cs.State.Terminated; t != nil && t.ExitCode != 0 {
+			s := fmt.Sprintf("container %v terminated with exit code %v", cs.Name, t.ExitCode)
+			if t.Reason != "" {
+				s += " (" + t.Reason + ")"
+			}
+			return s
+		}
+	}
+	if pod.Status.Reason != "" {
+		return strings.TrimSpace(pod.Status.Reason + ": " + pod.Status.Message)
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Running != nil && !cs.Ready {
+			s := fmt.Sprintf("container %v not ready", cs.Name)
+			for i := len(events) - 1; i >= 0; i-- {
+				if events[i].Reason == "Unhealthy" {
+					return s + ": " + events[i].Message
+				}
+			}
+			return s
+		}
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Type == corev1.EventTypeWarning {
+			return events[i].Reason + ": " + events[i].Message
+		}
+	}
+	return strings.ToLower(string(pod.Status.Phase))
+}
+
+// summarizeScheduling reduces a scheduler message like "0/3 nodes are available: 1 node(s) had taint {foo: bar}, 2 Insufficient cpu."
+// to its distinct reasons ("node(s) had taint {foo: bar}, insufficient cpu")
+func summarizeScheduling(msg string) string {
+	if msg == "" {
+		return "unknown reason"
+	}
+	if i := strings.Index(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	// drop trailing scheduler hints such as "preemption: 0/3 nodes are available: ..."
+	if i := strings.Index(msg, " preemption:"); i >= 0 {
+		msg = msg[:i]
+	}
+	reasons := []string{}
+	seen := map[string]struct{}{}
+	for _, r := range strings.Split(strings.TrimRight(strings.TrimSpace(msg), "."), ", ") {
+		r = strings.TrimSpace(r)
+		// strip the node count
+		if i := strings.Index(r, " "); i > 0 && strings.Trim(r[:i], "0123456789") == "" {
+			r = r[i+1:]
+		}
+		if r == "" {
+			continue
+		}
+		r = strings.TrimRight(strings.ToLower(r[:1])+r[1:], ".")
+		if _, ok := seen[r]; ok {
+			continue
+		}
+		seen[r] = struct{}{}
+		reasons = append(reasons, r)
+	}
+	return strings.Join(reasons, ", ")
+}
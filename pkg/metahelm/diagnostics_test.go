@@ -0,0 +1,160 @@
+package metahelm
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSummarizeScheduling(t *testing.T) {
+	cases := []struct {
+		name, input, output string
+	}{
+		{"empty", "", "unknown reason"},
+		{"cpu", "0/3 nodes are available: 3 Insufficient cpu.", "insufficient cpu"},
+		{"multiple", "0/5 nodes are available: 2 Insufficient memory, 3 Insufficient cpu.", "insufficient memory, insufficient cpu"},
+		{"preemption", "0/3 nodes are available: 3 Insufficient cpu. preemption: 0/3 nodes are available: 3 No preemption victims found for incoming pod..", "insufficient cpu"},
+		{"duplicate", "0/2 nodes are available: 1 Insufficient cpu, 1 Insufficient cpu.", "insufficient cpu"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if out := summarizeScheduling(c.input); out != c.output {
+				t.Fatalf("bad output: %q (wanted %q)", out, c.output)
+			}
+		})
+	}
+}
+
+func TestSummarizePod(t *testing.T) {
+	cases := []struct {
+		name   string
+		status corev1.PodStatus
+		events []Event
+		output string
+	}{
+		{
+			name: "image pull",
+			status: corev1.PodStatus{
+				Phase: corev1.PodPending,
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "foo", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image \"foo:bar\""}}},
+				},
+			},
+			output: "image pull failed: container foo: ImagePullBackOff: Back-off pulling image \"foo:bar\"",
+		},
+		{
+			name: "unschedulable",
+			status: corev1.PodStatus{
+				Phase: corev1.PodPending,
+				Conditions: []corev1.PodCondition{
+					{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: "Unschedulable"},
+				},
+			},
+			events: []Event{{Type: corev1.EventTypeWarning, Reason: "FailedScheduling", Message: "0/3 nodes are available: 3 Insufficient cpu."}},
+			output: "unschedulable: insufficient cpu",
+		},
+		{
+			name: "crash loop init container",
+			status: corev1.PodStatus{
+				Phase: corev1.PodPending,
+				InitContainerStatuses: []corev1.ContainerStatus{
+					{
+						Name:                 "migrate",
+						RestartCount:         4,
+						State:                corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+						LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"}},
+					},
+				},
+			},
+			output: "crash loop: container migrate restarted 4 times, last exit code 1 (Error)",
+		},
+		{
+			name: "not ready",
+			status: corev1.PodStatus{
+				Phase: corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "foo", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+				},
+			},
+			events: []Event{{Type: corev1.EventTypeWarning, Reason: "Unhealthy", Message: "Readiness probe failed: connection refused"}},
+			output: "container foo not ready: Readiness probe failed: connection refused",
+		},
+		{
+			name: "evicted",
+			status: corev1.PodStatus{
+				Phase:   corev1.PodFailed,
+				Reason:  "Evicted",
+				Message: "The node was low on resource: memory.",
+			},
+			output: "Evicted: The node was low on resource: memory.",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if out := summarizePod(corev1.Pod{Status: c.status}, c.events); out != c.output {
+				t.Fatalf("bad output: %q (wanted %q)", out, c.output)
+			}
+		})
+	}
+}
+
+func TestFailedPodDiagnostics(t *testing.T) {
+	p := &corev1.Pod{}
+	p.Name = "foo-1234"
+	p.Namespace = DefaultK8sNamespace
+	p.Status = corev1.PodStatus{
+		Phase: corev1.PodPending,
+		Conditions: []corev1.PodCondition{
+			{Type: corev1.PodScheduled, Status: corev1.ConditionTrue},
+		},
+		InitContainerStatuses: []corev1.ContainerStatus{
+			{
+				Name:                 "migrate",
+				RestartCount:         2,
+				State:                corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+				LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}},
+			},
+			{
+				Name:  "setup",
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}},
+			},
+		},
+		ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "foo", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "PodInitializing"}}},
+		},
+	}
+	e := &corev1.Event{}
+	e.Name = "foo-1234.1"
+	e.Namespace = DefaultK8sNamespace
+	e.InvolvedObject = corev1.ObjectReference{Kind: "Pod", Name: "foo-1234", Namespace: DefaultK8sNamespace}
+	e.Type = corev1.EventTypeWarning
+	e.Reason = "BackOff"
+	e.Message = "Back-off restarting failed container"
+	e.LastTimestamp = metav1.Now()
+	e2 := e.DeepCopy()
+	e2.Name = "other.1"
+	e2.InvolvedObject.Name = "other"
+	kc := fake.NewSimpleClientset(p, e, e2)
+	failed, fp := failedpod(context.Background(), *p, 100, kc)
+	if !failed {
+		t.Fatalf("pod should have failed")
+	}
+	if len(fp.InitContainerStatuses) != 2 {
+		t.Fatalf("bad init container statuses length: %v", len(fp.InitContainerStatuses))
+	}
+	if _, ok := fp.PreviousLogs["migrate"]; !ok {
+		t.Fatalf("previous logs for init container missing: %v", fp.PreviousLogs)
+	}
+	if _, ok := fp.Logs["setup"]; ok {
+		t.Fatalf("logs for successful init container should be omitted")
+	}
+	if len(fp.Events) != 1 || fp.Events[0].Reason != "BackOff" {
+		t.Fatalf("bad events: %+v", fp.Events)
+	}
+	if fp.Summary != "crash loop: container migrate restarted 2 times, last exit code 1" {
+		t.Fatalf("bad summary: %v", fp.Summary)
+	}
+}
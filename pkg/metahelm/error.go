@@ -4,30 +4,39 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
-	"strings"
 
 	"github.com/graphext/metahelm/pkg/manifest"
 	"github.com/pkg/errors"
 	"helm.sh/helm/v3/pkg/release"
 	"helm.sh/helm/v3/pkg/releaseutil"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // FailedPod models a single failed pod with metadata and logs
 type FailedPod struct {
-	Name              string                   `json:"name"`
-	Phase             string                   `json:"phase"`
-	Message           string                   `json:"message"`
-	Reason            string                   `json:"reason"`
-	Conditions        []corev1.PodCondition    `json:"conditions"`
-	ContainerStatuses []corev1.ContainerStatus `json:"container_statuses"`
-	// Logs is a map of container name to raw log (stdout/stderr) output
+	Name                  string                   `json:"name"`
+	Phase                 string                   `json:"phase"`
+	Message               string                   `json:"message"`
+	Reason                string                   `json:"reason"`
+	Conditions            []corev1.PodCondition    `json:"conditions"`
+	ContainerStatuses     []corev1.ContainerStatus `json:"container_statuses"`
+	InitContainerStatuses []corev1.ContainerStatus `json:"init_container_statuses"`
+	// Logs is a map of container name (including init containers) to raw log (stdout/stderr) output
 	Logs map[string][]byte `json:"logs"`
+	// PreviousLogs is a map of container name (including init containers) to raw log output of the previous terminated instance of the container
+	PreviousLogs map[string][]byte `json:"previous_logs"`
+	// Events are the Kubernetes events for the pod
+	Events []Event `json:"events"`
+	// Summary is a human-readable explanation of why the pod is failing (eg, "image pull failed", "unschedulable: insufficient cpu")
+	Summary string `json:"summary"`
 }
 
-// ChartError is a chart install/upgrade error due to failing Kubernetes resources. It contains all Deployment, Job or DaemonSet-related pods that appear to
-// be in a failed state, including up to MaxPodLogLines of log data for each.
+// ChartError is a chart install/upgrade error due to failing Kubernetes resources. It contains all Deployment, StatefulSet, DaemonSet, ReplicaSet, Job or
+// CronJob-related pods that appear to be in a failed state, including up to MaxPodLogLines of log data for each.
 type ChartError struct {
 	// HelmError is the original error returned by Helm
 	// We always omit this value when json marshaling/unmarshaling since we would otherwise have to implement the UnmarshalJSON and MarshalJSON methods.
@@ -42,6 +51,16 @@ type ChartError struct {
 	FailedDeployments map[string][]FailedPod `json:"failed_deployments"`
 	// FailedJobs is map of Job name to failed pods
 	FailedJobs map[string][]FailedPod `json:"failed_jobs"`
+	// FailedStatefulSets is map of StatefulSet name to failed pods
+	FailedStatefulSets map[string][]FailedPod `json:"failed_stateful_sets"`
+	// FailedReplicaSets is map of ReplicaSet name to failed pods (only for ReplicaSets that are part of the release, not those owned by Deployments)
+	FailedReplicaSets map[string][]FailedPod `json:"failed_replica_sets"`
+	// FailedCronJobs is map of CronJob name to failed pods of the Jobs it created
+	FailedCronJobs map[string][]FailedPod `json:"failed_cron_jobs"`
+	// FailedTests is a map of Helm test hook name to the failed test pod (only populated if the chart Helm tests were run and failed)
+	FailedTests map[string][]FailedPod `json:"failed_tests"`
+	// Events is a map of "Kind/name" to the Kubernetes events of the owner objects (Deployments, ReplicaSets, Jobs, etc) of failed pods
+	Events map[string][]Event `json:"events"`
 }
 
 // NewChartError returns an initialized empty ChartError
@@ -51,75 +70,72 @@ func NewChartError(err error) ChartError {
 		errorString = err.Error()
 	}
 	return ChartError{
-		HelmError:         err,
-		HelmErrorString:   errorString,
-		FailedDaemonSets:  make(map[string][]FailedPod),
-		FailedDeployments: make(map[string][]FailedPod),
-		FailedJobs:        make(map[string][]FailedPod),
+		HelmError:          err,
+		HelmErrorString:    errorString,
+		FailedDaemonSets:   make(map[string][]FailedPod),
+		FailedDeployments:  make(map[string][]FailedPod),
+		FailedJobs:         make(map[string][]FailedPod),
+		FailedStatefulSets: make(map[string][]FailedPod),
+		FailedReplicaSets:  make(map[string][]FailedPod),
+		FailedCronJobs:     make(map[string][]FailedPod),
+		FailedTests:        make(map[string][]FailedPod),
+		Events:             make(map[string][]Event),
 	}
 }
 
 // Error satisfies the error interface
 func (ce ChartError) Error() string {
-	return errors.Wrap(fmt.Errorf("error executing level %v: failed resources (deployments: %v; jobs: %v; daemonsets: %v)", ce.Level, len(ce.FailedDeployments), len(ce.FailedJobs), len(ce.FailedDaemonSets)), ce.HelmErrorString).Error()
+	return errors.Wrap(fmt.Errorf("error executing level %v: failed resources (deployments: %v; statefulsets: %v; daemonsets: %v; replicasets: %v; jobs: %v; cronjobs: %v; tests: %v)",
+		ce.Level, len(ce.FailedDeployments), len(ce.FailedStatefulSets), len(ce.FailedDaemonSets), len(ce.FailedReplicaSets), len(ce.FailedJobs), len(ce.FailedCronJobs), len(ce.FailedTests)), ce.HelmErrorString).Error()
 }
 
-// PopulateFromRelease finds the failed Jobs and Pods for a given release and fills ChartError with names and logs of the failed resources
+// failedMap returns the map of failed pods for objects of kind, or nil if kind is not a workload kind
+func (ce ChartError) failedMap(kind string) map[string][]FailedPod {
+	switch kind {
+	case "Deployment":
+		return ce.FailedDeployments
+	case "StatefulSet":
+		return ce.FailedStatefulSets
+	case "DaemonSet":
+		return ce.FailedDaemonSets
+	case "ReplicaSet":
+		return ce.FailedReplicaSets
+	case "Job":
+		return ce.FailedJobs
+	case "CronJob":
+		return ce.FailedCronJobs
+	}
+	return nil
+}
+
+// PopulateFromRelease finds the failed workloads and pods for a given release and fills ChartError with names and logs of the failed resources
 func (ce ChartError) PopulateFromRelease(ctx context.Context, rls *release.Release, kc K8sClient, maxloglines uint) error {
 	if rls == nil {
 		return errors.New("release is nil")
 	}
+	objs := [][2]string{}
 	for _, m := range manifest.SplitManifests(releaseutil.SplitManifests(rls.Manifest)) {
-		ml := map[string]string{}
-		failedpods := []FailedPod{}
-		switch m.Head.Kind {
-		case "Deployment":
-			d, err := kc.AppsV1().Deployments(rls.Namespace).Get(ctx, m.Head.Metadata.Name, metav1.GetOptions{})
-			if err != nil || d.Spec.Replicas == nil || d == nil {
-				return errors.Wrap(err, "error getting deployment")
-			}
-			ml = d.Spec.Selector.MatchLabels
-		case "Job":
-			j, err := kc.BatchV1().Jobs(rls.Namespace).Get(ctx, m.Head.Metadata.Name, metav1.GetOptions{})
-			if err != nil {
-				return errors.Wrap(err, "error getting job")
-			}
-			ml = j.Spec.Selector.MatchLabels
-		case "DaemonSet":
-			ds, err := kc.AppsV1().DaemonSets(rls.Namespace).Get(ctx, m.Head.Metadata.Name, metav1.GetOptions{})
-			if err != nil {
-				return errors.Wrap(err, "error getting daemonset")
-			}
-			ml = ds.Spec.Selector.MatchLabels
-		default:
+		objs = append(objs, [2]string{m.Head.Kind, m.Head.Metadata.Name})
+	}
+	return ce.populateFromWorkloads(ctx, rls.Namespace, objs, kc, maxloglines)
+}
+
+// populateFromWorkloads fills ChartError with the failed pods of the workload objects in namespace (pairs of kind and name). Objects that are not workloads are ignored.
+func (ce ChartError) populateFromWorkloads(ctx context.Context, namespace string, objs [][2]string, kc K8sClient, maxloglines uint) error {
+	pr := newPodResolver(namespace, kc)
+	for _, o := range objs {
+		fm := ce.failedMap(o[0])
+		if fm == nil {
 			// we don't care about any other resource types
 			continue
 		}
-		if len(ml) == 0 {
-			continue
-		}
-		ss := []string{}
-		for k, v := range ml {
-			ss = append(ss, fmt.Sprintf("%v = %v", k, v))
-		}
-		pl, err := kc.CoreV1().Pods(rls.Namespace).List(ctx, metav1.ListOptions{LabelSelector: strings.Join(ss, ",")})
-		if err != nil || pl == nil {
-			return errors.Wrapf(err, "error listing pods for selector: %v", ss)
-		}
-		for _, pod := range pl.Items {
-			if failed, fp := failedpod(ctx, pod, maxloglines, kc); failed {
-				failedpods = append(failedpods, fp)
-			}
+		pods, failedpods, err := pr.failedPods(ctx, o[0], o[1], maxloglines)
+		if err != nil {
+			return err
 		}
 		if len(failedpods) > 0 {
-			switch m.Head.Kind {
-			case "Deployment":
-				ce.FailedDeployments[m.Head.Metadata.Name] = failedpods
-			case "Job":
-				ce.FailedJobs[m.Head.Metadata.Name] = failedpods
-			case "DaemonSet":
-				ce.FailedDaemonSets[m.Head.Metadata.Name] = failedpods
-			}
+			ce.populateEvents(ctx, namespace, o[0], o[1], pods, failedpods, kc)
+			fm[o[1]] = failedpods
 		}
 	}
 	return nil
@@ -127,26 +143,236 @@ func (ce ChartError) PopulateFromRelease(ctx context.Context, rls *release.Relea
 
 // PopulateFromDeployment finds the failed pods for a deployment and fills ChartError with names and logs of the failed pods
 func (ce ChartError) PopulateFromDeployment(ctx context.Context, namespace, deploymentName string, kc K8sClient, maxloglines uint) error {
-	d, err := kc.AppsV1().Deployments(namespace).Get(ctx, deploymentName, metav1.GetOptions{})
-	if err != nil || d.Spec.Replicas == nil || d == nil {
-		return errors.Wrap(err, "error getting deployment")
+	pods, failedpods, err := newPodResolver(namespace, kc).failedPods(ctx, "Deployment", deploymentName, maxloglines)
+	if err != nil {
+		return err
 	}
-	ss := []string{}
-	for k, v := range d.Spec.Selector.MatchLabels {
-		ss = append(ss, fmt.Sprintf("%v = %v", k, v))
+	ce.FailedDeployments[deploymentName] = failedpods
+	if len(failedpods) > 0 {
+		ce.populateEvents(ctx, namespace, "Deployment", deploymentName, pods, failedpods, kc)
 	}
-	pl, err := kc.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: strings.Join(ss, ",")})
-	if err != nil || pl == nil {
-		return errors.Wrapf(err, "error listing pods for selector: %v", ss)
+	return nil
+}
+
+// podResolver finds the pods belonging to workload objects within a namespace, by label selector and by owner references.
+// Pods, ReplicaSets and Jobs are listed with the label selector of the workload (or unscoped if it has none), at most once per selector.
+type podResolver struct {
+	namespace string
+	kc        K8sClient
+	pods      map[string][]corev1.Pod // by label selector ("" for all the pods in the namespace)
+	rsl       map[string][]appsv1.ReplicaSet
+	jobs      map[string][]batchv1.Job
+}
+
+func newPodResolver(namespace string, kc K8sClient) *podResolver {
+	return &podResolver{
+		namespace: namespace,
+		kc:        kc,
+		pods:      map[string][]corev1.Pod{},
+		rsl:       map[string][]appsv1.ReplicaSet{},
+		jobs:      map[string][]batchv1.Job{},
+	}
+}
+
+// failedPods returns the pods of the workload object of kind with name and those that appear to be in a failed state
+func (pr *podResolver) failedPods(ctx context.Context, kind, name string, maxloglines uint) ([]corev1.Pod, []FailedPod, error) {
+	pods, err := pr.workloadPods(ctx, kind, name)
+	if err != nil {
+		return nil, nil, err
 	}
 	failedpods := []FailedPod{}
-	for _, pod := range pl.Items {
-		if failed, fp := failedpod(ctx, pod, maxloglines, kc); failed {
+	for _, pod := range pods {
+		if failed, fp := failedpod(ctx, pod, maxloglines, pr.kc); failed {
 			failedpods = append(failedpods, fp)
 		}
 	}
-	ce.FailedDeployments[deploymentName] = failedpods
-	return nil
+	return pods, failedpods, nil
+}
+
+// workloadPods returns the pods matching the selector of the workload object of kind with name, or owned by it
+// (directly or via the ReplicaSets of a Deployment or the Jobs of a CronJob) if it has no selector
+func (pr *podResolver) workloadPods(ctx context.Context, kind, name string) ([]corev1.Pod, error) {
+	var selectors []*metav1.LabelSelector
+	owners := map[types.UID]struct{}{}
+	addOwner := func(uid types.UID) {
+		// an object without UID (eg, not created by the API server) would match the owner references of any other such object
+		if uid != "" {
+			owners[uid] = struct{}{}
+		}
+	}
+	switch kind {
+	case "Deployment":
+		d, err := pr.kc.AppsV1().Deployments(pr.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting deployment")
+		}
+		selectors = append(selectors, d.Spec.Selector)
+		addOwner(d.UID)
+		rsl, err := pr.listReplicaSets(ctx, d.Spec.Selector)
+		if err != nil {
+			return nil, err
+		}
+		for _, rs := range rsl {
+			if ownedBy(rs.OwnerReferences, d.UID) {
+				addOwner(rs.UID)
+			}
+		}
+	case "StatefulSet":
+		ss, err := pr.kc.AppsV1().StatefulSets(pr.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting statefulset")
+		}
+		selectors = append(selectors, ss.Spec.Selector)
+		addOwner(ss.UID)
+	case "DaemonSet":
+		ds, err := pr.kc.AppsV1().DaemonSets(pr.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting daemonset")
+		}
+		selectors = append(selectors, ds.Spec.Selector)
+		addOwner(ds.UID)
+	case "ReplicaSet":
+		rs, err := pr.kc.AppsV1().ReplicaSets(pr.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting replicaset")
+		}
+		selectors = append(selectors, rs.Spec.Selector)
+		addOwner(rs.UID)
+	case "Job":
+		j, err := pr.kc.BatchV1().Jobs(pr.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting job")
+		}
+		selectors = append(selectors, j.Spec.Selector)
+		addOwner(j.UID)
+	case "CronJob":
+		cj, err := pr.kc.BatchV1().CronJobs(pr.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting cronjob")
+		}
+		// the jobs of a cronjob have the labels of its job template
+		jobs, err := pr.listJobs(ctx, &metav1.LabelSelector{MatchLabels: cj.Spec.JobTemplate.Labels})
+		if err != nil {
+			return nil, err
+		}
+		for _, j := range jobs {
+			if ownedBy(j.OwnerReferences, cj.UID) {
+				selectors = append(selectors, j.Spec.Selector)
+				addOwner(j.UID)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported workload kind: %v", kind)
+	}
+	out := []corev1.Pod{}
+	seen := map[string]struct{}{}
+	add := func(pod corev1.Pod) {
+		if _, ok := seen[pod.Name]; !ok {
+			seen[pod.Name] = struct{}{}
+			out = append(out, pod)
+		}
+	}
+	// objects without selector (or a cronjob without jobs) are matched by owner references among all the pods
+	unselected := len(selectors) == 0
+	for _, ls := range selectors {
+		sel, err := selectorString(ls)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing selector for %v %v", kind, name)
+		}
+		if sel == "" {
+			unselected = true
+			continue
+		}
+		pods, err := pr.listPods(ctx, sel)
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range pods {
+			add(pod)
+		}
+	}
+	if unselected && len(owners) > 0 {
+		pods, err := pr.listPods(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range pods {
+			for _, ref := range pod.OwnerReferences {
+				if _, ok := owners[ref.UID]; ok {
+					add(pod)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// selectorString returns ls as a selector string for list options, or "" if it is nil or empty (it would match everything)
+func selectorString(ls *metav1.LabelSelector) (string, error) {
+	if ls == nil || (len(ls.MatchLabels) == 0 && len(ls.MatchExpressions) == 0) {
+		return "", nil
+	}
+	sel, err := metav1.LabelSelectorAsSelector(ls)
+	if err != nil {
+		return "", err
+	}
+	return sel.String(), nil
+}
+
+func (pr *podResolver) listPods(ctx context.Context, selector string) ([]corev1.Pod, error) {
+	if pods, ok := pr.pods[selector]; ok {
+		return pods, nil
+	}
+	pl, err := pr.kc.CoreV1().Pods(pr.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil || pl == nil {
+		return nil, errors.Wrap(err, "error listing pods")
+	}
+	pr.pods[selector] = pl.Items
+	return pl.Items, nil
+}
+
+func (pr *podResolver) listReplicaSets(ctx context.Context, ls *metav1.LabelSelector) ([]appsv1.ReplicaSet, error) {
+	selector, err := selectorString(ls)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing selector")
+	}
+	if rsl, ok := pr.rsl[selector]; ok {
+		return rsl, nil
+	}
+	rsl, err := pr.kc.AppsV1().ReplicaSets(pr.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil || rsl == nil {
+		return nil, errors.Wrap(err, "error listing replicasets")
+	}
+	pr.rsl[selector] = rsl.Items
+	return rsl.Items, nil
+}
+
+func (pr *podResolver) listJobs(ctx context.Context, ls *metav1.LabelSelector) ([]batchv1.Job, error) {
+	selector, err := selectorString(ls)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing selector")
+	}
+	if jobs, ok := pr.jobs[selector]; ok {
+		return jobs, nil
+	}
+	jl, err := pr.kc.BatchV1().Jobs(pr.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil || jl == nil {
+		return nil, errors.Wrap(err, "error listing jobs")
+	}
+	pr.jobs[selector] = jl.Items
+	return jl.Items, nil
+}
+
+func ownedBy(refs []metav1.OwnerReference, uid types.UID) bool {
+	if uid == "" {
+		return false
+	}
+	for _, ref := range refs {
+		if ref.UID == uid {
+			return true
+		}
+	}
+	return false
 }
 
 func failedpod(ctx context.Context, pod corev1.Pod, maxloglines uint, kc K8sClient) (bool, FailedPod) {
@@ -155,9 +381,6 @@ func failedpod(ctx context.Context, pod corev1.Pod, maxloglines uint, kc K8sClie
 		ml := int64(maxloglines)
 		maxlines = &ml
 	}
-	plopts := corev1.PodLogOptions{
-		TailLines: maxlines,
-	}
 	var scheduled, ready, running bool
 	for _, c := range pod.Status.Conditions {
 		if c.Type == corev1.PodScheduled {
@@ -172,25 +395,50 @@ func failedpod(ctx context.Context, pod corev1.Pod, maxloglines uint, kc K8sClie
 	}
 	running = pod.Status.Phase == corev1.PodRunning
 	if !running || (scheduled && !ready) {
-		fp := FailedPod{Logs: make(map[string][]byte)}
+		fp := FailedPod{Logs: make(map[string][]byte), PreviousLogs: make(map[string][]byte)}
 		fp.Name = pod.ObjectMeta.Name
 		fp.Phase = string(pod.Status.Phase)
 		fp.Message = pod.Status.Message
 		fp.Reason = pod.Status.Reason
 		fp.Conditions = pod.Status.Conditions
 		fp.ContainerStatuses = pod.Status.ContainerStatuses
+		fp.InitContainerStatuses = pod.Status.InitContainerStatuses
 		// get logs
-		for _, cs := range fp.ContainerStatuses {
-			if !cs.Ready && ((cs.LastTerminationState.Terminated != nil && cs.LastTerminationState.Terminated.ExitCode != 0) ||
-				(cs.State.Terminated != nil && cs.State.Terminated.ExitCode != 0)) {
-				plopts.Container = cs.Name
-				logs, err := getlogs(ctx, pod.Namespace, pod.Name, &plopts, kc)
+		getContainerLogs := func(cs corev1.ContainerStatus) {
+			if cs.Ready {
+				return
+			}
+			if cs.State.Running != nil || (cs.State.Terminated != nil && cs.State.Terminated.ExitCode != 0) {
+				logs, err := getlogs(ctx, pod.Namespace, pod.Name, &corev1.PodLogOptions{Container: cs.Name, TailLines: maxlines}, kc)
 				if err != nil {
 					logs = []byte("error gettings logs for pod: " + err.Error())
 				}
 				fp.Logs[cs.Name] = logs
 			}
+			if cs.LastTerminationState.Terminated != nil {
+				logs, err := getlogs(ctx, pod.Namespace, pod.Name, &corev1.PodLogOptions{Container: cs.Name, TailLines: maxlines, Previous: true}, kc)
+				if err != nil {
+					logs = []byte("error gettings previous logs for pod: " + err.Error())
+				}
+				fp.PreviousLogs[cs.Name] = logs
+			}
+		}
+		for _, cs := range fp.InitContainerStatuses {
+			// init containers that completed successfully are not ready, but aren't interesting
+			if cs.State.Terminated != nil && cs.State.Terminated.ExitCode == 0 {
+				continue
+			}
+			getContainerLogs(cs)
+		}
+		for _, cs := range fp.ContainerStatuses {
+			getContainerLogs(cs)
+		}
+		events, err := getevents(ctx, pod.Namespace, "Pod", pod.Name, kc)
+		if err != nil {
+			events = []Event{{Type: corev1.EventTypeWarning, Reason: "MetahelmError", Message: "error getting events for pod: " + err.Error()}}
 		}
+		fp.Events = events
+		fp.Summary = summarizePod(pod, events)
 		return true, fp
 	}
 	return false, FailedPod{}
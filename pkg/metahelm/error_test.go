@@ -13,6 +13,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	mtypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
 )
 
 func TestErrorPopulateFromRelease(t *testing.T) {
@@ -113,7 +114,13 @@ metadata:
 	d.ObjectMeta.Name = "foo"
 	d.Namespace = DefaultK8sNamespace
 	r.Spec.Template = d.Spec.Template
-	kc := fake.NewSimpleClientset(r, d, j, p, pj)
+	e := &corev1.Event{}
+	e.Name = "foo.1"
+	e.Namespace = DefaultK8sNamespace
+	e.InvolvedObject = corev1.ObjectReference{Kind: "Deployment", Name: "foo", Namespace: DefaultK8sNamespace}
+	e.Type = corev1.EventTypeWarning
+	e.Reason = "ProgressDeadlineExceeded"
+	kc := fake.NewSimpleClientset(r, d, j, p, pj, e)
 	ce := NewChartError(errors.New("some helm error"))
 	err := ce.PopulateFromRelease(context.Background(), rls, kc, 100)
 	if err != nil {
@@ -135,6 +142,12 @@ metadata:
 	if ec := fp[0].ContainerStatuses[0].State.Terminated.ExitCode; ec != 128 {
 		t.Fatalf("bad exit code: %v", ec)
 	}
+	if fp[0].Summary != "container foo terminated with exit code 128" {
+		t.Fatalf("bad summary: %v", fp[0].Summary)
+	}
+	if ev := ce.Events["Deployment/foo"]; len(ev) != 1 || ev[0].Reason != "ProgressDeadlineExceeded" {
+		t.Fatalf("bad deployment events: %+v", ce.Events)
+	}
 }
 
 func TestErrorPopulateFromDeployment(t *testing.T) {
@@ -268,4 +281,189 @@ func TestUnmarshalError(t *testing.T) {
 	if err := json.Unmarshal(encodedCE, &outputCE); err != nil {
 		t.Fatalf("error unmarshaling chart error: %v", err)
 	}
+	if i := len(outputCE.FailedDeployments["foo"]); i != 1 {
+		t.Fatalf("unexpected length for failed deployment pods after unmarshaling: %v", i)
+	}
+	if outputCE.FailedStatefulSets == nil || outputCE.FailedReplicaSets == nil || outputCE.FailedCronJobs == nil {
+		t.Fatalf("failed workload maps should have been unmarshaled: %+v", outputCE)
+	}
+}
+
+func TestErrorPopulateFromReleaseOwnedWorkloads(t *testing.T) {
+	rls := &release.Release{
+		Namespace: DefaultK8sNamespace,
+		Manifest: `
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: db
+---
+apiVersion: apps/v1
+kind: ReplicaSet
+metadata:
+  name: cache
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: backup`,
+	}
+	failedStatus := corev1.PodStatus{
+		Phase: corev1.PodFailed,
+		Conditions: []corev1.PodCondition{
+			corev1.PodCondition{
+				Type:   corev1.PodScheduled,
+				Status: corev1.ConditionTrue,
+			},
+		},
+		ContainerStatuses: []corev1.ContainerStatus{
+			corev1.ContainerStatus{
+				Name: "main",
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{
+						ExitCode: 1,
+					},
+				},
+			},
+		},
+	}
+	iscontroller := true
+	// StatefulSet pods are selected with MatchExpressions only
+	ss := &appsv1.StatefulSet{}
+	ss.Name = "db"
+	ss.Namespace = DefaultK8sNamespace
+	ss.UID = mtypes.UID("db-statefulset")
+	ss.Spec.Selector = &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"db", "database"}},
+		},
+	}
+	pss := &corev1.Pod{}
+	pss.Name = "db-0"
+	pss.Namespace = DefaultK8sNamespace
+	pss.Labels = map[string]string{"app": "database"}
+	pss.Status = failedStatus
+	// a pod matching no selector, which must not be included
+	pother := &corev1.Pod{}
+	pother.Name = "other"
+	pother.Namespace = DefaultK8sNamespace
+	pother.Labels = map[string]string{"app": "other"}
+	pother.Status = failedStatus
+	// ReplicaSet pods are found by owner reference only
+	rs := &appsv1.ReplicaSet{}
+	rs.Name = "cache"
+	rs.Namespace = DefaultK8sNamespace
+	rs.UID = mtypes.UID("cache-replicaset")
+	prs := &corev1.Pod{}
+	prs.Name = "cache-abcd"
+	prs.Namespace = DefaultK8sNamespace
+	prs.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "cache", UID: rs.UID, Controller: &iscontroller}}
+	prs.Status = failedStatus
+	// CronJob pods are owned by Jobs owned by the CronJob
+	cj := &batchv1.CronJob{}
+	cj.Name = "backup"
+	cj.Namespace = DefaultK8sNamespace
+	cj.UID = mtypes.UID("backup-cronjob")
+	j := &batchv1.Job{}
+	j.Name = "backup-1234"
+	j.Namespace = DefaultK8sNamespace
+	j.UID = mtypes.UID("backup-1234-job")
+	j.OwnerReferences = []metav1.OwnerReference{{Kind: "CronJob", Name: "backup", UID: cj.UID, Controller: &iscontroller}}
+	pj := &corev1.Pod{}
+	pj.Name = "backup-1234-xyz"
+	pj.Namespace = DefaultK8sNamespace
+	pj.OwnerReferences = []metav1.OwnerReference{{Kind: "Job", Name: "backup-1234", UID: j.UID, Controller: &iscontroller}}
+	pj.Status = failedStatus
+	kc := fake.NewSimpleClientset(ss, pss, pother, rs, prs, cj, j, pj)
+	ce := NewChartError(errors.New("some helm error"))
+	if err := ce.PopulateFromRelease(context.Background(), rls, kc, 100); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	check := func(kind string, fm map[string][]FailedPod, name, pod string) {
+		fp, ok := fm[name]
+		if !ok {
+			t.Fatalf("%v %v missing", kind, name)
+		}
+		if len(fp) != 1 || fp[0].Name != pod {
+			t.Fatalf("bad failed pods for %v %v: %+v", kind, name, fp)
+		}
+	}
+	check("statefulset", ce.FailedStatefulSets, "db", "db-0")
+	check("replicaset", ce.FailedReplicaSets, "cache", "cache-abcd")
+	check("cronjob", ce.FailedCronJobs, "backup", "backup-1234-xyz")
+	if _, ok := ce.Events["Job/backup-1234"]; ok {
+		t.Fatalf("no events should have been found for the job")
+	}
+}
+
+func TestPodResolverScope(t *testing.T) {
+	iscontroller := true
+	pod := func(name string, labels map[string]string, owner mtypes.UID) *corev1.Pod {
+		p := &corev1.Pod{}
+		p.Name = name
+		p.Namespace = DefaultK8sNamespace
+		p.Labels = labels
+		if owner != "" || labels == nil {
+			p.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", UID: owner, Controller: &iscontroller}}
+		}
+		return p
+	}
+	d := &appsv1.Deployment{}
+	d.Name = "web"
+	d.Namespace = DefaultK8sNamespace
+	d.UID = mtypes.UID("web-deployment")
+	d.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	// replicasets without selector or UID (eg, created by hand), whose pods are matched by owner reference only
+	rs := &appsv1.ReplicaSet{}
+	rs.Name = "cache"
+	rs.Namespace = DefaultK8sNamespace
+	rs2 := &appsv1.ReplicaSet{}
+	rs2.Name = "db"
+	rs2.Namespace = DefaultK8sNamespace
+	rs2.UID = mtypes.UID("db-replicaset")
+	kc := fake.NewSimpleClientset(d, rs, rs2,
+		pod("db-1", nil, rs2.UID),
+		pod("web-1", map[string]string{"app": "web"}, ""),
+		pod("web-2", map[string]string{"app": "web", "tier": "front"}, ""),
+		pod("api-1", map[string]string{"app": "api"}, d.UID),
+		pod("orphan", nil, ""),
+	)
+	pr := newPodResolver(DefaultK8sNamespace, kc)
+	pods, err := pr.workloadPods(context.Background(), "Deployment", "web")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(pods) != 2 || pods[0].Name != "web-1" || pods[1].Name != "web-2" {
+		t.Fatalf("bad pods: %+v", pods)
+	}
+	for _, a := range kc.Actions() {
+		if la, ok := a.(ktesting.ListAction); ok && (a.GetResource().Resource == "pods" || a.GetResource().Resource == "replicasets") {
+			if sel := la.GetListRestrictions().Labels.String(); sel != "app=web" {
+				t.Fatalf("%v should have been listed with the deployment selector: %q", a.GetResource().Resource, sel)
+			}
+		}
+	}
+	pods, err = pr.workloadPods(context.Background(), "ReplicaSet", "db")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(pods) != 1 || pods[0].Name != "db-1" {
+		t.Fatalf("bad pods: %+v", pods)
+	}
+	pods, err = pr.workloadPods(context.Background(), "ReplicaSet", "cache")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if len(pods) != 0 {
+		t.Fatalf("pods with an empty owner UID should not have been matched: %+v", pods)
+	}
+	n := 0
+	for _, a := range kc.Actions() {
+		if a.GetVerb() == "list" && a.GetResource().Resource == "pods" {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Fatalf("pods should have been listed once per selector: %v", n)
+	}
 }
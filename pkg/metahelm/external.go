@@ -0,0 +1,190 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Kinds of external dependencies
+const (
+	ExternalRelease     = "release"
+	ExternalDeployment  = "deployment"
+	ExternalStatefulSet = "statefulset"
+	ExternalDaemonSet   = "daemonset"
+)
+
+// ExternalDependency is a step that waits for a Helm release or a workload installed outside of the graph (eg, shared infrastructure
+// installed by another graph) to be deployed and healthy, so that the objects that depend on it can start. It doesn't install or modify anything.
+type ExternalDependency struct {
+	Title        string // unique name for this step (ParseExternalDependency uses the dependency reference)
+	Kind         string // ExternalRelease or the kind of workload: ExternalDeployment, ExternalStatefulSet or ExternalDaemonSet
+	ResourceName string // release or workload name
+	// Namespace is the namespace of the release or workload. If empty, the graph namespace is used.
+	Namespace      string
+	WaitTimeout    time.Duration // how long to wait for the release or workload. If unset, DefaultDeploymentTimeout is used
+	DependencyList []string
+	StartPriority  int            // steps with higher priority are started first within a graph level
+	ResourceTokens map[string]int // tokens of shared resources held while running the step (see WithResourceLimits)
+}
+
+var _ Step = &ExternalDependency{}
+
+func (ed *ExternalDependency) Name() string {
+	return ed.Title
+}
+
+func (ed *ExternalDependency) String() string {
+	return fmt.Sprintf("\"%v\"", ed.Title)
+}
+
+func (ed *ExternalDependency) Dependencies() []string {
+	return ed.DependencyList
+}
+
+func (ed *ExternalDependency) Priority() int {
+	return ed.StartPriority
+}
+
+func (ed *ExternalDependency) Resources() map[string]int {
+	return ed.ResourceTokens
+}
+
+// ParseExternalDependency parses a reference to a release or workload outside of the graph, of the form "<kind>/<namespace>/<name>" or
+// "<kind>/<name>" (in the graph namespace), where kind is release, deployment, statefulset or daemonset (eg, "release/infra/postgres").
+// It returns false if ref doesn't start with one of the kinds, and the step is titled ref.
+func ParseExternalDependency(ref string) (*ExternalDependency, bool, error) {
+	parts := strings.Split(ref, "/")
+	switch strings.ToLower(parts[0]) {
+	case ExternalRelease, ExternalDeployment, ExternalStatefulSet, ExternalDaemonSet:
+	default:
+		return nil, false, nil
+	}
+	ed := &ExternalDependency{Title: ref, Kind: strings.ToLower(parts[0])}
+	switch len(parts) {
+	case 2:
+		ed.ResourceName = parts[1]
+	case 3:
+		ed.Namespace, ed.ResourceName = parts[1], parts[2]
+		if ed.Namespace == "" {
+			return nil, true, fmt.Errorf("empty namespace in external dependency: %v", ref)
+		}
+	default:
+		return nil, true, fmt.Errorf("malformed external dependency (expected %v/<namespace>/<name>): %v", parts[0], ref)
+	}
+	if ed.ResourceName == "" {
+		return nil, true, fmt.Errorf("empty name in external dependency: %v", ref)
+	}
+	return ed, true, nil
+}
+
+// Run polls until the release is deployed or the workload is healthy (all desired pods are ready), or WaitTimeout elapses or ctx is
+// cancelled. It keeps polling while the release or workload doesn't exist, and fails on other errors.
+func (ed *ExternalDependency) Run(ctx context.Context, m *Manager, namespace string) error {
+	if ed.Namespace != "" {
+		namespace = ed.Namespace
+	}
+	timeout := ed.WaitTimeout
+	if timeout == 0 {
+		timeout = DefaultDeploymentTimeout
+	}
+	desc := fmt.Sprintf("%v %v/%v", ed.Kind, namespace, ed.ResourceName)
+	m.log("%v: waiting for external %v", ed.Title, desc)
+	var state string
+	err := wait.PollImmediateWithContext(ctx, ChartWaitPollInterval, timeout, func(ctx context.Context) (bool, error) {
+		var ok bool
+		var err error
+		ok, state, err = m.externalReady(ctx, ed.Kind, namespace, ed.ResourceName)
+		if err != nil {
+			return false, err
+		}
+		m.log("%v: %v: %v", ed.Title, desc, state)
+		return ok, nil
+	})
+	if err != nil {
+		if state != "" {
+			return errors.Wrapf(err, "error waiting for external %v (%v)", desc, state)
+		}
+		return errors.Wrapf(err, "error waiting for external %v", desc)
+	}
+	m.log("%v: external %v is ready", ed.Title, desc)
+	return nil
+}
+
+// externalReady returns whether the release or workload of kind is deployed and healthy, and a description of its state. A release or
+// workload that doesn't exist isn't ready; other errors getting it are returned.
+func (m *Manager) externalReady(ctx context.Context, kind, namespace, name string) (bool, string, error) {
+	// a workload scaled to zero is ready once its controller has observed the current spec
+	ready := func(ready, desired int32, observed, generation int64) (bool, string, error) {
+		state := fmt.Sprintf("%v ready replicas, %v desired", ready, desired)
+		if observed < generation {
+			return false, state + " (spec not observed yet)", nil
+		}
+		return ready >= desired, state, nil
+	}
+	notFound := func(err error) (bool, string, error) {
+		if kerrors.IsNotFound(err) || errors.Is(err, driver.ErrReleaseNotFound) {
+			return false, fmt.Sprintf("not found: %v", err), nil
+		}
+		return false, "", errors.Wrapf(err, "error getting %v %v/%v", kind, namespace, name)
+	}
+	switch kind {
+	case ExternalRelease:
+		rel, err := m.releaseStorage(namespace).Last(name)
+		if err != nil {
+			return notFound(err)
+		}
+		if rel.Info == nil {
+			return false, "no release info", nil
+		}
+		return rel.Info.Status == release.StatusDeployed, fmt.Sprintf("revision %v %v", rel.Version, rel.Info.Status), nil
+	case ExternalDeployment:
+		d, err := m.K8c.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return notFound(err)
+		}
+		desired := int32(1)
+		if d.Spec.Replicas != nil {
+			desired = *d.Spec.Replicas
+		}
+		return ready(d.Status.ReadyReplicas, desired, d.Status.ObservedGeneration, d.Generation)
+	case ExternalStatefulSet:
+		ss, err := m.K8c.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return notFound(err)
+		}
+		desired := int32(1)
+		if ss.Spec.Replicas != nil {
+			desired = *ss.Spec.Replicas
+		}
+		return ready(ss.Status.ReadyReplicas, desired, ss.Status.ObservedGeneration, ss.Generation)
+	case ExternalDaemonSet:
+		ds, err := m.K8c.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return notFound(err)
+		}
+		return ready(ds.Status.NumberReady, ds.Status.DesiredNumberScheduled, ds.Status.ObservedGeneration, ds.Generation)
+	}
+	return false, "", fmt.Errorf("unknown kind of external dependency: %v", kind)
+}
+
+// releaseStorage returns the storage of the Helm releases in namespace. The Secrets and ConfigMaps drivers of HCfg are recreated for
+// namespace; other drivers (eg, SQL) are used as they are.
+func (m *Manager) releaseStorage(namespace string) *storage.Storage {
+	switch m.HCfg.Releases.Driver.(type) {
+	case *driver.Secrets:
+		return storage.Init(driver.NewSecrets(m.K8c.CoreV1().Secrets(namespace)))
+	case *driver.ConfigMaps:
+		return storage.Init(driver.NewConfigMaps(m.K8c.CoreV1().ConfigMaps(namespace)))
+	}
+	return m.HCfg.Releases
+}
@@ -0,0 +1,157 @@
+package metahelm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	appsv1 "k8s.io/api/apps/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func TestParseExternalDependency(t *testing.T) {
+	cases := []struct {
+		ref                   string
+		external, isErr       bool
+		kind, namespace, name string
+	}{
+		{"postgres", false, false, "", "", ""},
+		{"release/infra/postgres", true, false, ExternalRelease, "infra", "postgres"},
+		{"Deployment/ingress", true, false, ExternalDeployment, "", "ingress"},
+		{"statefulset/data/redis", true, false, ExternalStatefulSet, "data", "redis"},
+		{"release/", true, true, "", "", ""},
+		{"release//postgres", true, true, "", "", ""},
+		{"daemonset/a/b/c", true, true, "", "", ""},
+	}
+	for _, c := range cases {
+		ed, ok, err := ParseExternalDependency(c.ref)
+		if ok != c.external {
+			t.Fatalf("%v: external: expected %v, got %v", c.ref, c.external, ok)
+		}
+		if err != nil {
+			if !c.isErr {
+				t.Fatalf("%v: should have succeeded: %v", c.ref, err)
+			}
+			continue
+		}
+		if c.isErr {
+			t.Fatalf("%v: should have failed", c.ref)
+		}
+		if !ok {
+			continue
+		}
+		if ed.Title != c.ref || ed.Kind != c.kind || ed.Namespace != c.namespace || ed.ResourceName != c.name {
+			t.Fatalf("%v: bad external dependency: %+v", c.ref, ed)
+		}
+	}
+}
+
+func TestExternalDependency(t *testing.T) {
+	replicas, zero := int32(2), int32(0)
+	kc := k8sfake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "ingress", Namespace: "infra"},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			Status:     appsv1.DeploymentStatus{ReadyReplicas: 2},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "redis", Namespace: "infra"},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+			Status:     appsv1.StatefulSetStatus{ReadyReplicas: 1},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "scaled-down", Namespace: "infra", Generation: 3},
+			Spec:       appsv1.DeploymentSpec{Replicas: &zero},
+			Status:     appsv1.DeploymentStatus{ObservedGeneration: 3},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "scaling-down", Namespace: "infra", Generation: 4},
+			Spec:       appsv1.DeploymentSpec{Replicas: &zero},
+			Status:     appsv1.DeploymentStatus{ObservedGeneration: 3},
+		},
+		&appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "no-nodes", Namespace: "infra"},
+		},
+	)
+	kc.PrependReactor("get", "statefulsets", func(action ktesting.Action) (bool, runtime.Object, error) {
+		if action.(ktesting.GetAction).GetName() != "forbidden" {
+			return false, nil, nil
+		}
+		return true, nil, kerrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "statefulsets"}, "forbidden", errors.New("no permission"))
+	})
+	infra := storage.Init(driver.NewSecrets(kc.CoreV1().Secrets("infra")))
+	for _, r := range []*release.Release{
+		{Name: "postgres", Namespace: "infra", Version: 1, Info: &release.Info{Status: release.StatusDeployed}},
+		{Name: "certs", Namespace: "infra", Version: 1, Info: &release.Info{Status: release.StatusFailed}},
+	} {
+		if err := infra.Create(r); err != nil {
+			t.Fatalf("error creating release: %v", err)
+		}
+	}
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  kc,
+		HCfg: &action.Configuration{Releases: storage.Init(driver.NewSecrets(kc.CoreV1().Secrets("foo")))},
+	}
+	ChartWaitPollInterval = 100 * time.Millisecond
+	cases := []struct {
+		ref    string
+		errMsg string
+	}{
+		{"release/infra/postgres", ""},
+		{"release/infra/certs", "timed out"},
+		{"release/postgres", "timed out"},
+		{"deployment/infra/ingress", ""},
+		{"deployment/infra/missing", "timed out"},
+		{"deployment/infra/scaled-down", ""},
+		{"deployment/infra/scaling-down", "timed out"},
+		{"daemonset/infra/no-nodes", ""},
+		{"statefulset/infra/redis", "timed out"},
+		{"statefulset/infra/forbidden", "no permission"},
+	}
+	for _, c := range cases {
+		t.Run(c.ref, func(t *testing.T) {
+			ed, _, err := ParseExternalDependency(c.ref)
+			if err != nil {
+				t.Fatalf("error parsing: %v", err)
+			}
+			ed.WaitTimeout = 300 * time.Millisecond
+			err = ed.Run(context.Background(), &m, "foo")
+			if c.errMsg == "" {
+				if err != nil {
+					t.Fatalf("should have succeeded: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.errMsg) {
+				t.Fatalf("should have failed with %q: %v", c.errMsg, err)
+			}
+		})
+	}
+}
+
+func TestExternalDependencyCancel(t *testing.T) {
+	m := Manager{LogF: t.Logf, K8c: k8sfake.NewSimpleClientset()}
+	ChartWaitPollInterval = 100 * time.Millisecond
+	ed := &ExternalDependency{Title: "ingress", Kind: ExternalDeployment, ResourceName: "ingress", WaitTimeout: time.Minute}
+	ctx, cf := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cf()
+	start := time.Now()
+	if err := ed.Run(ctx, &m, "foo"); err == nil {
+		t.Fatalf("should have failed")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("should have stopped when the context was cancelled: %v", d)
+	}
+}
@@ -0,0 +1,118 @@
+package metahelm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/getter"
+)
+
+// HelmOptions are Helm install/upgrade flags for a chart. They map onto the fields of the same names of action.Install and action.Upgrade
+// (those that only exist in one of them are ignored for the other).
+type HelmOptions struct {
+	Atomic           bool   // on failure, uninstall a failed install or roll back a failed upgrade
+	Force            bool   // force resource updates through a replacement strategy
+	ResetValues      bool   // upgrade only: reset the values to the ones built into the chart
+	ReuseValues      bool   // upgrade only: reuse the last release's values and merge in the overrides
+	SkipCRDs         bool   // don't install the CRDs in the crds/ directory of the chart
+	DisableHooks     bool   // don't run chart hooks
+	WaitForJobs      bool   // wait for all Jobs to complete before marking the release as successful
+	MaxHistory       int    // upgrade only: maximum number of revisions saved per release (zero means no limit)
+	Description      string // custom description of the release revision
+	DependencyUpdate bool   // update the chart dependencies (charts/ directory) before installing if they are missing
+}
+
+// WithHelmDefaults specifies the Helm options used for charts that don't have their own (Chart.Helm is nil)
+func WithHelmDefaults(ho HelmOptions) InstallOption {
+	return func(op *options) {
+		op.helmDefaults = ho
+	}
+}
+
+// Validate verifies that the options are consistent
+func (ho HelmOptions) Validate() error {
+	if ho.ResetValues && ho.ReuseValues {
+		return errors.New("reset values and reuse values are mutually exclusive")
+	}
+	if ho.MaxHistory < 0 {
+		return fmt.Errorf("negative max history: %v", ho.MaxHistory)
+	}
+	return nil
+}
+
+func (ho HelmOptions) applyInstall(install *action.Install) {
+	install.Atomic = ho.Atomic
+	install.Force = ho.Force
+	install.SkipCRDs = ho.SkipCRDs
+	install.DisableHooks = ho.DisableHooks
+	install.WaitForJobs = ho.WaitForJobs
+	install.Description = ho.Description
+	install.DependencyUpdate = ho.DependencyUpdate
+}
+
+func (ho HelmOptions) applyUpgrade(upgrade *action.Upgrade) {
+	upgrade.Atomic = ho.Atomic
+	upgrade.Force = ho.Force
+	upgrade.ResetValues = ho.ResetValues
+	upgrade.ReuseValues = ho.ReuseValues
+	upgrade.SkipCRDs = ho.SkipCRDs
+	upgrade.DisableHooks = ho.DisableHooks
+	upgrade.WaitForJobs = ho.WaitForJobs
+	upgrade.MaxHistory = ho.MaxHistory
+	upgrade.Description = ho.Description
+	upgrade.DependencyUpdate = ho.DependencyUpdate
+}
+
+// helmOptions returns the Helm options for c
+func (ops *options) helmOptions(c *Chart) HelmOptions {
+	if c.Helm != nil {
+		return *c.Helm
+	}
+	return ops.helmDefaults
+}
+
+// loadChart loads the chart at location. If dependencyUpdate is set and the chart is a directory with missing dependencies, they are
+// updated (like helm dependency update) and the chart is loaded again.
+func (m *Manager) loadChart(title, location string, dependencyUpdate bool) (*chart.Chart, error) {
+	c, err := loader.Load(location)
+	if err != nil {
+		return nil, fmt.Errorf("error loading chart from location %s: %w", location, err)
+	}
+	if !dependencyUpdate || c.Metadata == nil || len(c.Metadata.Dependencies) == 0 {
+		return c, nil
+	}
+	if err := action.CheckDependencies(c, c.Metadata.Dependencies); err == nil {
+		return c, nil
+	}
+	if fi, err := os.Stat(location); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("chart %v has missing dependencies and is not a directory, so they can't be updated", title)
+	}
+	m.log("%v: updating chart dependencies", title)
+	settings := cli.New()
+	out := &bytes.Buffer{}
+	man := &downloader.Manager{
+		Out:              out,
+		ChartPath:        location,
+		Getters:          getter.All(settings),
+		RepositoryConfig: settings.RepositoryConfig,
+		RepositoryCache:  settings.RepositoryCache,
+	}
+	if m.HCfg != nil {
+		man.RegistryClient = m.HCfg.RegistryClient
+	}
+	if err := man.Update(); err != nil {
+		return nil, fmt.Errorf("error updating chart dependencies: %w: %v", err, out.String())
+	}
+	c, err = loader.Load(location)
+	if err != nil {
+		return nil, fmt.Errorf("error loading chart from location %s after updating dependencies: %w", location, err)
+	}
+	return c, nil
+}
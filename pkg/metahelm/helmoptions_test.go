@@ -0,0 +1,69 @@
+package metahelm
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHelmOptionsValidate(t *testing.T) {
+	if err := (HelmOptions{Atomic: true, MaxHistory: 10}).Validate(); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if err := (HelmOptions{ResetValues: true, ReuseValues: true}).Validate(); err == nil {
+		t.Fatalf("should have failed with reset and reuse values")
+	}
+	if err := (HelmOptions{MaxHistory: -1}).Validate(); err == nil {
+		t.Fatalf("should have failed with negative max history")
+	}
+	charts := []Chart{
+		Chart{
+			Title:                      "redis",
+			Location:                   "/foo",
+			DeploymentHealthIndication: IgnorePodHealth,
+			Helm:                       &HelmOptions{ResetValues: true, ReuseValues: true},
+		},
+	}
+	if err := ValidateCharts(charts); err == nil {
+		t.Fatalf("ValidateCharts should have failed")
+	}
+}
+
+func TestGraphInstallHelmOptions(t *testing.T) {
+	charts := []Chart{
+		Chart{
+			Title:                      "redis",
+			Location:                   "testdata/chart",
+			DeploymentHealthIndication: IgnorePodHealth,
+			Helm:                       &HelmOptions{Description: "installed with chart options"},
+		},
+		Chart{
+			Title:                      "mysql",
+			Location:                   "testdata/chart",
+			DeploymentHealthIndication: IgnorePodHealth,
+		},
+	}
+	cfg := fakeHelmConfiguration(t)
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fakeKubernetesClientset(t, DefaultK8sNamespace, charts),
+		HCfg: cfg,
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	rm, err := m.Install(context.Background(), charts, WithHelmDefaults(HelmOptions{Description: "installed with defaults"}))
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	for title, desc := range map[string]string{"redis": "installed with chart options", "mysql": "installed with defaults"} {
+		rel, err := cfg.Releases.Last(rm[title])
+		if err != nil {
+			t.Fatalf("error getting release: %v", err)
+		}
+		if rel.Info.Description != desc {
+			t.Fatalf("bad description for %v: %v", title, rel.Info.Description)
+		}
+	}
+	if _, err := m.Install(context.Background(), charts, WithHelmDefaults(HelmOptions{MaxHistory: -1})); err == nil {
+		t.Fatalf("should have failed with invalid defaults")
+	}
+}
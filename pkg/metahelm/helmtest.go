@@ -0,0 +1,93 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// runHelmTests executes the Helm test hooks of release relname (equivalent to "helm test"). If any test fails, a ChartError is returned
+// with the failed test pods in FailedTests.
+func (m *Manager) runHelmTests(ctx context.Context, c *Chart, relname string) error {
+	m.log("%v: running helm tests", c.Name())
+	rt := action.NewReleaseTesting(m.HCfg)
+	rt.Timeout = c.WaitTimeout
+	var rel *release.Release
+	fn := func() error {
+		var err error
+		rel, err = rt.Run(relname)
+		return err
+	}
+	err := wrapper(ctx, fn)
+	if err == nil {
+		m.log("%v: helm tests passed", c.Name())
+		return nil
+	}
+	m.log("%v: helm tests failed: %v", c.Name(), err)
+	ce := NewChartError(errors.Wrap(err, "helm tests failed"))
+	// if the context was cancelled the test run may still be in progress
+	if ctx.Err() != nil || rel == nil {
+		return ce
+	}
+	if err2 := ce.PopulateFromTests(ctx, rel, m.K8c, MaxPodLogLines); err2 != nil {
+		m.log("error populating chart error from tests: %v", err2)
+	}
+	return ce
+}
+
+// PopulateFromTests fills ChartError with the failed test hooks of a release (after a "helm test" run), including the logs of the test pods if they still exist
+func (ce ChartError) PopulateFromTests(ctx context.Context, rls *release.Release, kc K8sClient, maxloglines uint) error {
+	if rls == nil {
+		return errors.New("release is nil")
+	}
+	for _, h := range rls.Hooks {
+		if !isTestHook(h) || h.LastRun.Phase == release.HookPhaseSucceeded || h.LastRun.Phase == release.HookPhaseUnknown {
+			continue
+		}
+		fp := FailedPod{Name: h.Name, Phase: h.LastRun.Phase.String(), Summary: fmt.Sprintf("test %v: %v", h.Name, h.LastRun.Phase)}
+		if h.Kind == "Pod" {
+			pod, err := kc.CoreV1().Pods(rls.Namespace).Get(ctx, h.Name, metav1.GetOptions{})
+			if err == nil && pod != nil {
+				if failed, fp2 := failedpod(ctx, *pod, maxloglines, kc); failed {
+					fp = fp2
+				} else {
+					fp.Logs = testPodLogs(ctx, *pod, maxloglines, kc)
+				}
+			}
+		}
+		ce.FailedTests[h.Name] = append(ce.FailedTests[h.Name], fp)
+	}
+	return nil
+}
+
+func isTestHook(h *release.Hook) bool {
+	for _, e := range h.Events {
+		if e == release.HookTest {
+			return true
+		}
+	}
+	return false
+}
+
+// testPodLogs returns the logs of all containers of a test pod
+func testPodLogs(ctx context.Context, pod corev1.Pod, maxloglines uint, kc K8sClient) map[string][]byte {
+	var maxlines *int64
+	if maxloglines > 0 {
+		ml := int64(maxloglines)
+		maxlines = &ml
+	}
+	out := make(map[string][]byte)
+	for _, c := range pod.Spec.Containers {
+		logs, err := getlogs(ctx, pod.Namespace, pod.Name, &corev1.PodLogOptions{Container: c.Name, TailLines: maxlines}, kc)
+		if err != nil {
+			logs = []byte("error gettings logs for pod: " + err.Error())
+		}
+		out[c.Name] = logs
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package metahelm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/release"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGraphInstallHelmTests(t *testing.T) {
+	charts := []Chart{
+		Chart{
+			Title:                      "redis",
+			Location:                   "testdata/chart",
+			DeploymentHealthIndication: IgnorePodHealth,
+			RunHelmTests:               true,
+		},
+	}
+	fkc := fakeKubernetesClientset(t, DefaultK8sNamespace, charts)
+	cfg := fakeHelmConfiguration(t)
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fkc,
+		HCfg: cfg,
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	rm, err := m.Install(context.Background(), charts)
+	if err != nil {
+		t.Fatalf("error installing: %v", err)
+	}
+	rel, err := cfg.Releases.Last(rm["redis"])
+	if err != nil {
+		t.Fatalf("error getting release: %v", err)
+	}
+	var ran bool
+	for _, h := range rel.Hooks {
+		if isTestHook(h) {
+			ran = true
+			if h.LastRun.Phase != release.HookPhaseSucceeded {
+				t.Fatalf("bad test hook phase: %v", h.LastRun.Phase)
+			}
+		}
+	}
+	if !ran {
+		t.Fatalf("test hook should have been run")
+	}
+}
+
+func TestGraphInstallHelmTestsFailure(t *testing.T) {
+	charts := []Chart{
+		Chart{
+			Title:                      "redis",
+			Location:                   "testdata/chart",
+			DeploymentHealthIndication: IgnorePodHealth,
+			RunHelmTests:               true,
+		},
+	}
+	fkc := fakeKubernetesClientset(t, DefaultK8sNamespace, charts)
+	p := &corev1.Pod{}
+	p.Name = "redis-chart-test-connection"
+	p.Namespace = DefaultK8sNamespace
+	p.Spec.Containers = []corev1.Container{{Name: "wget"}}
+	p.Status = corev1.PodStatus{
+		Phase: corev1.PodFailed,
+		ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "wget", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"}}},
+		},
+	}
+	if _, err := fkc.CoreV1().Pods(DefaultK8sNamespace).Create(context.Background(), p, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("error creating test pod: %v", err)
+	}
+	cfg := fakeHelmConfiguration(t)
+	cfg.KubeClient = &testKubeClient{watchErr: errors.New("pod redis-chart-test-connection failed")}
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fkc,
+		HCfg: cfg,
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	_, err := m.Install(context.Background(), charts)
+	if err == nil {
+		t.Fatalf("install should have failed")
+	}
+	ce, ok := err.(ChartError)
+	if !ok {
+		t.Fatalf("error should have been a ChartError: %T: %v", err, err)
+	}
+	fps, ok := ce.FailedTests["redis-chart-test-connection"]
+	if !ok || len(fps) != 1 {
+		t.Fatalf("bad failed tests: %+v", ce.FailedTests)
+	}
+	if _, ok := fps[0].Logs["wget"]; !ok {
+		t.Fatalf("test pod logs missing: %+v", fps[0])
+	}
+	if fps[0].Summary != "container wget terminated with exit code 1 (Error)" {
+		t.Fatalf("bad summary: %v", fps[0].Summary)
+	}
+}
@@ -0,0 +1,164 @@
+package metahelm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+// DefaultLockFileName is the name of the lock file written next to the graph definition
+const DefaultLockFileName = "metahelm.lock"
+
+// LockedChart is a chart pinned to an exact version and content digest
+type LockedChart struct {
+	// Title of the chart in the graph
+	Title string `yaml:"name"`
+	// Source is the chart reference in the graph definition (local path, chart name in a repository or OCI reference)
+	Source string `yaml:"source"`
+	// RepoURL is the chart repository URL, if any
+	RepoURL string `yaml:"repo,omitempty"`
+	// Version is the exact chart version
+	Version string `yaml:"version"`
+	// Digest is the content digest of the chart (see ChartDigest)
+	Digest string `yaml:"digest"`
+}
+
+// LockFile pins the charts of a graph
+type LockFile struct {
+	Generated time.Time     `yaml:"generated"`
+	Charts    []LockedChart `yaml:"charts"`
+}
+
+// Get returns the locked chart with title, if present
+func (lf *LockFile) Get(title string) (LockedChart, bool) {
+	for _, lc := range lf.Charts {
+		if lc.Title == title {
+			return lc, true
+		}
+	}
+	return LockedChart{}, false
+}
+
+// ReadLockFile reads a lock file
+func ReadLockFile(path string) (*LockFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading lock file")
+	}
+	lf := &LockFile{}
+	if err := yaml.Unmarshal(b, lf); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling lock file")
+	}
+	return lf, nil
+}
+
+// WriteLockFile writes a lock file, with charts sorted by title
+func WriteLockFile(path string, lf *LockFile) error {
+	sort.Slice(lf.Charts, func(i, j int) bool { return lf.Charts[i].Title < lf.Charts[j].Title })
+	b, err := yaml.Marshal(lf)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling lock file")
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return errors.Wrap(err, "error writing lock file")
+	}
+	return nil
+}
+
+// LockMismatchError is returned when a chart doesn't match the lock file
+type LockMismatchError struct {
+	Title                  string
+	LockedVersion, Version string
+	LockedDigest, Digest   string
+	Missing                bool // the chart isn't in the lock file
+}
+
+// Error satisfies the error interface
+func (lme LockMismatchError) Error() string {
+	if lme.Missing {
+		return fmt.Sprintf("chart %v is not in the lock file", lme.Title)
+	}
+	return fmt.Sprintf("chart %v doesn't match the lock file: version %v, digest %v (locked: version %v, digest %v)",
+		lme.Title, lme.Version, lme.Digest, lme.LockedVersion, lme.LockedDigest)
+}
+
+// Verify checks that the chart with title has the locked version and digest
+func (lf *LockFile) Verify(title, version, digest string) error {
+	lc, ok := lf.Get(title)
+	if !ok {
+		return LockMismatchError{Title: title, Version: version, Digest: digest, Missing: true}
+	}
+	if lc.Version != version || lc.Digest != digest {
+		return LockMismatchError{Title: title, LockedVersion: lc.Version, Version: version, LockedDigest: lc.Digest, Digest: digest}
+	}
+	return nil
+}
+
+// ChartDigest loads the chart at location (directory or archive) and returns its version and content digest. The digest is computed over the
+// names and contents of the chart files (excluding those ignored by .helmignore), so it doesn't depend on how the chart is packaged.
+func ChartDigest(location string) (version, digest string, err error) {
+	c, err := loader.Load(location)
+	if err != nil {
+		return "", "", errors.Wrap(err, "error loading chart")
+	}
+	files := c.Raw
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	h := sha256.New()
+	for _, f := range files {
+		fh := sha256.Sum256(canonicalChartFile(f))
+		fmt.Fprintf(h, "%s\x00%x\n", f.Name, fh)
+	}
+	return c.Metadata.Version, "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// canonicalChartFile returns the contents of f, with Chart.yaml and Chart.lock files normalized (Helm rewrites them when packaging charts)
+func canonicalChartFile(f *chart.File) []byte {
+	var v interface{}
+	switch path.Base(f.Name) {
+	case "Chart.yaml":
+		v = &chart.Metadata{}
+	case "Chart.lock":
+		v = &chart.Lock{}
+	default:
+		return f.Data
+	}
+	if err := sigsyaml.Unmarshal(f.Data, v); err != nil {
+		return f.Data
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return f.Data
+	}
+	return b
+}
+
+// LocateChart returns the local path of a chart: ref itself for a local chart, or the path of the downloaded archive for a chart in the
+// repository repoURL or an OCI reference (oci://...), with version an exact version or a constraint (empty means the latest version).
+// rc is required for OCI references.
+func LocateChart(ref, repoURL, version string, rc *registry.Client) (string, error) {
+	if repoURL == "" && !registry.IsOCI(ref) {
+		return ref, nil
+	}
+	install := action.NewInstall(&action.Configuration{RegistryClient: rc})
+	install.ChartPathOptions.RepoURL = repoURL
+	install.ChartPathOptions.Version = version
+	p, err := install.ChartPathOptions.LocateChart(ref, cli.New())
+	if err != nil {
+		return "", errors.Wrap(err, "error locating chart")
+	}
+	return p, nil
+}
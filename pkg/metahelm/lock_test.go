@@ -0,0 +1,78 @@
+package metahelm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+func TestChartDigest(t *testing.T) {
+	v, d, err := ChartDigest("testdata/chart")
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if v == "" || d == "" {
+		t.Fatalf("empty version or digest: %v, %v", v, d)
+	}
+	// the digest of the packaged chart is the same
+	c, err := loader.Load("testdata/chart")
+	if err != nil {
+		t.Fatalf("error loading chart: %v", err)
+	}
+	tmpdir, err := ioutil.TempDir("", "metahelm-lock")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	archive, err := chartutil.Save(c, tmpdir)
+	if err != nil {
+		t.Fatalf("error packaging chart: %v", err)
+	}
+	v2, d2, err := ChartDigest(archive)
+	if err != nil {
+		t.Fatalf("archive: should have succeeded: %v", err)
+	}
+	if v2 != v || d2 != d {
+		t.Fatalf("archive digest differs: %v, %v (directory: %v, %v)", v2, d2, v, d)
+	}
+	if p, err := LocateChart("testdata/chart", "", "", nil); err != nil || p != "testdata/chart" {
+		t.Fatalf("local chart should be located in place: %v, %v", p, err)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "metahelm-lock")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	lp := filepath.Join(tmpdir, DefaultLockFileName)
+	lf := &LockFile{Charts: []LockedChart{
+		LockedChart{Title: "redis", Source: "redis", RepoURL: "https://charts.example.com", Version: "1.2.3", Digest: "sha256:abc"},
+		LockedChart{Title: "mysql", Source: "charts/mysql", Version: "0.1.0", Digest: "sha256:def"},
+	}}
+	if err := WriteLockFile(lp, lf); err != nil {
+		t.Fatalf("error writing lock file: %v", err)
+	}
+	lf2, err := ReadLockFile(lp)
+	if err != nil {
+		t.Fatalf("error reading lock file: %v", err)
+	}
+	if len(lf2.Charts) != 2 || lf2.Charts[0].Title != "mysql" {
+		t.Fatalf("bad lock file: %+v", lf2)
+	}
+	if err := lf2.Verify("redis", "1.2.3", "sha256:abc"); err != nil {
+		t.Fatalf("should have matched: %v", err)
+	}
+	if err := lf2.Verify("redis", "1.2.3", "sha256:xyz"); err == nil {
+		t.Fatalf("should have failed with different digest")
+	}
+	err = lf2.Verify("postgres", "1.0.0", "sha256:abc")
+	if lme, ok := err.(LockMismatchError); !ok || !lme.Missing {
+		t.Fatalf("should have failed with missing chart: %v", err)
+	}
+}
@@ -0,0 +1,426 @@
+package metahelm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// FieldManager is the field manager used for server-side apply of manifests
+const FieldManager = "metahelm"
+
+// inventoryKey is the ConfigMap data key holding the JSON-encoded inventory of a ManifestStep
+const inventoryKey = "inventory"
+
+// ManifestStep is a graph node that applies plain Kubernetes manifests (a YAML/JSON file, a directory of them or a Kustomize directory)
+// with server-side apply. The applied objects are recorded in an inventory ConfigMap so that objects removed from the manifests
+// are deleted (pruned) on subsequent runs.
+type ManifestStep struct {
+	Title string // unique name for this step (must not collide with any chart or other step)
+	// Location is the local filesystem location of a manifest file or directory. Directories containing a kustomization file are built with Kustomize,
+	// otherwise all .yaml, .yml and .json files in the directory (not recursive) are applied.
+	Location string
+	// InventoryName is the name of the ConfigMap used to store the inventory of applied objects. If empty, ManifestInventoryName("", Title) is used.
+	InventoryName string
+	// WaitUntilReady waits until all applied resources are ready, using the same criteria as Helm (equivalent to WaitUntilHelmSaysItsReady for charts).
+	// This overrides WaitUntilDeployment and DeploymentHealthIndication.
+	WaitUntilReady             bool
+	WaitUntilDeployment        string           // Deployment name that, when healthy, indicates the manifests have been applied successfully
+	WaitTimeout                time.Duration    // how long to wait for the deployment to become healthy. If unset, DefaultDeploymentTimeout is used
+	DeploymentHealthIndication HealthIndication // How to determine if a deployment is healthy
+	DependencyList             []string
+	StartPriority              int            // steps with higher priority are started first within a graph level
+	ResourceTokens             map[string]int // tokens of shared resources held while applying the manifests (see WithResourceLimits)
+}
+
+var _ Step = &ManifestStep{}
+
+func (ms *ManifestStep) Name() string {
+	return ms.Title
+}
+
+func (ms *ManifestStep) String() string {
+	return fmt.Sprintf("\"%v\"", ms.Title)
+}
+
+func (ms *ManifestStep) Dependencies() []string {
+	return ms.DependencyList
+}
+
+func (ms *ManifestStep) Priority() int {
+	return ms.StartPriority
+}
+
+func (ms *ManifestStep) Resources() map[string]int {
+	return ms.ResourceTokens
+}
+
+// ManifestInventoryName returns the name of the inventory ConfigMap for a ManifestStep with title (installed with releaseNamePrefix)
+func ManifestInventoryName(releaseNamePrefix, title string) string {
+	parts := []string{"metahelm-inventory"}
+	for _, p := range []string{releaseNamePrefix, title} {
+		if sp := sanitizeName(p); sp != "" {
+			parts = append(parts, sp)
+		}
+	}
+	n := strings.Join(parts, ".")
+	if len(n) > 253 {
+		n = n[:253]
+	}
+	return n
+}
+
+// ObjectRef identifies a Kubernetes object in a manifest inventory
+type ObjectRef struct {
+	APIVersion string `json:"api_version"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+}
+
+func (or ObjectRef) String() string {
+	if or.Namespace == "" {
+		return or.Kind + "/" + or.Name
+	}
+	return or.Kind + "/" + or.Namespace + "/" + or.Name
+}
+
+// Run renders and applies the manifests, prunes objects that were applied previously but are no longer present, records the inventory and
+// then waits for health. If the manifests do not become healthy, a ChartError is returned with the failed pods of the applied workloads.
+func (ms *ManifestStep) Run(ctx context.Context, m *Manager, namespace string) error {
+	objs, err := RenderManifests(ms.Location)
+	if err != nil {
+		return err
+	}
+	dc, mapper, err := m.dynamicClient()
+	if err != nil {
+		return err
+	}
+	timeout := ms.WaitTimeout
+	if timeout == 0 {
+		timeout = DefaultDeploymentTimeout
+	}
+	invname := ms.InventoryName
+	if invname == "" {
+		invname = ManifestInventoryName("", ms.Title)
+	}
+	prev, err := m.getInventory(ctx, namespace, invname)
+	if err != nil {
+		return err
+	}
+	m.log("%v: applying %v objects", ms.Title, len(objs))
+	inv := []ObjectRef{}
+	crds := []string{}
+	for _, obj := range objs {
+		if obj.GetKind() != crdKind && len(crds) > 0 {
+			// CRDs are ordered first; they must be served before custom resources can be applied
+			if err := m.waitForCRDs(ctx, ms.Title, crds, timeout); err != nil {
+				return err
+			}
+			crds = nil
+		}
+		ref, err := applyObject(ctx, dc, mapper, namespace, obj)
+		if err != nil {
+			// record what has been applied so far so those objects can still be pruned later
+			if err2 := m.saveInventory(ctx, namespace, invname, mergeInventory(inv, prev)); err2 != nil {
+				m.log("%v: error saving inventory: %v", ms.Title, err2)
+			}
+			return err
+		}
+		inv = append(inv, ref)
+		if obj.GetKind() == crdKind {
+			crds = append(crds, obj.GetName())
+		}
+	}
+	if err := m.waitForCRDs(ctx, ms.Title, crds, timeout); err != nil {
+		return err
+	}
+	current := map[ObjectRef]struct{}{}
+	for _, ref := range inv {
+		current[ref] = struct{}{}
+	}
+	// delete in reverse order of application
+	for i := len(prev) - 1; i >= 0; i-- {
+		if _, ok := current[prev[i]]; ok {
+			continue
+		}
+		m.log("%v: pruning %v", ms.Title, prev[i])
+		if err := deleteObject(ctx, dc, mapper, prev[i]); err != nil {
+			if err2 := m.saveInventory(ctx, namespace, invname, mergeInventory(inv, prev[:i+1])); err2 != nil {
+				m.log("%v: error saving inventory: %v", ms.Title, err2)
+			}
+			return errors.Wrapf(err, "error pruning %v", prev[i])
+		}
+	}
+	if err := m.saveInventory(ctx, namespace, invname, inv); err != nil {
+		return err
+	}
+	m.log("%v: manifests applied; waiting for health", ms.Title)
+	if err := m.waitForManifests(ctx, ms, objs, namespace, timeout); err != nil {
+		ce := NewChartError(err)
+		workloads := [][2]string{}
+		for _, ref := range inv {
+			if ref.Namespace == namespace {
+				workloads = append(workloads, [2]string{ref.Kind, ref.Name})
+			}
+		}
+		if err2 := ce.populateFromWorkloads(ctx, namespace, workloads, m.K8c, MaxPodLogLines); err2 != nil {
+			m.log("error populating chart error from manifests: %v", err2)
+			return errors.Wrap(err, "error waiting for manifests")
+		}
+		return ce
+	}
+	return nil
+}
+
+func (m *Manager) waitForManifests(ctx context.Context, ms *ManifestStep, objs []*unstructured.Unstructured, namespace string, timeout time.Duration) error {
+	defer m.log("%v: done", ms.Title)
+	if ms.WaitUntilReady {
+		buf := &bytes.Buffer{}
+		for _, obj := range objs {
+			b, err := json.Marshal(obj)
+			if err != nil {
+				return errors.Wrap(err, "error marshaling object")
+			}
+			buf.WriteString("---\n")
+			buf.Write(b)
+			buf.WriteString("\n")
+		}
+		rl, err := m.HCfg.KubeClient.Build(buf, false)
+		if err != nil {
+			return errors.Wrap(err, "error building resources")
+		}
+		return m.HCfg.KubeClient.Wait(rl, timeout)
+	}
+	if ms.DeploymentHealthIndication == IgnorePodHealth || ms.WaitUntilDeployment == "" {
+		m.log("%v: IgnorePodHealth, no health check needed", ms.Title)
+		return nil
+	}
+	return m.waitForDeployment(ctx, ms.Title, ms.WaitUntilDeployment, ms.DeploymentHealthIndication, namespace, timeout)
+}
+
+// RenderManifests reads and decodes the manifests at location (a file, a directory or a Kustomize directory). Namespaces and CustomResourceDefinitions
+// are ordered first; otherwise the order of the manifests is preserved.
+func RenderManifests(location string) ([]*unstructured.Unstructured, error) {
+	fi, err := os.Stat(location)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading manifest location")
+	}
+	var docs []byte
+	switch {
+	case !fi.IsDir():
+		docs, err = ioutil.ReadFile(location)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading manifest")
+		}
+	case isKustomization(location):
+		k := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+		rm, err := k.Run(filesys.MakeFsOnDisk(), location)
+		if err != nil {
+			return nil, errors.Wrap(err, "error running kustomize")
+		}
+		docs, err = rm.AsYaml()
+		if err != nil {
+			return nil, errors.Wrap(err, "error rendering kustomization")
+		}
+	default:
+		entries, err := ioutil.ReadDir(location)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading manifest directory")
+		}
+		for _, e := range entries {
+			switch strings.ToLower(filepath.Ext(e.Name())) {
+			case ".yaml", ".yml", ".json":
+			default:
+				continue
+			}
+			if e.IsDir() {
+				continue
+			}
+			b, err := ioutil.ReadFile(filepath.Join(location, e.Name()))
+			if err != nil {
+				return nil, errors.Wrap(err, "error reading manifest")
+			}
+			docs = append(docs, []byte("\n---\n")...)
+			docs = append(docs, b...)
+		}
+	}
+	objs := []*unstructured.Unstructured{}
+	dec := yamlutil.NewYAMLOrJSONDecoder(bytes.NewReader(docs), 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := dec.Decode(&obj.Object); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.Wrap(err, "error decoding manifest")
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+		if obj.GetKind() == "" || obj.GetAPIVersion() == "" || obj.GetName() == "" {
+			return nil, fmt.Errorf("manifest object is missing apiVersion, kind or name: %v", obj.Object)
+		}
+		if obj.IsList() {
+			return nil, fmt.Errorf("lists are not supported in manifests: %v", obj.GetKind())
+		}
+		objs = append(objs, obj)
+	}
+	sort.SliceStable(objs, func(i, j int) bool { return applyPriority(objs[i]) < applyPriority(objs[j]) })
+	return objs, nil
+}
+
+func isKustomization(dir string) bool {
+	for _, fn := range []string{"kustomization.yaml", "kustomization.yml", "Kustomization"} {
+		if _, err := os.Stat(filepath.Join(dir, fn)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func applyPriority(obj *unstructured.Unstructured) int {
+	switch obj.GetKind() {
+	case "Namespace":
+		return 0
+	case "CustomResourceDefinition":
+		return 1
+	}
+	return 2
+}
+
+// resourceFor returns the dynamic resource interface for objects of apiVersion and kind in namespace (ignored for cluster-scoped resources),
+// and whether the resource is namespaced
+func resourceFor(dc dynamic.Interface, mapper meta.RESTMapper, apiVersion, kind, namespace string) (dynamic.ResourceInterface, bool, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "error parsing api version")
+	}
+	mapping, err := mapper.RESTMapping(schema.GroupKind{Group: gv.Group, Kind: kind}, gv.Version)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "error getting resource mapping for %v %v", apiVersion, kind)
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		return dc.Resource(mapping.Resource).Namespace(namespace), true, nil
+	}
+	return dc.Resource(mapping.Resource), false, nil
+}
+
+// applyObject applies obj with server-side apply, defaulting the namespace of namespaced objects to namespace
+func applyObject(ctx context.Context, dc dynamic.Interface, mapper meta.RESTMapper, namespace string, obj *unstructured.Unstructured) (ObjectRef, error) {
+	ns := obj.GetNamespace()
+	if ns == "" {
+		ns = namespace
+	}
+	ri, namespaced, err := resourceFor(dc, mapper, obj.GetAPIVersion(), obj.GetKind(), ns)
+	if err != nil {
+		return ObjectRef{}, err
+	}
+	ref := ObjectRef{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind(), Name: obj.GetName()}
+	if namespaced {
+		obj.SetNamespace(ns)
+		ref.Namespace = ns
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return ObjectRef{}, errors.Wrap(err, "error marshaling object")
+	}
+	force := true
+	if _, err := ri.Patch(ctx, obj.GetName(), types.ApplyPatchType, b, metav1.PatchOptions{FieldManager: FieldManager, Force: &force}); err != nil {
+		return ObjectRef{}, errors.Wrapf(err, "error applying %v", ref)
+	}
+	return ref, nil
+}
+
+// deleteObject deletes the object identified by ref. Objects that no longer exist (or whose kind no longer exists) are ignored.
+func deleteObject(ctx context.Context, dc dynamic.Interface, mapper meta.RESTMapper, ref ObjectRef) error {
+	ri, _, err := resourceFor(dc, mapper, ref.APIVersion, ref.Kind, ref.Namespace)
+	if err != nil {
+		if meta.IsNoMatchError(errors.Cause(err)) {
+			return nil
+		}
+		return err
+	}
+	bg := metav1.DeletePropagationBackground
+	if err := ri.Delete(ctx, ref.Name, metav1.DeleteOptions{PropagationPolicy: &bg}); err != nil && !kerrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// mergeInventory returns the refs in a followed by those in b that are not in a
+func mergeInventory(a, b []ObjectRef) []ObjectRef {
+	seen := map[ObjectRef]struct{}{}
+	out := []ObjectRef{}
+	for _, refs := range [][]ObjectRef{a, b} {
+		for _, ref := range refs {
+			if _, ok := seen[ref]; ok {
+				continue
+			}
+			seen[ref] = struct{}{}
+			out = append(out, ref)
+		}
+	}
+	return out
+}
+
+func (m *Manager) getInventory(ctx context.Context, namespace, name string) ([]ObjectRef, error) {
+	cm, err := m.K8c.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error getting inventory")
+	}
+	inv := []ObjectRef{}
+	if err := json.Unmarshal([]byte(cm.Data[inventoryKey]), &inv); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling inventory: %v", name)
+	}
+	return inv, nil
+}
+
+func (m *Manager) saveInventory(ctx context.Context, namespace, name string, inv []ObjectRef) error {
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling inventory")
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{ManagedByLabel: ManagedByValue},
+		},
+		Data: map[string]string{inventoryKey: string(b)},
+	}
+	cmi := m.K8c.CoreV1().ConfigMaps(namespace)
+	if _, err := cmi.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		if !kerrors.IsNotFound(err) {
+			return errors.Wrap(err, "error updating inventory")
+		}
+		if _, err := cmi.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return errors.Wrap(err, "error creating inventory")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package metahelm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynfake "k8s.io/client-go/dynamic/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+var (
+	cmGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	nsGVR = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+)
+
+// fakeApplyDynamicClient returns a fake dynamic client that supports server-side apply patches (by creating or replacing the object)
+func fakeApplyDynamicClient() *dynfake.FakeDynamicClient {
+	dc := dynfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		crdGVR: "CustomResourceDefinitionList",
+		cmGVR:  "ConfigMapList",
+		nsGVR:  "NamespaceList",
+	})
+	dc.PrependReactor("patch", "*", func(action ktesting.Action) (bool, runtime.Object, error) {
+		pa := action.(ktesting.PatchAction)
+		if pa.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(pa.GetPatch()); err != nil {
+			return true, nil, err
+		}
+		tracker := dc.Tracker()
+		if _, err := tracker.Get(pa.GetResource(), pa.GetNamespace(), pa.GetName()); err != nil {
+			if !kerrors.IsNotFound(err) {
+				return true, nil, err
+			}
+			return true, obj, tracker.Create(pa.GetResource(), obj, pa.GetNamespace())
+		}
+		return true, obj, tracker.Update(pa.GetResource(), obj, pa.GetNamespace())
+	})
+	return dc
+}
+
+func testManifestRESTMapper() meta.RESTMapper {
+	rm := testRESTMapper().(*meta.DefaultRESTMapper)
+	rm.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	rm.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	return rm
+}
+
+func TestRenderManifests(t *testing.T) {
+	objs, err := RenderManifests("testdata/manifests")
+	if err != nil {
+		t.Fatalf("error rendering manifests: %v", err)
+	}
+	if len(objs) != 3 {
+		t.Fatalf("bad length: %v", len(objs))
+	}
+	if objs[0].GetKind() != "Namespace" || objs[1].GetName() != "foo" || objs[2].GetName() != "bar" {
+		t.Fatalf("bad order: %v, %v, %v", objs[0].GetName(), objs[1].GetName(), objs[2].GetName())
+	}
+	objs, err = RenderManifests("testdata/kustomize")
+	if err != nil {
+		t.Fatalf("error rendering kustomization: %v", err)
+	}
+	if len(objs) != 1 {
+		t.Fatalf("bad kustomization length: %v", len(objs))
+	}
+	if objs[0].GetName() != "prod-foo" || objs[0].GetLabels()["env"] != "prod" {
+		t.Fatalf("kustomization not applied: %v", objs[0].Object)
+	}
+	if _, err := RenderManifests("testdata/missing"); err == nil {
+		t.Fatalf("should have failed with missing location")
+	}
+}
+
+func TestManifestStep(t *testing.T) {
+	ns := "foo"
+	fkc := fakeKubernetesClientset(t, ns, nil)
+	dc := fakeApplyDynamicClient()
+	m := Manager{
+		LogF:       t.Logf,
+		K8c:        fkc,
+		HCfg:       fakeHelmConfiguration(t),
+		Dynamic:    dc,
+		RESTMapper: testManifestRESTMapper(),
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	ms := &ManifestStep{
+		Title:         "config",
+		Location:      "testdata/manifests",
+		InventoryName: ManifestInventoryName("pfx-", "config"),
+		WaitTimeout:   5 * time.Second,
+	}
+	if err := ms.Run(context.Background(), &m, ns); err != nil {
+		t.Fatalf("error running manifest step: %v", err)
+	}
+	for _, n := range []string{"foo", "bar"} {
+		if _, err := dc.Resource(cmGVR).Namespace(ns).Get(context.Background(), n, metav1.GetOptions{}); err != nil {
+			t.Fatalf("configmap should have been applied: %v: %v", n, err)
+		}
+	}
+	if _, err := dc.Resource(nsGVR).Get(context.Background(), "manifests", metav1.GetOptions{}); err != nil {
+		t.Fatalf("namespace should have been applied: %v", err)
+	}
+	inv, err := m.getInventory(context.Background(), ns, ms.InventoryName)
+	if err != nil {
+		t.Fatalf("error getting inventory: %v", err)
+	}
+	if len(inv) != 3 || inv[0] != (ObjectRef{APIVersion: "v1", Kind: "Namespace", Name: "manifests"}) {
+		t.Fatalf("bad inventory: %+v", inv)
+	}
+	// applying again is idempotent
+	if err := ms.Run(context.Background(), &m, ns); err != nil {
+		t.Fatalf("error running manifest step again: %v", err)
+	}
+	// replacing the manifests prunes the objects that are no longer present
+	ms.Location = "testdata/kustomize"
+	if err := ms.Run(context.Background(), &m, ns); err != nil {
+		t.Fatalf("error running manifest step with kustomization: %v", err)
+	}
+	if _, err := dc.Resource(cmGVR).Namespace(ns).Get(context.Background(), "prod-foo", metav1.GetOptions{}); err != nil {
+		t.Fatalf("kustomized configmap should have been applied: %v", err)
+	}
+	for _, n := range []string{"foo", "bar"} {
+		if _, err := dc.Resource(cmGVR).Namespace(ns).Get(context.Background(), n, metav1.GetOptions{}); !kerrors.IsNotFound(err) {
+			t.Fatalf("configmap should have been pruned: %v: %v", n, err)
+		}
+	}
+	if _, err := dc.Resource(nsGVR).Get(context.Background(), "manifests", metav1.GetOptions{}); !kerrors.IsNotFound(err) {
+		t.Fatalf("namespace should have been pruned: %v", err)
+	}
+	inv, err = m.getInventory(context.Background(), ns, ms.InventoryName)
+	if err != nil {
+		t.Fatalf("error getting inventory: %v", err)
+	}
+	if len(inv) != 1 || inv[0].Name != "prod-foo" || inv[0].Namespace != ns {
+		t.Fatalf("bad inventory after prune: %+v", inv)
+	}
+}
+
+func TestManifestStepHealth(t *testing.T) {
+	ns := "foo"
+	charts := []Chart{Chart{Title: "web"}}
+	fkc := fakeKubernetesClientset(t, ns, charts)
+	m := Manager{
+		LogF:       t.Logf,
+		K8c:        fkc,
+		HCfg:       fakeHelmConfiguration(t),
+		Dynamic:    fakeApplyDynamicClient(),
+		RESTMapper: testManifestRESTMapper(),
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	ms := &ManifestStep{
+		Title:                      "config",
+		Location:                   "testdata/manifests",
+		WaitUntilDeployment:        "web",
+		DeploymentHealthIndication: AllPodsHealthy,
+		WaitTimeout:                2 * time.Second,
+	}
+	if err := ms.Run(context.Background(), &m, ns); err != nil {
+		t.Fatalf("manifests should have been healthy: %v", err)
+	}
+	ms.WaitUntilDeployment = "missing"
+	if err := ms.Run(context.Background(), &m, ns); err == nil {
+		t.Fatalf("manifests should not have been healthy")
+	}
+}
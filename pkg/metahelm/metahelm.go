@@ -5,17 +5,18 @@ import (
 	"fmt"
 	"math/rand"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/graphext/metahelm/pkg/dag"
 	"github.com/pkg/errors"
 	"helm.sh/helm/v3/pkg/action"
-	"helm.sh/helm/v3/pkg/chart/loader"
-	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	appsv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
 	batchv1 "k8s.io/client-go/kubernetes/typed/batch/v1"
@@ -38,6 +39,10 @@ type Manager struct {
 	K8c  kubernetes.Interface
 	HCfg *action.Configuration
 	LogF LogFunc
+	// Dynamic and RESTMapper are used by steps that operate on arbitrary resources (eg, WaitForResource).
+	// If not set, they are obtained from the RESTClientGetter of HCfg.
+	Dynamic    dynamic.Interface
+	RESTMapper meta.RESTMapper
 }
 
 func (m *Manager) log(msg string, args ...interface{}) {
@@ -48,9 +53,16 @@ func (m *Manager) log(msg string, args ...interface{}) {
 
 type options struct {
 	k8sNamespace, releaseNamePrefix string
+	graphName                       string
 	installCallback                 InstallCallback
 	completedCallback               CompletedCallback
 	timeout                         time.Duration
+	steps                           []Step
+	pendingPolicy                   PendingReleasePolicy
+	helmDefaults                    HelmOptions
+	concurrency                     int
+	resourceLimits                  map[string]int
+	ageKeyFile                      string
 }
 
 type InstallOption func(*options)
@@ -69,6 +81,15 @@ func WithReleaseNamePrefix(pfx string) InstallOption {
 	}
 }
 
+// WithGraphName specifies the name of the chart graph. When set, metahelm records the state of the graph (charts and release names) in a ConfigMap
+// in the graph namespace after each install or upgrade, which allows installed graphs to be discovered with ListGraphs. Failing to record the state is
+// logged, and doesn't fail the install or upgrade.
+func WithGraphName(name string) InstallOption {
+	return func(op *options) {
+		op.graphName = name
+	}
+}
+
 // WithTimeout sets a timeout for all chart installations/upgrades to complete. If the timeout is reached, chart operations are aborted and an error is returned.
 func WithTimeout(timeout time.Duration) InstallOption {
 	return func(op *options) {
@@ -76,6 +97,23 @@ func WithTimeout(timeout time.Duration) InstallOption {
 	}
 }
 
+// WithConcurrency limits the number of charts and steps installed at once (zero means no limit). Within a graph level, they are started
+// by descending priority (see Chart.StartPriority), then by title.
+func WithConcurrency(n int) InstallOption {
+	return func(op *options) {
+		op.concurrency = n
+	}
+}
+
+// WithResourceLimits specifies the number of tokens of each shared resource used by charts and steps (see Chart.ResourceTokens). A chart
+// is only installed when the tokens it needs are available, so charts using the same resource don't run concurrently beyond its limit.
+// Resources without a limit have one token.
+func WithResourceLimits(limits map[string]int) InstallOption {
+	return func(op *options) {
+		op.resourceLimits = limits
+	}
+}
+
 // WithInstallCallback specifies a callback function that will be invoked immediately prior to each chart installation
 func WithInstallCallback(cb InstallCallback) InstallOption {
 	return func(op *options) {
@@ -107,6 +145,7 @@ const (
 type InstallCallback func(Chart) InstallCallbackAction
 
 // CompletedCallback is a function that is called upon completion of each individual chart upgrade/install. The error returned by Helm (if any) will be included.
+// If the chart has a retry policy, it is called after each attempt, and failed attempts that will be retried have an error of type AttemptError.
 // This will be called concurrently from multiple goroutines, so make sure everything is threadsafe. Also make sure to return promptly, as execution will block waiting for the callback to complete.
 type CompletedCallback func(Chart, error)
 
@@ -145,10 +184,11 @@ func (m *Manager) Upgrade(ctx context.Context, rmap ReleaseMap, charts []Chart,
 }
 
 // releaseName returns a release name of not more than 53 characters. If the input is truncated, a random number is added to ensure uniqueness.
+// Slashes (eg, in the names of charts of included graphs) are replaced by dashes.
 func ReleaseName(input string) string {
-	rsl := []rune(input)
+	rsl := []rune(strings.ReplaceAll(input, "/", "-"))
 	if len(rsl) < 54 {
-		return input
+		return string(rsl)
 	}
 	out := rsl[0 : 53-6]
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -184,6 +224,9 @@ func (m *Manager) installOrUpgrade(ctx context.Context, upgradeMap ReleaseMap, u
 	if ops.k8sNamespace == "" {
 		ops.k8sNamespace = DefaultK8sNamespace
 	}
+	if err := ops.helmDefaults.Validate(); err != nil {
+		return nil, errors.Wrap(err, "bad default Helm options")
+	}
 	cmap := map[string]*Chart{}
 	objs := []dag.GraphObject{}
 	for i := range charts {
@@ -200,15 +243,37 @@ func (m *Manager) installOrUpgrade(ctx context.Context, upgradeMap ReleaseMap, u
 		default:
 			return nil, fmt.Errorf("unknown value for DeploymentHealthIndication: %v", charts[i].DeploymentHealthIndication)
 		}
+		if err := charts[i].Retry.validate(); err != nil {
+			return nil, errors.Wrapf(err, "bad retry policy for chart: %v", charts[i].Title)
+		}
+		if charts[i].Helm != nil {
+			if err := charts[i].Helm.Validate(); err != nil {
+				return nil, errors.Wrapf(err, "bad Helm options for chart: %v", charts[i].Title)
+			}
+		}
 		cmap[charts[i].Name()] = &charts[i]
 		objs = append(objs, &charts[i])
 	}
+	if err := checkSOPS(charts); err != nil {
+		return nil, err
+	}
+	smap := map[string]Step{}
+	for i, s := range ops.steps {
+		if _, ok := cmap[s.Name()]; ok {
+			return nil, fmt.Errorf("step name collides with chart: %v (offset %v)", s.Name(), i)
+		}
+		if _, ok := smap[s.Name()]; ok {
+			return nil, fmt.Errorf("duplicate step name: %v (offset %v)", s.Name(), i)
+		}
+		smap[s.Name()] = s
+		objs = append(objs, s)
+	}
 	lf := func(msg string, args ...interface{}) {
 		if m.LogF != nil {
 			m.LogF("objgraph: "+msg, args...)
 		}
 	}
-	og := dag.ObjectGraph{LogF: dag.LogFunc(lf)}
+	og := dag.ObjectGraph{LogF: dag.LogFunc(lf), MaxConcurrency: ops.concurrency, ResourceLimits: ops.resourceLimits}
 	if err := og.Build(objs); err != nil {
 		return nil, errors.Wrap(err, "error building graph")
 	}
@@ -219,6 +284,10 @@ func (m *Manager) installOrUpgrade(ctx context.Context, upgradeMap ReleaseMap, u
 		deadline = started.Add(ops.timeout)
 	}
 	af := func(obj dag.GraphObject) error {
+		if s, ok := smap[obj.Name()]; ok {
+			m.log("%v: running step", obj.Name())
+			return s.Run(ctx, m, ops.k8sNamespace)
+		}
 		m.log("%v: starting install", obj.Name())
 	Loop:
 		for {
@@ -233,7 +302,11 @@ func (m *Manager) installOrUpgrade(ctx context.Context, upgradeMap ReleaseMap, u
 				break Loop
 			case Wait:
 				m.log("%v: install callback indicated Wait; delaying", obj.Name())
-				time.Sleep(retryDelay)
+				select {
+				case <-ctx.Done():
+					return errors.New("context was cancelled")
+				case <-time.After(retryDelay):
+				}
 			case Abort:
 				m.log("%v: install callback indicated Abort; aborting", obj.Name())
 				return errors.New("callback requested abort")
@@ -245,83 +318,121 @@ func (m *Manager) installOrUpgrade(ctx context.Context, upgradeMap ReleaseMap, u
 			}
 		}
 		c := cmap[obj.Name()]
-		chart, err := loader.Load(c.Location)
+		ho := ops.helmOptions(c)
+		chart, err := m.loadChart(c.Title, c.Location, ho.DependencyUpdate)
 		if err != nil {
-			return fmt.Errorf("error loading chart from location %s: %w", c.Location, err)
+			return err
 		}
-		vals, err := chartutil.ReadValues(c.ValueOverrides)
+		vals, err := m.chartValues(ctx, c, ops)
 		if err != nil {
-			return fmt.Errorf("error reading value overrides from raw YAML: %w", err)
+			return err
 		}
-		var opstr string
+		var opstr, installed string
 		var exist bool
+		var rel *release.Release
+		relname := ReleaseName(ops.releaseNamePrefix + c.Title)
+		if rn, ok := upgradeMap[c.Title]; ok {
+			relname = rn
+		}
+		if err := m.recoverPendingRelease(relname, ops.pendingPolicy, c.WaitTimeout); err != nil {
+			return err
+		}
 		if upgrade {
 			var err error
-			exist, err = releaseExists(ctx, m.HCfg, ops.k8sNamespace, ops.releaseNamePrefix+c.Title)
+			exist, err = releaseExists(ctx, m.HCfg, ops.k8sNamespace, relname)
 			if err != nil {
 				return errors.Wrap(err, "error error getting release names")
 			}
 		}
 		if upgrade && exist {
-			relname, ok := upgradeMap[c.Title]
-			if !ok {
+			if _, ok := upgradeMap[c.Title]; !ok {
 				return fmt.Errorf("chart not found in release map: %v", c.Title)
 			}
 			opstr = "upgrade"
-			m.log("%v: running helm upgrade", obj.Name())
 			upgrade := action.NewUpgrade(m.HCfg)
 			upgrade.Wait = true
 			upgrade.Timeout = c.WaitTimeout
-			fn := func() error {
-				if _, err := upgrade.RunWithContext(ctx, relname, chart, vals); err != nil {
-					return m.charterror(ctx, err, ops, c, relname, "upgrading")
-				}
-				return nil
+			ho.applyUpgrade(upgrade)
+			op := func() error {
+				m.log("%v: running helm upgrade", obj.Name())
+				return wrapper(ctx, func() error {
+					rel, err = upgrade.RunWithContext(ctx, relname, chart, vals)
+					if err != nil {
+						return m.charterror(ctx, err, ops, c, relname, "upgrading")
+					}
+					return nil
+				})
 			}
-			if err := wrapper(ctx, fn); err != nil {
+			cleanup := func() error { return m.cleanupFailedUpgrade(relname, c.WaitTimeout) }
+			if err := m.withRetries(ctx, c, ops, opstr, op, cleanup); err != nil {
 				return err
 			}
-			if ops.completedCallback != nil {
-				m.log("%v: running completed callback", obj.Name())
-				ops.completedCallback(*cmap[obj.Name()], err)
-			}
-			if err != nil {
-				return m.charterror(ctx, err, ops, c, relname, "upgrading")
-			}
+			og.Started(obj.Name())
+			installed = relname
+			rn.Lock()
+			rn.rmap[c.Title] = relname
+			rn.Unlock()
 		} else {
 			opstr = "installation"
-			m.log("%v: running helm install", obj.Name())
 			install := action.NewInstall(m.HCfg)
 			install.Wait = true
-			install.ReleaseName = ReleaseName(ops.releaseNamePrefix + c.Title)
+			install.ReleaseName = relname
 			install.Namespace = ops.k8sNamespace
 			install.Timeout = c.WaitTimeout
-			var release *release.Release
-			fn := func() error {
-				release, err = install.RunWithContext(ctx, chart, vals)
-				if err != nil {
-					return m.charterror(ctx, err, ops, c, install.ReleaseName, "installing")
-				}
-				return nil
+			ho.applyInstall(install)
+			op := func() error {
+				m.log("%v: running helm install", obj.Name())
+				return wrapper(ctx, func() error {
+					rel, err = install.RunWithContext(ctx, chart, vals)
+					if err != nil {
+						return m.charterror(ctx, err, ops, c, install.ReleaseName, "installing")
+					}
+					return nil
+				})
 			}
-			if err := wrapper(ctx, fn); err != nil {
+			existed := m.releaseStored(install.ReleaseName)
+			cleanup := func() error { return m.cleanupFailedInstall(install.ReleaseName, existed) }
+			if err := m.withRetries(ctx, c, ops, opstr, op, cleanup); err != nil {
 				return err
 			}
-			if ops.completedCallback != nil {
-				m.log("%v: running completed callback", obj.Name())
-				ops.completedCallback(*cmap[obj.Name()], err)
-			}
-			if err != nil {
-				return m.charterror(ctx, err, ops, c, install.ReleaseName, "installing")
-			}
+			og.Started(obj.Name())
+			installed = rel.Name
 			rn.Lock()
-			rn.rmap[c.Title] = release.Name
+			rn.rmap[c.Title] = rel.Name
 			rn.Unlock()
 		}
+		if err := m.waitForCRDs(ctx, c.Title, releaseCRDs(rel, ho.SkipCRDs), c.WaitTimeout); err != nil {
+			return err
+		}
 		m.log("%v: %v complete; waiting for health", opstr, obj.Name())
-		return m.waitForChart(ctx, c, ops.k8sNamespace)
+		if err := m.waitForChart(ctx, c, ops.k8sNamespace); err != nil {
+			return err
+		}
+		if c.RunHelmTests {
+			return m.runHelmTests(ctx, c, installed)
+		}
+		return nil
+	}
+	var dmtx sync.Mutex
+	durations := map[string]time.Duration{}
+	timed := func(obj dag.GraphObject) error {
+		t0 := time.Now()
+		if err := af(obj); err != nil {
+			return err
+		}
+		dmtx.Lock()
+		durations[obj.Name()] = time.Since(t0)
+		dmtx.Unlock()
+		return nil
+	}
+	err := og.Walk(ctx, timed)
+	if ops.graphName != "" {
+		// the charts are installed regardless, so a failure to record the state (eg, without permission on ConfigMaps) is only logged
+		if err2 := m.recordGraphState(ctx, ops, charts, rn.rmap, durations); err2 != nil {
+			m.log("warning: error recording graph state: %v", err2)
+		}
 	}
-	if err := og.Walk(ctx, af); err != nil {
+	if err != nil {
 		werr, ok := err.(dag.WalkError)
 		if !ok {
 			// shouldn't be possible
@@ -372,18 +483,23 @@ func (m *Manager) waitForChart(ctx context.Context, c *Chart, ns string) error {
 		m.log("%v: IgnorePodHealth, no health check needed", c.Name())
 		return nil
 	}
-	return wait.Poll(ChartWaitPollInterval, c.WaitTimeout, func() (bool, error) {
-		d, err := m.K8c.AppsV1().Deployments(ns).Get(ctx, c.WaitUntilDeployment, metav1.GetOptions{})
+	return m.waitForDeployment(ctx, c.Name(), c.WaitUntilDeployment, c.DeploymentHealthIndication, ns, c.WaitTimeout)
+}
+
+// waitForDeployment polls until deployment is healthy according to dhi, logging with title as prefix
+func (m *Manager) waitForDeployment(ctx context.Context, title, deployment string, dhi HealthIndication, ns string, timeout time.Duration) error {
+	return wait.PollImmediateWithContext(ctx, ChartWaitPollInterval, timeout, func(ctx context.Context) (bool, error) {
+		d, err := m.K8c.AppsV1().Deployments(ns).Get(ctx, deployment, metav1.GetOptions{})
 		if err != nil || d.Spec.Replicas == nil {
-			m.log("%v: error getting deployment (retrying): %v", c.Name(), err)
+			m.log("%v: error getting deployment (retrying): %v", title, err)
 			return false, nil // the deployment may not initially exist immediately after installing chart
 		}
 		if d.Spec.Replicas != nil {
 			needed := 1
-			if c.DeploymentHealthIndication == AllPodsHealthy {
+			if dhi == AllPodsHealthy {
 				needed = int(*d.Spec.Replicas)
 			}
-			m.log("%v: %v ready replicas, %v needed", c.Name(), d.Status.ReadyReplicas, needed)
+			m.log("%v: %v ready replicas, %v needed", title, d.Status.ReadyReplicas, needed)
 			return int(d.Status.ReadyReplicas) >= needed, nil
 		}
 		return false, nil
@@ -406,9 +522,10 @@ func releaseExists(ctx context.Context, cfg *action.Configuration, namespace str
 	return false, nil
 }
 
-// ValidateCharts verifies that a set of charts is constructed properly, particularly with respect
-// to dependencies. It does not check to see if the referenced charts exist in the local filesystem.
-func ValidateCharts(charts []Chart) error {
+// ValidateCharts verifies that a set of charts (and optionally non-chart steps) is constructed properly, particularly with respect
+// to dependencies. It does not check to see if the referenced charts exist in the local filesystem, or if the tools needed to install them
+// (such as sops) are available.
+func ValidateCharts(charts []Chart, steps ...Step) error {
 	objs := []dag.GraphObject{}
 	for i := range charts {
 		if charts[i].Title == "" {
@@ -424,8 +541,35 @@ func ValidateCharts(charts []Chart) error {
 		default:
 			return fmt.Errorf("unknown value for DeploymentHealthIndication at offset %v: %v", i, charts[i].DeploymentHealthIndication)
 		}
+		if err := charts[i].Retry.validate(); err != nil {
+			return errors.Wrapf(err, "bad retry policy at offset %v", i)
+		}
+		if charts[i].Helm != nil {
+			if err := charts[i].Helm.Validate(); err != nil {
+				return errors.Wrapf(err, "bad Helm options at offset %v", i)
+			}
+		}
+		for j, vs := range charts[i].ValuesFrom {
+			if err := vs.Validate(); err != nil {
+				return errors.Wrapf(err, "bad values source %v at offset %v", j, i)
+			}
+		}
 		objs = append(objs, &charts[i])
 	}
+	names := map[string]struct{}{}
+	for _, c := range charts {
+		names[c.Title] = struct{}{}
+	}
+	for i, s := range steps {
+		if s.Name() == "" {
+			return fmt.Errorf("empty step name at offset %v", i)
+		}
+		if _, ok := names[s.Name()]; ok {
+			return fmt.Errorf("duplicate step name at offset %v: %v", i, s.Name())
+		}
+		names[s.Name()] = struct{}{}
+		objs = append(objs, s)
+	}
 	og := dag.ObjectGraph{}
 	if err := og.Build(objs); err != nil {
 		return errors.Wrap(err, "error building graph from charts")
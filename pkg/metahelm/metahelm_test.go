@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -124,6 +125,11 @@ func gentestobjs(namespace string, charts []Chart) []runtime.Object {
 
 // testKubeClient is a stub helm v3 internal kube client for testing purposes
 type testKubeClient struct {
+	// watchErr is returned by WatchUntilReady (used to simulate failing hooks)
+	watchErr error
+	// waitErrs are returned by successive calls to Wait (used to simulate failing installs)
+	waitErrs []error
+	sync.Mutex
 }
 
 var _ kube.Interface = &testKubeClient{}
@@ -133,7 +139,14 @@ func (tkc *testKubeClient) Create(resources kube.ResourceList) (*kube.Result, er
 }
 
 func (tkc *testKubeClient) Wait(resources kube.ResourceList, timeout time.Duration) error {
-	return nil
+	tkc.Lock()
+	defer tkc.Unlock()
+	if len(tkc.waitErrs) == 0 {
+		return nil
+	}
+	err := tkc.waitErrs[0]
+	tkc.waitErrs = tkc.waitErrs[1:]
+	return err
 }
 
 func (tkc *testKubeClient) WaitWithJobs(resources kube.ResourceList, timeout time.Duration) error {
@@ -145,7 +158,7 @@ func (tkc *testKubeClient) Delete(resources kube.ResourceList) (*kube.Result, []
 }
 
 func (tkc *testKubeClient) WatchUntilReady(resources kube.ResourceList, timeout time.Duration) error {
-	return nil
+	return tkc.watchErr
 }
 
 func (tkc *testKubeClient) Update(original, target kube.ResourceList, force bool) (*kube.Result, error) {
@@ -326,6 +339,57 @@ func TestGraphInstallWaitCallback(t *testing.T) {
 	}
 }
 
+func TestGraphInstallCancelled(t *testing.T) {
+	charts := []Chart{
+		Chart{
+			Title:                      "redis",
+			Location:                   "testdata/chart",
+			DeploymentHealthIndication: IgnorePodHealth,
+		},
+		Chart{
+			Title:                      "app",
+			Location:                   "testdata/chart",
+			DependencyList:             []string{"redis"},
+			WaitUntilDeployment:        "app",
+			DeploymentHealthIndication: AtLeastOnePodHealthy,
+			WaitTimeout:                time.Minute,
+		},
+	}
+	cfg := fakeHelmConfiguration(t)
+	m := Manager{
+		LogF: t.Logf,
+		// the app deployment never appears, so its health wait only ends on cancellation
+		K8c:  fakeKubernetesClientset(t, DefaultK8sNamespace, nil),
+		HCfg: cfg,
+	}
+	ChartWaitPollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cb := func(c Chart, err error) {
+		if c.Title == "redis" {
+			time.AfterFunc(100*time.Millisecond, cancel)
+		}
+	}
+	t0 := time.Now()
+	if _, err := m.Install(ctx, charts, WithGraphName("app"), WithCompletedCallback(cb)); err == nil {
+		t.Fatalf("install should have been cancelled")
+	}
+	if d := time.Since(t0); d > 30*time.Second {
+		t.Fatalf("install should have stopped waiting on cancellation (took %v)", d)
+	}
+	gs, err := m.GetGraphState(context.Background(), DefaultK8sNamespace, "app", "")
+	if err != nil || gs == nil {
+		t.Fatalf("graph state should have been recorded: %v", err)
+	}
+	titles := []string{}
+	for _, cs := range gs.Charts {
+		titles = append(titles, cs.Title)
+	}
+	if strings.Join(titles, ",") != "redis,app" {
+		t.Fatalf("bad recorded charts: %v", titles)
+	}
+}
+
 func TestGraphInstallAbortCallback(t *testing.T) {
 	fkc := fakeKubernetesClientset(t, DefaultK8sNamespace, testCharts)
 	cfg := fakeHelmConfiguration(t)
@@ -435,6 +499,14 @@ func TestValidateCharts(t *testing.T) {
 	if err := ValidateCharts(charts); err == nil {
 		t.Fatalf("should have failed with unknown dependency")
 	}
+	charts[3].DependencyList = []string{"doesntexist:optional"}
+	if err := ValidateCharts(charts); err != nil {
+		t.Fatalf("should have succeeded with absent optional dependency: %v", err)
+	}
+	charts[3].DependencyList = []string{"someservice:eventually"}
+	if err := ValidateCharts(charts); err == nil {
+		t.Fatalf("should have failed with unknown dependency qualifier")
+	}
 }
 
 func TestGraphInstallAndUpgrade(t *testing.T) {
@@ -493,6 +565,37 @@ func TestGraphInstallAndUpgrade(t *testing.T) {
 	}
 }
 
+func TestGraphInstallAndUpgradeSlashTitle(t *testing.T) {
+	ns := "foo"
+	charts := []Chart{
+		Chart{Title: "app", Location: "testdata/chart", DeploymentHealthIndication: IgnorePodHealth, DependencyList: []string{"data/mysql"}},
+		Chart{Title: "data/mysql", Location: "testdata/chart", DeploymentHealthIndication: IgnorePodHealth},
+	}
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fakeKubernetesClientset(t, ns, charts),
+		HCfg: fakeHelmConfiguration(t),
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	um, err := m.Install(context.Background(), charts, WithK8sNamespace(ns))
+	if err != nil {
+		t.Fatalf("error installing: %v", err)
+	}
+	if um["data/mysql"] != "data-mysql" {
+		t.Fatalf("bad release name: %v", um["data/mysql"])
+	}
+	if err := m.Upgrade(context.Background(), um, charts, WithK8sNamespace(ns)); err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	r, err := m.HCfg.Releases.Last("data-mysql")
+	if err != nil {
+		t.Fatalf("error getting release: %v", err)
+	}
+	if r.Version != 2 {
+		t.Fatalf("release should have been upgraded: v%v", r.Version)
+	}
+}
+
 func TestGraphInstallAndUpgradeMissingRelease(t *testing.T) {
 	ns := "foo"
 	prefix := "metahelm-test-prefix-"
@@ -566,4 +669,7 @@ func TestReleaseName(t *testing.T) {
 			}
 		})
 	}
+	if out := ReleaseName("data/mysql"); out != "data-mysql" {
+		t.Fatalf("bad release name for prefixed chart: %v", out)
+	}
 }
@@ -25,11 +25,17 @@ type Chart struct {
 	Title                      string           // unique name for this chart (must not collide with any dependencies)
 	Location                   string           // local filesystem location
 	ValueOverrides             []byte           // value overrides as raw YAML stream
+	ValuesFrom                 []ValuesSource   // values read at install/upgrade time (eg, from Secrets), overriding ValueOverrides in order
 	WaitUntilHelmSaysItsReady  bool             // wait until Helm thinks the chart is ready. This overrides WaitUntilDeployment and DeploymentHealthIndication.
 	WaitUntilDeployment        string           // Deployment name that, when healthy, indicates chart install has succeeded
 	WaitTimeout                time.Duration    // how long to wait for the deployment to become healthy. If unset, DefaultDeploymentTimeout is used
 	DeploymentHealthIndication HealthIndication // How to determine if a deployment is healthy
-	DependencyList             []string
+	RunHelmTests               bool             // run the chart Helm tests (equivalent to "helm test") after the chart is healthy. A failing test fails the chart.
+	Helm                       *HelmOptions     // Helm install/upgrade flags. If nil, the graph defaults (see WithHelmDefaults) are used
+	Retry                      RetryPolicy      // how failed Helm installs/upgrades are retried (by default they aren't)
+	DependencyList             []string         // names of dependencies, optionally qualified (eg, "redis:optional,order-only"; see dag.ParseDependency)
+	StartPriority              int              // charts with higher priority are started first within a graph level (see dag.Prioritizer)
+	ResourceTokens             map[string]int   // tokens of shared resources held while installing the chart (see WithResourceLimits)
 }
 
 func (c *Chart) Name() string {
@@ -43,3 +49,11 @@ func (c *Chart) String() string {
 func (c *Chart) Dependencies() []string {
 	return c.DependencyList
 }
+
+func (c *Chart) Priority() int {
+	return c.StartPriority
+}
+
+func (c *Chart) Resources() map[string]int {
+	return c.ResourceTokens
+}
@@ -0,0 +1,114 @@
+package metahelm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// PendingReleasePolicy determines what is done with a release left in a pending state (pending-install, pending-upgrade or pending-rollback),
+// typically because a previous install or upgrade was interrupted. Helm refuses to operate on such releases.
+type PendingReleasePolicy int
+
+const (
+	// FailOnPending fails the chart with a PendingReleaseError (the default)
+	FailOnPending PendingReleasePolicy = iota
+	// RollbackPending rolls the release back to its last deployed revision before proceeding. If it has never been deployed, it is uninstalled.
+	RollbackPending
+	// ReinstallPending uninstalls the release so that it is installed again from scratch
+	ReinstallPending
+)
+
+// String returns the name of the policy as used on the command line
+func (p PendingReleasePolicy) String() string {
+	switch p {
+	case FailOnPending:
+		return "fail"
+	case RollbackPending:
+		return "rollback"
+	case ReinstallPending:
+		return "reinstall"
+	}
+	return fmt.Sprintf("unknown (%d)", int(p))
+}
+
+// ParsePendingReleasePolicy parses a policy name ("fail", "rollback" or "reinstall")
+func ParsePendingReleasePolicy(s string) (PendingReleasePolicy, error) {
+	for _, p := range []PendingReleasePolicy{FailOnPending, RollbackPending, ReinstallPending} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return FailOnPending, fmt.Errorf("unknown pending release policy: %v", s)
+}
+
+// WithPendingReleasePolicy specifies what to do with releases left in a pending state by an interrupted install or upgrade. FailOnPending is used otherwise.
+func WithPendingReleasePolicy(p PendingReleasePolicy) InstallOption {
+	return func(op *options) {
+		op.pendingPolicy = p
+	}
+}
+
+// PendingReleaseError is returned when a release is in a pending state and the policy is FailOnPending
+type PendingReleaseError struct {
+	ReleaseName string
+	Status      release.Status
+	Revision    int
+}
+
+// Error satisfies the error interface
+func (pre PendingReleaseError) Error() string {
+	return fmt.Sprintf("release %v is in state %v (revision %v), probably because a previous operation was interrupted: roll it back or uninstall it, or use a rollback or reinstall pending release policy",
+		pre.ReleaseName, pre.Status, pre.Revision)
+}
+
+// recoverPendingRelease checks if the release relname is in a pending state and, if so, applies the policy
+func (m *Manager) recoverPendingRelease(relname string, policy PendingReleasePolicy, timeout time.Duration) error {
+	rel, err := m.HCfg.Releases.Last(relname)
+	if err != nil || rel.Info == nil || !rel.Info.Status.IsPending() {
+		return nil // no release or not pending
+	}
+	m.log("%v: release is in state %v (revision %v); pending release policy: %v", relname, rel.Info.Status, rel.Version, policy)
+	switch policy {
+	case FailOnPending:
+		return PendingReleaseError{ReleaseName: relname, Status: rel.Info.Status, Revision: rel.Version}
+	case RollbackPending:
+		hist, err := m.HCfg.Releases.History(relname)
+		if err != nil {
+			return errors.Wrap(err, "error getting release history")
+		}
+		target := 0
+		for _, r := range hist {
+			if r.Info != nil && (r.Info.Status == release.StatusDeployed || r.Info.Status == release.StatusSuperseded) && r.Version > target && r.Version < rel.Version {
+				target = r.Version
+			}
+		}
+		if target == 0 {
+			m.log("%v: no deployed revision to roll back to; uninstalling", relname)
+			return m.uninstallPendingRelease(relname)
+		}
+		m.log("%v: rolling back to revision %v", relname, target)
+		rb := action.NewRollback(m.HCfg)
+		rb.Version = target
+		rb.Wait = true
+		rb.Timeout = timeout
+		if err := rb.Run(relname); err != nil {
+			return errors.Wrap(err, "error rolling back pending release")
+		}
+		return nil
+	case ReinstallPending:
+		return m.uninstallPendingRelease(relname)
+	}
+	return fmt.Errorf("unknown pending release policy: %v", policy)
+}
+
+func (m *Manager) uninstallPendingRelease(relname string) error {
+	m.log("%v: uninstalling pending release", relname)
+	if _, err := action.NewUninstall(m.HCfg).Run(relname); err != nil {
+		return errors.Wrap(err, "error uninstalling pending release")
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package metahelm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// storeReleases stores revisions of the release name with statuses (in order, starting at revision 1)
+func storeReleases(t *testing.T, cfg *action.Configuration, name string, statuses ...release.Status) {
+	t.Helper()
+	chart, err := loader.Load("testdata/chart")
+	if err != nil {
+		t.Fatalf("error loading chart: %v", err)
+	}
+	for i, st := range statuses {
+		rel := &release.Release{
+			Name:      name,
+			Namespace: DefaultK8sNamespace,
+			Version:   i + 1,
+			Chart:     chart,
+			Info:      &release.Info{Status: st},
+		}
+		if err := cfg.Releases.Create(rel); err != nil {
+			t.Fatalf("error creating release: %v", err)
+		}
+	}
+}
+
+func TestGraphInstallPendingRelease(t *testing.T) {
+	charts := []Chart{
+		Chart{
+			Title:                      "redis",
+			Location:                   "testdata/chart",
+			DeploymentHealthIndication: IgnorePodHealth,
+			WaitTimeout:                2 * time.Second,
+		},
+	}
+	cases := []struct {
+		name     string
+		statuses []release.Status
+		policy   PendingReleasePolicy
+		upgrade  bool
+		isErr    bool
+		// expected status and minimum revision of the last release afterwards
+		status   release.Status
+		revision int
+	}{
+		{"pending upgrade, fail", []release.Status{release.StatusSuperseded, release.StatusDeployed, release.StatusPendingUpgrade}, FailOnPending, true, true, release.StatusPendingUpgrade, 3},
+		{"pending upgrade, rollback", []release.Status{release.StatusSuperseded, release.StatusDeployed, release.StatusPendingUpgrade}, RollbackPending, true, false, release.StatusDeployed, 5},
+		{"pending upgrade, reinstall", []release.Status{release.StatusDeployed, release.StatusPendingUpgrade}, ReinstallPending, true, false, release.StatusDeployed, 1},
+		{"pending install, fail", []release.Status{release.StatusPendingInstall}, FailOnPending, false, true, release.StatusPendingInstall, 1},
+		{"pending install, rollback", []release.Status{release.StatusPendingInstall}, RollbackPending, false, false, release.StatusDeployed, 1},
+		{"pending install, reinstall", []release.Status{release.StatusPendingInstall}, ReinstallPending, false, false, release.StatusDeployed, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := fakeHelmConfiguration(t)
+			storeReleases(t, cfg, "redis", c.statuses...)
+			m := Manager{
+				LogF: t.Logf,
+				K8c:  fakeKubernetesClientset(t, DefaultK8sNamespace, charts),
+				HCfg: cfg,
+			}
+			ChartWaitPollInterval = 1 * time.Second
+			var err error
+			if c.upgrade {
+				err = m.Upgrade(context.Background(), ReleaseMap{"redis": "redis"}, charts, WithPendingReleasePolicy(c.policy))
+			} else {
+				_, err = m.Install(context.Background(), charts, WithPendingReleasePolicy(c.policy))
+			}
+			if err != nil && !c.isErr {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+			if err == nil && c.isErr {
+				t.Fatalf("should have failed")
+			}
+			if c.isErr {
+				if pre := (PendingReleaseError{}); !errors.As(err, &pre) || pre.ReleaseName != "redis" {
+					t.Fatalf("expected PendingReleaseError: %T: %v", err, err)
+				}
+			}
+			rel, err := cfg.Releases.Last("redis")
+			if err != nil {
+				t.Fatalf("error getting release: %v", err)
+			}
+			if rel.Info.Status != c.status || rel.Version < c.revision {
+				t.Fatalf("bad release afterwards: status %v, revision %v", rel.Info.Status, rel.Version)
+			}
+		})
+	}
+}
+
+func TestParsePendingReleasePolicy(t *testing.T) {
+	for _, p := range []PendingReleasePolicy{FailOnPending, RollbackPending, ReinstallPending} {
+		p2, err := ParsePendingReleasePolicy(p.String())
+		if err != nil || p2 != p {
+			t.Fatalf("bad round trip for %v: %v, %v", p, p2, err)
+		}
+	}
+	if _, err := ParsePendingReleasePolicy("ignore"); err == nil {
+		t.Fatalf("should have failed")
+	}
+}
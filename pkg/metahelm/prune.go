@@ -0,0 +1,140 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/graphext/metahelm/pkg/dag"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+// prunedChart adapts a recorded ChartState into a graph object, retaining only dependencies on other pruned charts
+type prunedChart struct {
+	cs   ChartState
+	deps []string
+}
+
+func (pc *prunedChart) Name() string {
+	return pc.cs.Title
+}
+
+func (pc *prunedChart) String() string {
+	return fmt.Sprintf("\"%v\"", pc.cs.Title)
+}
+
+func (pc *prunedChart) Dependencies() []string {
+	return pc.deps
+}
+
+// Orphans returns the charts recorded in the state of the graph that are not present in charts. WithGraphName is required;
+// WithK8sNamespace and WithReleaseNamePrefix identify the graph as they do for Install.
+func (m *Manager) Orphans(ctx context.Context, charts []Chart, opts ...InstallOption) ([]ChartState, error) {
+	ops := &options{}
+	for _, opt := range opts {
+		opt(ops)
+	}
+	_, orphans, err := m.orphans(ctx, charts, ops)
+	return orphans, err
+}
+
+func (m *Manager) orphans(ctx context.Context, charts []Chart, ops *options) (*GraphState, []ChartState, error) {
+	if ops.graphName == "" {
+		return nil, nil, errors.New("graph name is required")
+	}
+	if ops.k8sNamespace == "" {
+		ops.k8sNamespace = DefaultK8sNamespace
+	}
+	gs, err := m.GetGraphState(ctx, ops.k8sNamespace, ops.graphName, ops.releaseNamePrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if gs == nil {
+		return nil, nil, nil
+	}
+	current := map[string]struct{}{}
+	for _, c := range charts {
+		current[c.Title] = struct{}{}
+	}
+	orphans := []ChartState{}
+	for _, cs := range gs.Charts {
+		if _, ok := current[cs.Title]; !ok {
+			orphans = append(orphans, cs)
+		}
+	}
+	return gs, orphans, nil
+}
+
+// Prune uninstalls the releases of charts that are recorded in the state of the graph but are no longer present in charts
+// (they were removed from the graph definition). Releases are uninstalled in reverse dependency order according to the dependencies
+// recorded when they were installed, and are then removed from the graph state. The pruned charts are returned. Steps are not recorded in
+// the graph state, so they are never pruned.
+// WithGraphName is required; WithK8sNamespace and WithReleaseNamePrefix identify the graph as they do for Install.
+func (m *Manager) Prune(ctx context.Context, charts []Chart, opts ...InstallOption) ([]ChartState, error) {
+	ops := &options{}
+	for _, opt := range opts {
+		opt(ops)
+	}
+	gs, orphans, err := m.orphans(ctx, charts, ops)
+	if err != nil || len(orphans) == 0 {
+		return nil, err
+	}
+	omap := map[string]struct{}{}
+	for _, cs := range orphans {
+		omap[cs.Title] = struct{}{}
+	}
+	objs := []dag.GraphObject{}
+	for _, cs := range orphans {
+		pc := &prunedChart{cs: cs}
+		for _, ds := range cs.Dependencies {
+			d, err := dag.ParseDependency(ds)
+			if err != nil {
+				continue
+			}
+			if _, ok := omap[d.Name]; ok {
+				pc.deps = append(pc.deps, d.Name)
+			}
+		}
+		objs = append(objs, pc)
+	}
+	lf := func(msg string, args ...interface{}) {
+		m.log("prune objgraph: "+msg, args...)
+	}
+	og := dag.ObjectGraph{LogF: dag.LogFunc(lf)}
+	if err := og.Build(objs); err != nil {
+		return nil, errors.Wrap(err, "error building graph of pruned charts")
+	}
+	var lock sync.Mutex
+	pruned := map[string]struct{}{}
+	af := func(obj dag.GraphObject) error {
+		pc := obj.(*prunedChart)
+		m.log("%v: uninstalling release %v", pc.cs.Title, pc.cs.ReleaseName)
+		if _, err := action.NewUninstall(m.HCfg).Run(pc.cs.ReleaseName); err != nil && !errors.Is(err, driver.ErrReleaseNotFound) {
+			return errors.Wrapf(err, "error uninstalling release %v", pc.cs.ReleaseName)
+		}
+		lock.Lock()
+		pruned[pc.cs.Title] = struct{}{}
+		lock.Unlock()
+		return nil
+	}
+	werr := og.WalkReverse(ctx, af)
+	out := []ChartState{}
+	remaining := []ChartState{}
+	for _, cs := range gs.Charts {
+		if _, ok := pruned[cs.Title]; ok {
+			out = append(out, cs)
+			continue
+		}
+		remaining = append(remaining, cs)
+	}
+	gs.Charts = remaining
+	if err := m.saveGraphState(ctx, gs); err != nil {
+		return out, err
+	}
+	if werr != nil {
+		return out, errors.Wrap(werr, "error pruning releases")
+	}
+	return out, nil
+}
@@ -0,0 +1,106 @@
+package metahelm
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	ns := "foo"
+	prefix := "metahelm-test-prefix-"
+	fkc := fakeKubernetesClientset(t, ns, testCharts)
+	cfg := fakeHelmConfiguration(t)
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fkc,
+		HCfg: cfg,
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	opts := []InstallOption{WithK8sNamespace(ns), WithReleaseNamePrefix(prefix), WithGraphName("app")}
+	um, err := m.Install(context.Background(), testCharts, opts...)
+	if err != nil {
+		t.Fatalf("error installing: %v", err)
+	}
+	// remove toplevel and anotherthing from the graph
+	remaining := []Chart{testCharts[1], testCharts[3]}
+	remaining[0].DependencyList = nil
+	if err := m.Upgrade(context.Background(), um, remaining, opts...); err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	orphans, err := m.Orphans(context.Background(), remaining, opts...)
+	if err != nil {
+		t.Fatalf("error getting orphans: %v", err)
+	}
+	if len(orphans) != 2 {
+		t.Fatalf("bad orphans length: %v", len(orphans))
+	}
+	pruned, err := m.Prune(context.Background(), remaining, opts...)
+	if err != nil {
+		t.Fatalf("error pruning: %v", err)
+	}
+	if len(pruned) != 2 {
+		t.Fatalf("bad pruned length: %v", len(pruned))
+	}
+	for _, cs := range pruned {
+		if cs.Title != "toplevel" && cs.Title != "anotherthing" {
+			t.Fatalf("unexpected pruned chart: %v", cs.Title)
+		}
+		if _, err := cfg.Releases.Last(cs.ReleaseName); err == nil {
+			t.Fatalf("release should have been uninstalled: %v", cs.ReleaseName)
+		}
+	}
+	for _, c := range remaining {
+		if _, err := cfg.Releases.Deployed(um[c.Title]); err != nil {
+			t.Fatalf("release should still be deployed: %v: %v", um[c.Title], err)
+		}
+	}
+	gs, err := m.GetGraphState(context.Background(), ns, "app", prefix)
+	if err != nil {
+		t.Fatalf("error getting graph state: %v", err)
+	}
+	if len(gs.Charts) != len(remaining) {
+		t.Fatalf("bad graph state chart count: %v", len(gs.Charts))
+	}
+	pruned, err = m.Prune(context.Background(), remaining, opts...)
+	if err != nil {
+		t.Fatalf("error pruning again: %v", err)
+	}
+	if len(pruned) != 0 {
+		t.Fatalf("nothing should have been pruned: %v", pruned)
+	}
+	if _, err := m.Prune(context.Background(), remaining); err == nil {
+		t.Fatalf("should have failed without graph name")
+	}
+}
+
+func TestPruneKeepsCharts(t *testing.T) {
+	fkc := fakeKubernetesClientset(t, DefaultK8sNamespace, testCharts)
+	cfg := fakeHelmConfiguration(t)
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fkc,
+		HCfg: cfg,
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	um, err := m.Install(context.Background(), testCharts, WithGraphName("app"))
+	if err != nil {
+		t.Fatalf("error installing: %v", err)
+	}
+	// toplevel is removed from the graph; anotherthing is only kept (eg, disabled by the CLI) and isn't upgraded
+	remaining := []Chart{testCharts[1], testCharts[3]}
+	if err := m.Upgrade(context.Background(), um, remaining, WithGraphName("app")); err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	kept := append(remaining, Chart{Title: "anotherthing"})
+	pruned, err := m.Prune(context.Background(), kept, WithGraphName("app"))
+	if err != nil {
+		t.Fatalf("error pruning: %v", err)
+	}
+	if len(pruned) != 1 || pruned[0].Title != "toplevel" {
+		t.Fatalf("only toplevel should have been pruned: %v", pruned)
+	}
+	if _, err := cfg.Releases.Deployed(um["anotherthing"]); err != nil {
+		t.Fatalf("kept release should still be deployed: %v", err)
+	}
+}
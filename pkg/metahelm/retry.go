@@ -0,0 +1,222 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// ErrorClass is a class of install/upgrade errors that may be retried
+type ErrorClass string
+
+const (
+	// ErrorClassAPI covers transient Kubernetes API errors: server timeouts, throttling, unavailability, internal errors, conflicts and connection failures
+	ErrorClassAPI ErrorClass = "api"
+	// ErrorClassWebhook covers failures calling admission webhooks
+	ErrorClassWebhook ErrorClass = "webhook"
+	// ErrorClassTimeout covers Helm timing out while waiting for the release resources to be ready
+	ErrorClassTimeout ErrorClass = "timeout"
+	// ErrorClassAny covers all errors
+	ErrorClassAny ErrorClass = "any"
+)
+
+// DefaultRetryableErrors are the error classes retried if a RetryPolicy doesn't specify any
+var DefaultRetryableErrors = []ErrorClass{ErrorClassAPI, ErrorClassWebhook}
+
+// DefaultRetryBackoff is the delay before the first retry if a RetryPolicy doesn't specify one
+var DefaultRetryBackoff = 5 * time.Second
+
+// RetryPolicy defines how a failed Helm install or upgrade of a chart is retried. Before each retry the failed release is cleaned up:
+// a failed first install is uninstalled and a failed upgrade is rolled back to the previous revision. The zero value means no retries.
+type RetryPolicy struct {
+	MaxAttempts uint          // total number of attempts, including the first. Zero or one means no retries.
+	Backoff     time.Duration // delay before the first retry, doubled for each subsequent retry. If unset, DefaultRetryBackoff is used
+	MaxBackoff  time.Duration // maximum delay between retries (zero means unlimited)
+	RetryOn     []ErrorClass  // error classes that are retried. If empty, DefaultRetryableErrors is used
+}
+
+func (rp RetryPolicy) validate() error {
+	for _, ec := range rp.RetryOn {
+		switch ec {
+		case ErrorClassAPI, ErrorClassWebhook, ErrorClassTimeout, ErrorClassAny:
+		default:
+			return fmt.Errorf("unknown error class: %v", ec)
+		}
+	}
+	return nil
+}
+
+func (rp RetryPolicy) attempts() uint {
+	if rp.MaxAttempts == 0 {
+		return 1
+	}
+	return rp.MaxAttempts
+}
+
+// backoff returns the delay before the retry that follows the attempt (one-indexed)
+func (rp RetryPolicy) backoff(attempt uint) time.Duration {
+	d := rp.Backoff
+	if d == 0 {
+		d = DefaultRetryBackoff
+	}
+	for i := uint(1); i < attempt && (rp.MaxBackoff == 0 || d < rp.MaxBackoff); i++ {
+		d *= 2
+	}
+	if rp.MaxBackoff > 0 && d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	return d
+}
+
+// retryable returns whether err belongs to one of the error classes retried by the policy
+func (rp RetryPolicy) retryable(err error) bool {
+	classes := rp.RetryOn
+	if len(classes) == 0 {
+		classes = DefaultRetryableErrors
+	}
+	for _, ec := range classes {
+		if ec == ErrorClassAny {
+			return true
+		}
+		for _, ec2 := range ClassifyError(err) {
+			if ec == ec2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ClassifyError returns the retryable error classes that err belongs to (other than ErrorClassAny), if any.
+// For a ChartError, the original Helm error is classified.
+func ClassifyError(err error) []ErrorClass {
+	if err == nil {
+		return nil
+	}
+	err = errors.Cause(err)
+	if ce, ok := err.(ChartError); ok && ce.HelmError != nil {
+		err = errors.Cause(ce.HelmError)
+	}
+	out := []ErrorClass{}
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "failed calling webhook") || strings.Contains(msg, "admission webhook") {
+		out = append(out, ErrorClassWebhook)
+	}
+	var nerr net.Error
+	switch {
+	case apierrors.IsServerTimeout(err), apierrors.IsTimeout(err), apierrors.IsTooManyRequests(err), apierrors.IsServiceUnavailable(err),
+		apierrors.IsInternalError(err), apierrors.IsConflict(err), errors.As(err, &nerr), errors.Is(err, io.ErrUnexpectedEOF):
+		out = append(out, ErrorClassAPI)
+	default:
+		for _, s := range []string{"connection refused", "connection reset", "i/o timeout", "tls handshake timeout", "unexpected eof", "the server is currently unable to handle the request"} {
+			if strings.Contains(msg, s) {
+				out = append(out, ErrorClassAPI)
+				break
+			}
+		}
+	}
+	if errors.Is(err, wait.ErrWaitTimeout) || errors.Is(err, context.DeadlineExceeded) || strings.Contains(msg, "timed out waiting for the condition") {
+		out = append(out, ErrorClassTimeout)
+	}
+	return out
+}
+
+// AttemptError is passed to the CompletedCallback for a failed attempt of a chart install/upgrade that will be retried
+type AttemptError struct {
+	// Attempt is the number (one-indexed) of the failed attempt
+	Attempt uint
+	// MaxAttempts is the total number of attempts allowed by the retry policy
+	MaxAttempts uint
+	// Err is the error of the attempt
+	Err error
+}
+
+// Error satisfies the error interface
+func (ae AttemptError) Error() string {
+	return fmt.Sprintf("attempt %v of %v failed: %v", ae.Attempt, ae.MaxAttempts, ae.Err)
+}
+
+// withRetries runs op (a Helm install or upgrade of c) according to the retry policy of c, running cleanup before each retry.
+// The completed callback is invoked after each attempt.
+func (m *Manager) withRetries(ctx context.Context, c *Chart, ops *options, opstr string, op func() error, cleanup func() error) error {
+	max := c.Retry.attempts()
+	for attempt := uint(1); ; attempt++ {
+		err := op()
+		retry := err != nil && attempt < max && ctx.Err() == nil && c.Retry.retryable(err)
+		if ops.completedCallback != nil {
+			m.log("%v: running completed callback", c.Name())
+			cberr := err
+			if retry {
+				cberr = AttemptError{Attempt: attempt, MaxAttempts: max, Err: err}
+			}
+			ops.completedCallback(*c, cberr)
+		}
+		if !retry {
+			return err
+		}
+		bo := c.Retry.backoff(attempt)
+		m.log("%v: %v attempt %v of %v failed (retrying in %v): %v", c.Name(), opstr, attempt, max, bo, err)
+		if err := cleanup(); err != nil {
+			m.log("%v: error cleaning up failed %v (retrying anyway): %v", c.Name(), opstr, err)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(bo):
+		}
+	}
+}
+
+// releaseStored returns whether Helm has any revision of the release relname
+func (m *Manager) releaseStored(relname string) bool {
+	_, err := m.HCfg.Releases.Last(relname)
+	return err == nil
+}
+
+// cleanupFailedInstall uninstalls the release if a failed install left it behind. Releases that existed before the install (existed)
+// and releases other than a failed or pending first revision weren't created by the install, and are left alone.
+func (m *Manager) cleanupFailedInstall(relname string, existed bool) error {
+	if existed {
+		return nil
+	}
+	rel, err := m.HCfg.Releases.Last(relname)
+	if err != nil {
+		return nil // no release to clean up
+	}
+	if rel.Version != 1 || rel.Info == nil || (rel.Info.Status != release.StatusFailed && !rel.Info.Status.IsPending()) {
+		return nil
+	}
+	m.log("%v: uninstalling failed release", relname)
+	if _, err := action.NewUninstall(m.HCfg).Run(relname); err != nil {
+		return errors.Wrap(err, "error uninstalling release")
+	}
+	return nil
+}
+
+// cleanupFailedUpgrade rolls back the release to the previous revision if a failed upgrade left it failed or pending
+func (m *Manager) cleanupFailedUpgrade(relname string, timeout time.Duration) error {
+	rel, err := m.HCfg.Releases.Last(relname)
+	if err != nil {
+		return errors.Wrap(err, "error getting release")
+	}
+	if rel.Info == nil || (rel.Info.Status != release.StatusFailed && !rel.Info.Status.IsPending()) {
+		return nil // the upgrade didn't create a new revision
+	}
+	m.log("%v: rolling back failed upgrade (revision %v)", relname, rel.Version)
+	rb := action.NewRollback(m.HCfg)
+	rb.Wait = true
+	rb.Timeout = timeout
+	if err := rb.Run(relname); err != nil {
+		return errors.Wrap(err, "error rolling back release")
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package metahelm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/release"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		output []ErrorClass
+	}{
+		{"nil", nil, nil},
+		{"other", errors.New("chart is broken"), []ErrorClass{}},
+		{"server timeout", apierrors.NewServerTimeout(schema.GroupResource{Resource: "pods"}, "create", 1), []ErrorClass{ErrorClassAPI}},
+		{"connection refused", fmt.Errorf("error creating: %w", errors.New("dial tcp 10.0.0.1:443: connect: connection refused")), []ErrorClass{ErrorClassAPI}},
+		{"webhook", errors.New(`Internal error occurred: failed calling webhook "validate.nginx.ingress.kubernetes.io": context deadline exceeded`), []ErrorClass{ErrorClassWebhook}},
+		{"wait timeout", errors.New("timed out waiting for the condition"), []ErrorClass{ErrorClassTimeout}},
+		{"chart error", NewChartError(apierrors.NewTooManyRequests("slow down", 1)), []ErrorClass{ErrorClassAPI}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if out := ClassifyError(c.err); !reflect.DeepEqual(out, c.output) {
+				t.Fatalf("bad classes: %v (expected %v)", out, c.output)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	rp := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for i, d := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if bo := rp.backoff(uint(i + 1)); bo != d {
+			t.Fatalf("bad backoff for attempt %v: %v (expected %v)", i+1, bo, d)
+		}
+	}
+	if rp.attempts() != 1 {
+		t.Fatalf("zero MaxAttempts should mean a single attempt")
+	}
+	if err := (RetryPolicy{RetryOn: []ErrorClass{"sometimes"}}).validate(); err == nil {
+		t.Fatalf("unknown error class should have failed")
+	}
+}
+
+func TestGraphInstallRetry(t *testing.T) {
+	transient := apierrors.NewServiceUnavailable("etcd is sad")
+	cases := []struct {
+		name     string
+		retry    RetryPolicy
+		waitErrs []error
+		isErr    bool
+		calls    int
+	}{
+		{"no retry policy", RetryPolicy{}, []error{transient}, true, 1},
+		{"retried", RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}, []error{transient, transient}, false, 3},
+		{"attempts exhausted", RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}, []error{transient, transient}, true, 2},
+		{"not retryable", RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}, []error{errors.New("bad chart")}, true, 1},
+		{"retry any", RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, RetryOn: []ErrorClass{ErrorClassAny}}, []error{errors.New("bad chart")}, false, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			charts := []Chart{
+				Chart{
+					Title:                      "redis",
+					Location:                   "testdata/chart",
+					DeploymentHealthIndication: IgnorePodHealth,
+					Retry:                      c.retry,
+				},
+			}
+			cfg := fakeHelmConfiguration(t)
+			cfg.KubeClient = &testKubeClient{waitErrs: c.waitErrs}
+			m := Manager{
+				LogF: t.Logf,
+				K8c:  fakeKubernetesClientset(t, DefaultK8sNamespace, charts),
+				HCfg: cfg,
+			}
+			var mtx sync.Mutex
+			attempts := []error{}
+			cb := func(c Chart, err error) {
+				mtx.Lock()
+				attempts = append(attempts, err)
+				mtx.Unlock()
+			}
+			_, err := m.Install(context.Background(), charts, WithCompletedCallback(cb))
+			if err != nil && !c.isErr {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+			if err == nil && c.isErr {
+				t.Fatalf("should have failed")
+			}
+			if len(attempts) != c.calls {
+				t.Fatalf("bad number of callback calls: %v (expected %v)", len(attempts), c.calls)
+			}
+			for i, aerr := range attempts[:len(attempts)-1] {
+				if ae, ok := aerr.(AttemptError); !ok || ae.Attempt != uint(i+1) {
+					t.Fatalf("expected AttemptError for attempt %v: %v", i+1, aerr)
+				}
+			}
+			if !c.isErr {
+				rel, err := cfg.Releases.Last("redis")
+				if err != nil {
+					t.Fatalf("error getting release: %v", err)
+				}
+				if rel.Version != 1 {
+					t.Fatalf("failed release should have been uninstalled (version %v)", rel.Version)
+				}
+			}
+		})
+	}
+}
+
+func TestGraphInstallRetryExistingRelease(t *testing.T) {
+	charts := []Chart{
+		Chart{
+			Title:                      "redis",
+			Location:                   "testdata/chart",
+			DeploymentHealthIndication: IgnorePodHealth,
+			Retry:                      RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, RetryOn: []ErrorClass{ErrorClassAny}},
+		},
+	}
+	cfg := fakeHelmConfiguration(t)
+	storeReleases(t, cfg, "redis", release.StatusDeployed)
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fakeKubernetesClientset(t, DefaultK8sNamespace, charts),
+		HCfg: cfg,
+	}
+	if _, err := m.Install(context.Background(), charts); err == nil {
+		t.Fatalf("should have failed with an existing release")
+	}
+	rel, err := cfg.Releases.Last("redis")
+	if err != nil {
+		t.Fatalf("existing release should not have been uninstalled: %v", err)
+	}
+	if rel.Version != 1 || rel.Info.Status != release.StatusDeployed {
+		t.Fatalf("existing release should have been left alone: revision %v, status %v", rel.Version, rel.Info.Status)
+	}
+}
@@ -0,0 +1,293 @@
+package metahelm
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ManagedByLabel is the label applied to all Kubernetes objects created by metahelm to store its own state
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	// ManagedByValue is the value of ManagedByLabel for metahelm-owned objects
+	ManagedByValue = "metahelm"
+	// GraphNameLabel is the label holding the (sanitized) graph name on graph state records
+	GraphNameLabel = "metahelm.graphext.com/graph"
+	// graphStateKey is the ConfigMap data key holding the JSON-encoded GraphState
+	graphStateKey = "state"
+)
+
+// GraphState is the record of an installed graph that metahelm stores in the cluster (as a ConfigMap in the graph namespace)
+// whenever a graph name is supplied with WithGraphName
+type GraphState struct {
+	// Name is the graph name
+	Name string `json:"name"`
+	// ReleaseNamePrefix is the release name prefix used to install the graph
+	ReleaseNamePrefix string `json:"release_name_prefix"`
+	// Namespace is the Kubernetes namespace the graph is installed into
+	Namespace string `json:"namespace"`
+	// Charts are the charts that make up the graph
+	Charts []ChartState `json:"charts"`
+	// Updated is the time of the last install or upgrade of the graph
+	Updated time.Time `json:"updated"`
+}
+
+// ChartState is the record of a single chart within GraphState
+type ChartState struct {
+	// Title is the chart title
+	Title string `json:"title"`
+	// ReleaseName is the name of the Helm release for the chart
+	ReleaseName string `json:"release_name"`
+	// Dependencies are the chart titles this chart depended upon when it was installed
+	Dependencies []string `json:"dependencies,omitempty"`
+	// Duration is how long the last successful install or upgrade of the chart took (in nanoseconds)
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// Durations returns the recorded install/upgrade durations of the charts, by title
+func (gs *GraphState) Durations() map[string]time.Duration {
+	out := map[string]time.Duration{}
+	for _, cs := range gs.Charts {
+		if cs.Duration > 0 {
+			out[cs.Title] = cs.Duration
+		}
+	}
+	return out
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// sanitizeName converts s into a string usable as a DNS label or label value
+func sanitizeName(s string) string {
+	s = invalidNameChars.ReplaceAllString(strings.ToLower(s), "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return strings.Trim(s, "-")
+}
+
+// GraphStateName returns the name of the ConfigMap used to store the state of a graph
+func GraphStateName(graphName, releaseNamePrefix string) string {
+	parts := []string{"metahelm-graph"}
+	for _, p := range []string{releaseNamePrefix, graphName} {
+		if sp := sanitizeName(p); sp != "" {
+			parts = append(parts, sp)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// GetGraphState returns the stored state for a graph, or nil if no state has been recorded
+func (m *Manager) GetGraphState(ctx context.Context, namespace, graphName, releaseNamePrefix string) (*GraphState, error) {
+	cm, err := m.K8c.CoreV1().ConfigMaps(namespace).Get(ctx, GraphStateName(graphName, releaseNamePrefix), metav1.GetOptions{})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error getting graph state")
+	}
+	return decodeGraphState(cm)
+}
+
+func decodeGraphState(cm *corev1.ConfigMap) (*GraphState, error) {
+	gs := &GraphState{}
+	if err := json.Unmarshal([]byte(cm.Data[graphStateKey]), gs); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling graph state: %v", cm.Name)
+	}
+	return gs, nil
+}
+
+// saveGraphState creates or updates the stored state for a graph
+func (m *Manager) saveGraphState(ctx context.Context, gs *GraphState) error {
+	b, err := json.Marshal(gs)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling graph state")
+	}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      GraphStateName(gs.Name, gs.ReleaseNamePrefix),
+			Namespace: gs.Namespace,
+			Labels: map[string]string{
+				ManagedByLabel: ManagedByValue,
+				GraphNameLabel: sanitizeName(gs.Name),
+			},
+		},
+		Data: map[string]string{graphStateKey: string(b)},
+	}
+	cmi := m.K8c.CoreV1().ConfigMaps(gs.Namespace)
+	if _, err := cmi.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		if !kerrors.IsNotFound(err) {
+			return errors.Wrap(err, "error updating graph state")
+		}
+		if _, err := cmi.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return errors.Wrap(err, "error creating graph state")
+		}
+	}
+	return nil
+}
+
+// recordGraphState saves the state of a graph after an install or upgrade. Charts from the previously recorded state that are
+// not part of charts are retained (they remain installed until pruned) so that releases are never forgotten. durations are the
+// install/upgrade durations of the charts that succeeded; the previously recorded durations are kept for the rest.
+func (m *Manager) recordGraphState(ctx context.Context, ops *options, charts []Chart, rmap ReleaseMap, durations map[string]time.Duration) error {
+	gs := &GraphState{
+		Name:              ops.graphName,
+		ReleaseNamePrefix: ops.releaseNamePrefix,
+		Namespace:         ops.k8sNamespace,
+		Updated:           time.Now().UTC(),
+	}
+	prev, err := m.GetGraphState(ctx, ops.k8sNamespace, ops.graphName, ops.releaseNamePrefix)
+	if err != nil {
+		return err
+	}
+	prevDurations := map[string]time.Duration{}
+	if prev != nil {
+		prevDurations = prev.Durations()
+	}
+	seen := map[string]struct{}{}
+	for _, c := range charts {
+		rn, ok := rmap[c.Title]
+		if !ok {
+			continue
+		}
+		seen[c.Title] = struct{}{}
+		d, ok := durations[c.Title]
+		if !ok {
+			d = prevDurations[c.Title]
+		}
+		gs.Charts = append(gs.Charts, ChartState{Title: c.Title, ReleaseName: rn, Dependencies: c.Dependencies(), Duration: d})
+	}
+	if prev != nil {
+		for _, cs := range prev.Charts {
+			if _, ok := seen[cs.Title]; !ok {
+				gs.Charts = append(gs.Charts, cs)
+			}
+		}
+	}
+	return m.saveGraphState(ctx, gs)
+}
+
+// Overall health values for GraphSummary
+const (
+	// GraphHealthy means all releases of the graph are deployed
+	GraphHealthy = "healthy"
+	// GraphPending means at least one release of the graph has an operation in progress
+	GraphPending = "pending"
+	// GraphDegraded means at least one release of the graph is missing or not deployed
+	GraphDegraded = "degraded"
+	// GraphFailed means at least one release of the graph has failed
+	GraphFailed = "failed"
+)
+
+// GraphSummary describes an installed graph found in the cluster
+type GraphSummary struct {
+	// Name is the graph name
+	Name string `json:"name"`
+	// ReleaseNamePrefix is the release name prefix used to install the graph
+	ReleaseNamePrefix string `json:"release_name_prefix"`
+	// Namespace is the Kubernetes namespace the graph is installed into
+	Namespace string `json:"namespace"`
+	// ChartCount is the number of charts in the graph
+	ChartCount int `json:"chart_count"`
+	// Health is the overall health of the graph releases (GraphHealthy, GraphPending, GraphDegraded or GraphFailed)
+	Health string `json:"health"`
+	// ReleaseStatuses is a map of chart title to Helm release status
+	ReleaseStatuses map[string]string `json:"release_statuses"`
+	// Updated is the time of the last install or upgrade of the graph
+	Updated time.Time `json:"updated"`
+}
+
+// ListGraphs returns the graphs recorded in the cluster, sorted by namespace, release name prefix and name.
+// WithK8sNamespace restricts results to a single namespace (all namespaces are searched otherwise) and WithReleaseNamePrefix
+// restricts results to graphs whose release name prefix starts with the supplied value.
+// m.HCfg must be able to list releases in all searched namespaces.
+func (m *Manager) ListGraphs(ctx context.Context, opts ...InstallOption) ([]GraphSummary, error) {
+	ops := &options{}
+	for _, opt := range opts {
+		opt(ops)
+	}
+	cml, err := m.K8c.CoreV1().ConfigMaps(ops.k8sNamespace).List(ctx, metav1.ListOptions{LabelSelector: ManagedByLabel + "=" + ManagedByValue})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing graph states")
+	}
+	list := action.NewList(m.HCfg)
+	list.All = true
+	list.SetStateMask()
+	rels, err := list.Run()
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing releases")
+	}
+	relmap := map[string]*release.Release{}
+	for _, r := range rels {
+		relmap[r.Namespace+"/"+r.Name] = r
+	}
+	out := []GraphSummary{}
+	for i := range cml.Items {
+		if _, ok := cml.Items[i].Data[graphStateKey]; !ok {
+			continue
+		}
+		gs, err := decodeGraphState(&cml.Items[i])
+		if err != nil {
+			m.log("ignoring graph state: %v", err)
+			continue
+		}
+		if !strings.HasPrefix(gs.ReleaseNamePrefix, ops.releaseNamePrefix) {
+			continue
+		}
+		out = append(out, summarizeGraph(gs, relmap))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Namespace != out[j].Namespace {
+			return out[i].Namespace < out[j].Namespace
+		}
+		if out[i].ReleaseNamePrefix != out[j].ReleaseNamePrefix {
+			return out[i].ReleaseNamePrefix < out[j].ReleaseNamePrefix
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+func summarizeGraph(gs *GraphState, relmap map[string]*release.Release) GraphSummary {
+	sum := GraphSummary{
+		Name:              gs.Name,
+		ReleaseNamePrefix: gs.ReleaseNamePrefix,
+		Namespace:         gs.Namespace,
+		ChartCount:        len(gs.Charts),
+		Health:            GraphHealthy,
+		ReleaseStatuses:   make(map[string]string, len(gs.Charts)),
+		Updated:           gs.Updated,
+	}
+	// health values in increasing order of severity
+	severity := map[string]int{GraphHealthy: 0, GraphPending: 1, GraphDegraded: 2, GraphFailed: 3}
+	for _, cs := range gs.Charts {
+		status := ReleaseNotInstalled
+		health := GraphDegraded
+		if r, ok := relmap[gs.Namespace+"/"+cs.ReleaseName]; ok && r.Info != nil {
+			status = r.Info.Status.String()
+			switch {
+			case r.Info.Status == release.StatusDeployed:
+				health = GraphHealthy
+			case r.Info.Status == release.StatusFailed:
+				health = GraphFailed
+			case r.Info.Status.IsPending():
+				health = GraphPending
+			}
+		}
+		sum.ReleaseStatuses[cs.Title] = status
+		if severity[health] > severity[sum.Health] {
+			sum.Health = health
+		}
+	}
+	return sum
+}
@@ -0,0 +1,152 @@
+package metahelm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func TestGraphStateName(t *testing.T) {
+	cases := []struct {
+		name, graph, prefix, output string
+	}{
+		{"no prefix", "mygraph", "", "metahelm-graph.mygraph"},
+		{"prefix", "mygraph", "pr-1234-", "metahelm-graph.pr-1234.mygraph"},
+		{"invalid chars", "My_Graph", "PR/1234", "metahelm-graph.pr-1234.my-graph"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if out := GraphStateName(c.graph, c.prefix); out != c.output {
+				t.Fatalf("bad output: %v (wanted %v)", out, c.output)
+			}
+		})
+	}
+}
+
+func TestListGraphs(t *testing.T) {
+	ns := "foo"
+	fkc := fakeKubernetesClientset(t, ns, testCharts)
+	cfg := fakeHelmConfiguration(t)
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fkc,
+		HCfg: cfg,
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	for _, pfx := range []string{"pr-1-", "pr-2-"} {
+		if _, err := m.Install(context.Background(), testCharts, WithK8sNamespace(ns), WithReleaseNamePrefix(pfx), WithGraphName("app")); err != nil {
+			t.Fatalf("error installing: %v", err)
+		}
+	}
+	gs, err := m.GetGraphState(context.Background(), ns, "app", "pr-1-")
+	if err != nil {
+		t.Fatalf("error getting graph state: %v", err)
+	}
+	if gs == nil {
+		t.Fatalf("graph state should have been recorded")
+	}
+	if len(gs.Charts) != len(testCharts) {
+		t.Fatalf("bad chart count: %v", len(gs.Charts))
+	}
+	for _, cs := range gs.Charts {
+		if cs.ReleaseName != ReleaseName("pr-1-"+cs.Title) {
+			t.Fatalf("bad release name for %v: %v", cs.Title, cs.ReleaseName)
+		}
+		if cs.Duration <= 0 {
+			t.Fatalf("duration should have been recorded for %v", cs.Title)
+		}
+	}
+	if d := gs.Durations(); len(d) != len(testCharts) {
+		t.Fatalf("bad durations: %v", d)
+	}
+	gl, err := m.ListGraphs(context.Background())
+	if err != nil {
+		t.Fatalf("error listing graphs: %v", err)
+	}
+	if len(gl) != 2 {
+		t.Fatalf("bad graph count: %v", len(gl))
+	}
+	for _, g := range gl {
+		if g.Name != "app" || g.Namespace != ns {
+			t.Fatalf("bad graph: %+v", g)
+		}
+		if g.ChartCount != len(testCharts) {
+			t.Fatalf("bad chart count: %v", g.ChartCount)
+		}
+		if g.Health != GraphHealthy {
+			t.Fatalf("bad health: %v: %v", g.Health, g.ReleaseStatuses)
+		}
+	}
+	gl, err = m.ListGraphs(context.Background(), WithReleaseNamePrefix("pr-2"))
+	if err != nil {
+		t.Fatalf("error listing graphs: %v", err)
+	}
+	if len(gl) != 1 || gl[0].ReleaseNamePrefix != "pr-2-" {
+		t.Fatalf("bad prefix filter results: %+v", gl)
+	}
+	gl, err = m.ListGraphs(context.Background(), WithK8sNamespace("bar"))
+	if err != nil {
+		t.Fatalf("error listing graphs: %v", err)
+	}
+	if len(gl) != 0 {
+		t.Fatalf("bad namespace filter results: %+v", gl)
+	}
+}
+
+func TestListGraphsDegraded(t *testing.T) {
+	fkc := fakeKubernetesClientset(t, DefaultK8sNamespace, testCharts)
+	cfg := fakeHelmConfiguration(t)
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fkc,
+		HCfg: cfg,
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	if _, err := m.Install(context.Background(), testCharts, WithGraphName("app")); err != nil {
+		t.Fatalf("error installing: %v", err)
+	}
+	if _, err := cfg.Releases.Delete(ReleaseName("redis"), 1); err != nil {
+		t.Fatalf("error deleting release: %v", err)
+	}
+	gl, err := m.ListGraphs(context.Background())
+	if err != nil {
+		t.Fatalf("error listing graphs: %v", err)
+	}
+	if len(gl) != 1 {
+		t.Fatalf("bad graph count: %v", len(gl))
+	}
+	if gl[0].Health != GraphDegraded {
+		t.Fatalf("bad health: %v", gl[0].Health)
+	}
+	if s := gl[0].ReleaseStatuses["redis"]; s != ReleaseNotInstalled {
+		t.Fatalf("bad redis status: %v", s)
+	}
+}
+
+func TestGraphStateRecordingFailure(t *testing.T) {
+	ns := "foo"
+	fkc := fakeKubernetesClientset(t, ns, testCharts)
+	fkc.(*k8sfake.Clientset).PrependReactor("*", "configmaps", func(action ktesting.Action) (bool, runtime.Object, error) {
+		return true, nil, kerrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "", errors.New("no permission"))
+	})
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fkc,
+		HCfg: fakeHelmConfiguration(t),
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	rm, err := m.Install(context.Background(), testCharts, WithK8sNamespace(ns), WithGraphName("app"))
+	if err != nil {
+		t.Fatalf("install should have succeeded: %v", err)
+	}
+	if len(rm) != len(testCharts) {
+		t.Fatalf("bad release map: %v", rm)
+	}
+}
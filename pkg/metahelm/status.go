@@ -0,0 +1,158 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/graphext/metahelm/pkg/dag"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReleaseNotInstalled is the release status reported for charts that have no Helm release
+const ReleaseNotInstalled = "not-installed"
+
+// ChartStatus models the live state of a single chart of an installed graph
+type ChartStatus struct {
+	// Title is the chart title
+	Title string `json:"title"`
+	// Level is the chart level (zero-indexed) within the graph
+	Level uint `json:"level"`
+	// ReleaseName is the name of the Helm release for the chart
+	ReleaseName string `json:"release_name"`
+	// ReleaseStatus is the Helm release status (deployed, failed, pending-install, etc) or ReleaseNotInstalled
+	ReleaseStatus string `json:"release_status"`
+	// Revision is the current Helm release revision
+	Revision int `json:"revision"`
+	// HealthTarget is the name of the Deployment used to determine health, if any
+	HealthTarget string `json:"health_target,omitempty"`
+	// ReadyReplicas is the number of ready replicas of HealthTarget
+	ReadyReplicas int32 `json:"ready_replicas"`
+	// DesiredReplicas is the number of desired replicas of HealthTarget
+	DesiredReplicas int32 `json:"desired_replicas"`
+	// Healthy indicates whether the release is deployed and the health target satisfies the chart health indication
+	Healthy bool `json:"healthy"`
+	// FailedPods are the pods of HealthTarget that appear to be in a failed state
+	FailedPods []FailedPod `json:"failed_pods,omitempty"`
+	// Error is any error encountered while determining the status
+	Error string `json:"error,omitempty"`
+}
+
+// Status returns the live status of each chart in rmap, in DAG order (charts that are installed first are returned first).
+// Only WithK8sNamespace and WithSteps (needed if charts depend on steps) are used from the supplied options. Steps are not included in the output.
+func (m *Manager) Status(ctx context.Context, rmap ReleaseMap, charts []Chart, opts ...InstallOption) ([]ChartStatus, error) {
+	ops := &options{}
+	for _, opt := range opts {
+		opt(ops)
+	}
+	if ops.k8sNamespace == "" {
+		ops.k8sNamespace = DefaultK8sNamespace
+	}
+	for _, c := range charts {
+		if _, ok := rmap[c.Title]; !ok {
+			return nil, fmt.Errorf("chart title missing from release map: %v", c.Title)
+		}
+	}
+	ordered, err := dagOrder(charts, ops.steps...)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ChartStatus, len(ordered))
+	for i, oc := range ordered {
+		out[i] = m.chartStatus(ctx, oc.chart, oc.level, rmap[oc.chart.Title], ops.k8sNamespace)
+	}
+	return out, nil
+}
+
+func (m *Manager) chartStatus(ctx context.Context, c *Chart, level uint, relname, ns string) ChartStatus {
+	cs := ChartStatus{
+		Title:         c.Title,
+		Level:         level,
+		ReleaseName:   relname,
+		ReleaseStatus: ReleaseNotInstalled,
+	}
+	rel, err := action.NewGet(m.HCfg).Run(relname)
+	if err != nil {
+		if !errors.Is(err, driver.ErrReleaseNotFound) {
+			cs.Error = fmt.Sprintf("error getting release: %v", err)
+		}
+		return cs
+	}
+	if rel.Info != nil {
+		cs.ReleaseStatus = rel.Info.Status.String()
+	}
+	cs.Revision = rel.Version
+	deployed := cs.ReleaseStatus == release.StatusDeployed.String()
+	if c.WaitUntilHelmSaysItsReady || c.WaitUntilDeployment == "" {
+		cs.Healthy = deployed
+		return cs
+	}
+	cs.HealthTarget = c.WaitUntilDeployment
+	d, err := m.K8c.AppsV1().Deployments(ns).Get(ctx, c.WaitUntilDeployment, metav1.GetOptions{})
+	if err != nil {
+		cs.Error = fmt.Sprintf("error getting deployment: %v", err)
+		return cs
+	}
+	// unset replicas defaults to 1 in the API
+	cs.DesiredReplicas = 1
+	if d.Spec.Replicas != nil {
+		cs.DesiredReplicas = *d.Spec.Replicas
+	}
+	cs.ReadyReplicas = d.Status.ReadyReplicas
+	needed := int32(1)
+	switch c.DeploymentHealthIndication {
+	case IgnorePodHealth:
+		needed = 0
+	case AllPodsHealthy:
+		needed = cs.DesiredReplicas
+	}
+	cs.Healthy = deployed && cs.ReadyReplicas >= needed
+	_, fps, err := newPodResolver(ns, m.K8c).failedPods(ctx, "Deployment", c.WaitUntilDeployment, MaxPodLogLines)
+	if err != nil {
+		cs.Error = fmt.Sprintf("error getting failed pods: %v", err)
+		return cs
+	}
+	cs.FailedPods = fps
+	return cs
+}
+
+type orderedChart struct {
+	chart *Chart
+	level uint
+}
+
+// dagOrder returns charts in installation order: descending graph level, then in the start order of the level (by descending priority, then
+// by title). Steps are only used to build the graph.
+func dagOrder(charts []Chart, steps ...Step) ([]orderedChart, error) {
+	cmap := map[string]*Chart{}
+	objs := []dag.GraphObject{}
+	for i := range charts {
+		cmap[charts[i].Name()] = &charts[i]
+		objs = append(objs, &charts[i])
+	}
+	for _, s := range steps {
+		objs = append(objs, s)
+	}
+	og := dag.ObjectGraph{}
+	if err := og.Build(objs); err != nil {
+		return nil, errors.Wrap(err, "error building graph")
+	}
+	_, levels, err := og.Info()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting graph info")
+	}
+	out := []orderedChart{}
+	for i := len(levels) - 1; i >= 0; i-- {
+		lvl := []orderedChart{}
+		for _, obj := range levels[i] {
+			if c, ok := cmap[obj.Name()]; ok {
+				lvl = append(lvl, orderedChart{chart: c, level: uint(i)})
+			}
+		}
+		out = append(out, lvl...)
+	}
+	return out, nil
+}
@@ -0,0 +1,139 @@
+package metahelm
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGraphStatus(t *testing.T) {
+	fkc := fakeKubernetesClientset(t, DefaultK8sNamespace, testCharts)
+	cfg := fakeHelmConfiguration(t)
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fkc,
+		HCfg: cfg,
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	rm, err := m.Install(context.Background(), testCharts)
+	if err != nil {
+		t.Fatalf("error installing: %v", err)
+	}
+	sl, err := m.Status(context.Background(), rm, testCharts)
+	if err != nil {
+		t.Fatalf("error getting status: %v", err)
+	}
+	if len(sl) != len(testCharts) {
+		t.Fatalf("unexpected status length: %v", len(sl))
+	}
+	if sl[0].Title != "redis" || sl[len(sl)-1].Title != "toplevel" {
+		t.Fatalf("bad DAG order: first: %v, last: %v", sl[0].Title, sl[len(sl)-1].Title)
+	}
+	for _, s := range sl {
+		if s.Error != "" {
+			t.Fatalf("%v: unexpected error: %v", s.Title, s.Error)
+		}
+		if s.ReleaseStatus != "deployed" {
+			t.Fatalf("%v: bad release status: %v", s.Title, s.ReleaseStatus)
+		}
+		if s.Revision != 1 {
+			t.Fatalf("%v: bad revision: %v", s.Title, s.Revision)
+		}
+		if !s.Healthy {
+			t.Fatalf("%v: should have been healthy", s.Title)
+		}
+		if s.Title == "anotherthing" && (s.ReadyReplicas != 1 || s.DesiredReplicas != 1) {
+			t.Fatalf("%v: bad replicas: %v/%v", s.Title, s.ReadyReplicas, s.DesiredReplicas)
+		}
+	}
+}
+
+func TestGraphStatusNotInstalled(t *testing.T) {
+	fkc := fakeKubernetesClientset(t, DefaultK8sNamespace, testCharts)
+	cfg := fakeHelmConfiguration(t)
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fkc,
+		HCfg: cfg,
+	}
+	rm := ReleaseMap{}
+	for _, c := range testCharts {
+		rm[c.Title] = ReleaseName(c.Title)
+	}
+	sl, err := m.Status(context.Background(), rm, testCharts)
+	if err != nil {
+		t.Fatalf("error getting status: %v", err)
+	}
+	for _, s := range sl {
+		if s.ReleaseStatus != ReleaseNotInstalled {
+			t.Fatalf("%v: bad release status: %v", s.Title, s.ReleaseStatus)
+		}
+		if s.Healthy {
+			t.Fatalf("%v: should not have been healthy", s.Title)
+		}
+	}
+	delete(rm, "redis")
+	if _, err := m.Status(context.Background(), rm, testCharts); err == nil {
+		t.Fatalf("should have failed with missing release")
+	}
+}
+
+func TestDAGOrderPriority(t *testing.T) {
+	charts := []Chart{
+		Chart{Title: "app", Location: "testdata/chart", DependencyList: []string{"cache", "db"}},
+		Chart{Title: "cache", Location: "testdata/chart"},
+		Chart{Title: "db", Location: "testdata/chart", StartPriority: 10},
+	}
+	ordered, err := dagOrder(charts)
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	titles := []string{}
+	for _, oc := range ordered {
+		titles = append(titles, oc.chart.Title)
+	}
+	if strings.Join(titles, ",") != "db,cache,app" {
+		t.Fatalf("bad order: %v", titles)
+	}
+}
+
+func TestGraphStatusUnsetReplicas(t *testing.T) {
+	fkc := fakeKubernetesClientset(t, DefaultK8sNamespace, testCharts)
+	cfg := fakeHelmConfiguration(t)
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fkc,
+		HCfg: cfg,
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	rm, err := m.Install(context.Background(), testCharts)
+	if err != nil {
+		t.Fatalf("error installing: %v", err)
+	}
+	d, err := fkc.AppsV1().Deployments(DefaultK8sNamespace).Get(context.Background(), "anotherthing", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting deployment: %v", err)
+	}
+	d.Spec.Replicas = nil
+	if _, err := fkc.AppsV1().Deployments(DefaultK8sNamespace).Update(context.Background(), d, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("error updating deployment: %v", err)
+	}
+	sl, err := m.Status(context.Background(), rm, testCharts)
+	if err != nil {
+		t.Fatalf("error getting status: %v", err)
+	}
+	for _, s := range sl {
+		if s.Title != "anotherthing" {
+			continue
+		}
+		if s.Error != "" {
+			t.Fatalf("unexpected error: %v", s.Error)
+		}
+		if s.DesiredReplicas != 1 || !s.Healthy {
+			t.Fatalf("unset replicas should default to 1: desired: %v, healthy: %v", s.DesiredReplicas, s.Healthy)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package metahelm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/graphext/metahelm/pkg/dag"
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+// Step is a graph node that is not a chart (a Job that must complete, a resource that must exist, etc). Steps participate in dependencies
+// like charts (charts may depend on steps and vice versa) and are executed by the graph walker when all their dependencies are satisfied.
+type Step interface {
+	dag.GraphObject
+	// Run executes the step in namespace and blocks until it has succeeded, failed or ctx is cancelled.
+	// Run may return a ChartError to provide details about failed pods.
+	Run(ctx context.Context, m *Manager, namespace string) error
+}
+
+// WithSteps adds non-chart steps to the chart graph
+func WithSteps(steps ...Step) InstallOption {
+	return func(op *options) {
+		op.steps = append(op.steps, steps...)
+	}
+}
+
+// JobStep is a step that runs a Kubernetes Job to completion. Any existing Job with the same name is deleted first, so the Job is run on every install/upgrade.
+type JobStep struct {
+	Title          string        // unique name for this step (must not collide with any chart or other step)
+	Job            batchv1.Job   // Job to run. If the name is empty, Title is used. The namespace is always set to the graph namespace.
+	WaitTimeout    time.Duration // how long to wait for the Job to complete. If unset, DefaultDeploymentTimeout is used
+	DependencyList []string
+	StartPriority  int            // steps with higher priority are started first within a graph level
+	ResourceTokens map[string]int // tokens of shared resources held while running the step (see WithResourceLimits)
+}
+
+var _ Step = &JobStep{}
+
+func (js *JobStep) Name() string {
+	return js.Title
+}
+
+func (js *JobStep) String() string {
+	return fmt.Sprintf("\"%v\"", js.Title)
+}
+
+func (js *JobStep) Dependencies() []string {
+	return js.DependencyList
+}
+
+func (js *JobStep) Priority() int {
+	return js.StartPriority
+}
+
+func (js *JobStep) Resources() map[string]int {
+	return js.ResourceTokens
+}
+
+// Run creates the Job and waits for it to complete. If the Job fails or does not complete within WaitTimeout, a ChartError is returned
+// with the failed pods of the Job in FailedJobs.
+func (js *JobStep) Run(ctx context.Context, m *Manager, namespace string) error {
+	job := js.Job.DeepCopy()
+	job.Namespace = namespace
+	if job.Name == "" {
+		job.Name = sanitizeName(js.Title)
+	}
+	timeout := js.WaitTimeout
+	if timeout == 0 {
+		timeout = DefaultDeploymentTimeout
+	}
+	jobs := m.K8c.BatchV1().Jobs(namespace)
+	bg := metav1.DeletePropagationBackground
+	if err := jobs.Delete(ctx, job.Name, metav1.DeleteOptions{PropagationPolicy: &bg}); err != nil && !kerrors.IsNotFound(err) {
+		return errors.Wrap(err, "error deleting existing job")
+	}
+	m.log("%v: creating job %v", js.Title, job.Name)
+	// a previous instance of the job may still be terminating
+	err := wait.PollImmediateWithContext(ctx, ChartWaitPollInterval, timeout, func(ctx context.Context) (bool, error) {
+		_, err := jobs.Create(ctx, job, metav1.CreateOptions{})
+		if err != nil {
+			if kerrors.IsAlreadyExists(err) {
+				m.log("%v: job %v still exists (retrying)", js.Title, job.Name)
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error creating job")
+	}
+	var failed bool
+	err = wait.PollImmediateWithContext(ctx, ChartWaitPollInterval, timeout, func(ctx context.Context) (bool, error) {
+		j, err := jobs.Get(ctx, job.Name, metav1.GetOptions{})
+		if err != nil {
+			m.log("%v: error getting job (retrying): %v", js.Title, err)
+			return false, nil
+		}
+		for _, c := range j.Status.Conditions {
+			if c.Status != corev1.ConditionTrue {
+				continue
+			}
+			switch c.Type {
+			case batchv1.JobComplete:
+				return true, nil
+			case batchv1.JobFailed:
+				failed = true
+				return false, fmt.Errorf("job failed: %v: %v", c.Reason, c.Message)
+			}
+		}
+		m.log("%v: job %v: %v active, %v succeeded, %v failed", js.Title, job.Name, j.Status.Active, j.Status.Succeeded, j.Status.Failed)
+		return false, nil
+	})
+	if err == nil {
+		m.log("%v: job completed", js.Title)
+		return nil
+	}
+	if !failed {
+		err = errors.Wrap(err, "error waiting for job to complete")
+	}
+	ce := NewChartError(err)
+	pods, failedpods, err2 := newPodResolver(namespace, m.K8c).failedPods(ctx, "Job", job.Name, MaxPodLogLines)
+	if err2 != nil {
+		m.log("error populating chart error from job: %v", err2)
+		return err
+	}
+	ce.FailedJobs[job.Name] = failedpods
+	if len(failedpods) > 0 {
+		ce.populateEvents(ctx, namespace, "Job", job.Name, pods, failedpods, m.K8c)
+	}
+	return ce
+}
+
+// WaitForResource is a step that waits for an arbitrary Kubernetes resource to exist and, optionally, for a status condition of the resource
+// to be True (eg, a CustomResourceDefinition to be Established, or a Secret created by an operator to exist)
+type WaitForResource struct {
+	Title        string // unique name for this step (must not collide with any chart or other step)
+	APIVersion   string // API version of the resource (eg, "v1", "apiextensions.k8s.io/v1")
+	Kind         string // kind of the resource (eg, "Secret", "CustomResourceDefinition")
+	ResourceName string // resource name
+	// Namespace is the namespace of the resource. If empty, the graph namespace is used. Ignored for cluster-scoped resources.
+	Namespace string
+	// Condition is the type of a status condition (.status.conditions) that must be True (eg, "Established", "Ready"). If empty, the resource only needs to exist.
+	Condition      string
+	WaitTimeout    time.Duration // how long to wait for the resource. If unset, DefaultDeploymentTimeout is used
+	DependencyList []string
+	StartPriority  int            // steps with higher priority are started first within a graph level
+	ResourceTokens map[string]int // tokens of shared resources held while running the step (see WithResourceLimits)
+}
+
+var _ Step = &WaitForResource{}
+
+func (wr *WaitForResource) Name() string {
+	return wr.Title
+}
+
+func (wr *WaitForResource) String() string {
+	return fmt.Sprintf("\"%v\"", wr.Title)
+}
+
+func (wr *WaitForResource) Dependencies() []string {
+	return wr.DependencyList
+}
+
+func (wr *WaitForResource) Priority() int {
+	return wr.StartPriority
+}
+
+func (wr *WaitForResource) Resources() map[string]int {
+	return wr.ResourceTokens
+}
+
+// Run polls until the resource exists and satisfies Condition (if set), or WaitTimeout elapses
+func (wr *WaitForResource) Run(ctx context.Context, m *Manager, namespace string) error {
+	gv, err := schema.ParseGroupVersion(wr.APIVersion)
+	if err != nil {
+		return errors.Wrap(err, "error parsing api version")
+	}
+	if wr.Namespace != "" {
+		namespace = wr.Namespace
+	}
+	dc, mapper, err := m.dynamicClient()
+	if err != nil {
+		return err
+	}
+	timeout := wr.WaitTimeout
+	if timeout == 0 {
+		timeout = DefaultDeploymentTimeout
+	}
+	desc := fmt.Sprintf("%v %v", wr.Kind, wr.ResourceName)
+	if wr.Condition != "" {
+		desc += " (condition " + wr.Condition + ")"
+	}
+	m.log("%v: waiting for %v", wr.Title, desc)
+	err = wait.PollImmediateWithContext(ctx, ChartWaitPollInterval, timeout, func(ctx context.Context) (bool, error) {
+		// the mapping is resolved on each attempt since the kind may be provided by a CRD that isn't established yet
+		mapping, err := mapper.RESTMapping(schema.GroupKind{Group: gv.Group, Kind: wr.Kind}, gv.Version)
+		if err != nil {
+			if rm, ok := mapper.(meta.ResettableRESTMapper); ok {
+				rm.Reset()
+			}
+			m.log("%v: error getting resource mapping (retrying): %v", wr.Title, err)
+			return false, nil
+		}
+		var ri dynamic.ResourceInterface = dc.Resource(mapping.Resource)
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			ri = dc.Resource(mapping.Resource).Namespace(namespace)
+		}
+		obj, err := ri.Get(ctx, wr.ResourceName, metav1.GetOptions{})
+		if err != nil {
+			if !kerrors.IsNotFound(err) {
+				m.log("%v: error getting resource (retrying): %v", wr.Title, err)
+			}
+			return false, nil
+		}
+		if wr.Condition == "" {
+			return true, nil
+		}
+		return conditionTrue(obj, wr.Condition), nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error waiting for %v", desc)
+	}
+	m.log("%v: %v is ready", wr.Title, desc)
+	return nil
+}
+
+// conditionTrue returns whether obj has a status condition of type ctype with status True
+func conditionTrue(obj *unstructured.Unstructured, ctype string) bool {
+	conds, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conds {
+		cm, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if cm["type"] == ctype && cm["status"] == string(metav1.ConditionTrue) {
+			return true
+		}
+	}
+	return false
+}
+
+// dynamicClient returns the dynamic client and REST mapper of the Manager, or obtains them from the Helm configuration if they are not set
+func (m *Manager) dynamicClient() (dynamic.Interface, meta.RESTMapper, error) {
+	if m.Dynamic != nil && m.RESTMapper != nil {
+		return m.Dynamic, m.RESTMapper, nil
+	}
+	if m.HCfg == nil || m.HCfg.RESTClientGetter == nil {
+		return nil, nil, errors.New("dynamic client and REST mapper are not set and Helm configuration has no REST client getter")
+	}
+	dc := m.Dynamic
+	if dc == nil {
+		rc, err := m.HCfg.RESTClientGetter.ToRESTConfig()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error getting REST config")
+		}
+		dc, err = dynamic.NewForConfig(rc)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error getting dynamic client")
+		}
+	}
+	mapper := m.RESTMapper
+	if mapper == nil {
+		var err error
+		mapper, err = m.HCfg.RESTClientGetter.ToRESTMapper()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error getting REST mapper")
+		}
+	}
+	return dc, mapper, nil
+}
@@ -0,0 +1,226 @@
+package metahelm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+// jobReactor sets the given condition on jobs when they are created
+func jobReactor(kc kubernetes.Interface, ctype batchv1.JobConditionType) {
+	kc.(*k8sfake.Clientset).PrependReactor("create", "jobs", func(action ktesting.Action) (bool, runtime.Object, error) {
+		j := action.(ktesting.CreateAction).GetObject().(*batchv1.Job)
+		j.Status.Conditions = []batchv1.JobCondition{{Type: ctype, Status: corev1.ConditionTrue, Reason: "Test"}}
+		return false, nil, nil
+	})
+}
+
+var crdGVR = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+func testRESTMapper() meta.RESTMapper {
+	rm := meta.NewDefaultRESTMapper(nil)
+	rm.Add(schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}, meta.RESTScopeRoot)
+	rm.Add(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, meta.RESTScopeNamespace)
+	return rm
+}
+
+func testCRD(name string, established bool) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("apiextensions.k8s.io/v1")
+	obj.SetKind("CustomResourceDefinition")
+	obj.SetName(name)
+	status := "False"
+	if established {
+		status = "True"
+	}
+	unstructured.SetNestedSlice(obj.Object, []interface{}{map[string]interface{}{"type": "Established", "status": status}}, "status", "conditions")
+	return obj
+}
+
+func TestGraphInstallWithSteps(t *testing.T) {
+	charts := []Chart{
+		Chart{
+			Title:                      "app",
+			Location:                   "testdata/chart",
+			DeploymentHealthIndication: IgnorePodHealth,
+			DependencyList:             []string{"seed"},
+		},
+		Chart{
+			Title:                      "db",
+			Location:                   "testdata/chart",
+			DeploymentHealthIndication: IgnorePodHealth,
+		},
+	}
+	steps := []Step{
+		&JobStep{Title: "seed", WaitTimeout: 5 * time.Second, DependencyList: []string{"db", "crd"}},
+		&WaitForResource{Title: "crd", APIVersion: "apiextensions.k8s.io/v1", Kind: "CustomResourceDefinition", ResourceName: "foos.example.com", Condition: "Established", WaitTimeout: 5 * time.Second},
+	}
+	fkc := fakeKubernetesClientset(t, DefaultK8sNamespace, charts)
+	jobReactor(fkc, batchv1.JobComplete)
+	scheme := runtime.NewScheme()
+	dc := dynfake.NewSimpleDynamicClientWithCustomListKinds(scheme, map[schema.GroupVersionResource]string{crdGVR: "CustomResourceDefinitionList"}, testCRD("foos.example.com", true))
+	m := Manager{
+		LogF:       t.Logf,
+		K8c:        fkc,
+		HCfg:       fakeHelmConfiguration(t),
+		Dynamic:    dc,
+		RESTMapper: testRESTMapper(),
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	if err := ValidateCharts(charts, steps...); err != nil {
+		t.Fatalf("charts should have validated: %v", err)
+	}
+	rm, err := m.Install(context.Background(), charts, WithSteps(steps...))
+	if err != nil {
+		t.Fatalf("error installing: %v", err)
+	}
+	if len(rm) != 2 {
+		t.Fatalf("bad release map: %v", rm)
+	}
+	if _, err := fkc.BatchV1().Jobs(DefaultK8sNamespace).Get(context.Background(), "seed", metav1.GetOptions{}); err != nil {
+		t.Fatalf("job should have been created: %v", err)
+	}
+	// the job is recreated on upgrade
+	if err := m.Upgrade(context.Background(), rm, charts, WithSteps(steps...)); err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	sl, err := m.Status(context.Background(), rm, charts, WithSteps(steps...))
+	if err != nil {
+		t.Fatalf("error getting status: %v", err)
+	}
+	if len(sl) != 2 || sl[0].Title != "db" || sl[1].Title != "app" {
+		t.Fatalf("bad status: %+v", sl)
+	}
+}
+
+func TestJobStepFailure(t *testing.T) {
+	fkc := fakeKubernetesClientset(t, DefaultK8sNamespace, nil)
+	jobReactor(fkc, batchv1.JobFailed)
+	p := &corev1.Pod{}
+	p.Name = "seed-1234"
+	p.Namespace = DefaultK8sNamespace
+	p.Labels = map[string]string{"job-name": "seed"}
+	p.Status = corev1.PodStatus{
+		Phase: corev1.PodFailed,
+		ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "seed", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 2}}},
+		},
+	}
+	if _, err := fkc.CoreV1().Pods(DefaultK8sNamespace).Create(context.Background(), p, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("error creating pod: %v", err)
+	}
+	m := Manager{
+		LogF: t.Logf,
+		K8c:  fkc,
+		HCfg: fakeHelmConfiguration(t),
+	}
+	ChartWaitPollInterval = 1 * time.Second
+	js := &JobStep{Title: "seed", WaitTimeout: 5 * time.Second}
+	js.Job.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"job-name": "seed"}}
+	err := js.Run(context.Background(), &m, DefaultK8sNamespace)
+	if err == nil {
+		t.Fatalf("job step should have failed")
+	}
+	ce, ok := err.(ChartError)
+	if !ok {
+		t.Fatalf("error should have been a ChartError: %T: %v", err, err)
+	}
+	if fps := ce.FailedJobs["seed"]; len(fps) != 1 || fps[0].Name != "seed-1234" {
+		t.Fatalf("bad failed jobs: %+v", ce.FailedJobs)
+	}
+}
+
+func TestWaitForResource(t *testing.T) {
+	scheme := runtime.NewScheme()
+	secret := &unstructured.Unstructured{}
+	secret.SetAPIVersion("v1")
+	secret.SetKind("Secret")
+	secret.SetName("creds")
+	secret.SetNamespace("foo")
+	dc := dynfake.NewSimpleDynamicClientWithCustomListKinds(scheme, map[schema.GroupVersionResource]string{crdGVR: "CustomResourceDefinitionList"}, testCRD("bars.example.com", false), secret)
+	m := Manager{
+		LogF:       t.Logf,
+		Dynamic:    dc,
+		RESTMapper: testRESTMapper(),
+	}
+	ChartWaitPollInterval = 100 * time.Millisecond
+	cases := []struct {
+		name  string
+		wr    WaitForResource
+		isErr bool
+	}{
+		{"secret exists", WaitForResource{Title: "s", APIVersion: "v1", Kind: "Secret", ResourceName: "creds"}, false},
+		{"secret in other namespace", WaitForResource{Title: "s", APIVersion: "v1", Kind: "Secret", ResourceName: "creds", Namespace: "bar"}, true},
+		{"crd not established", WaitForResource{Title: "c", APIVersion: "apiextensions.k8s.io/v1", Kind: "CustomResourceDefinition", ResourceName: "bars.example.com", Condition: "Established"}, true},
+		{"crd exists", WaitForResource{Title: "c", APIVersion: "apiextensions.k8s.io/v1", Kind: "CustomResourceDefinition", ResourceName: "bars.example.com"}, false},
+		{"unknown kind", WaitForResource{Title: "u", APIVersion: "example.com/v1", Kind: "Foo", ResourceName: "foo"}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.wr.WaitTimeout = 500 * time.Millisecond
+			err := c.wr.Run(context.Background(), &m, "foo")
+			if err != nil && !c.isErr {
+				t.Fatalf("should have succeeded: %v", err)
+			}
+			if err == nil && c.isErr {
+				t.Fatalf("should have failed")
+			}
+		})
+	}
+}
+
+func TestValidateChartsWithSteps(t *testing.T) {
+	charts := []Chart{
+		Chart{Title: "app", Location: "testdata/chart", DependencyList: []string{"seed"}},
+	}
+	if err := ValidateCharts(charts); err == nil {
+		t.Fatalf("should have failed with missing step")
+	}
+	if err := ValidateCharts(charts, &JobStep{Title: "seed"}); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	if err := ValidateCharts(charts, &JobStep{Title: "seed"}, &JobStep{Title: "app"}); err == nil {
+		t.Fatalf("should have failed with duplicate name")
+	}
+}
+
+func TestStepsCancel(t *testing.T) {
+	dc := dynfake.NewSimpleDynamicClient(runtime.NewScheme())
+	m := Manager{
+		LogF:       t.Logf,
+		K8c:        fakeKubernetesClientset(t, DefaultK8sNamespace, nil),
+		HCfg:       fakeHelmConfiguration(t),
+		Dynamic:    dc,
+		RESTMapper: testRESTMapper(),
+	}
+	ChartWaitPollInterval = 100 * time.Millisecond
+	steps := []Step{
+		&WaitForResource{Title: "s", APIVersion: "v1", Kind: "Secret", ResourceName: "creds", WaitTimeout: time.Minute},
+		&JobStep{Title: "seed", WaitTimeout: time.Minute}, // the fake job never completes
+	}
+	for _, s := range steps {
+		t.Run(s.Name(), func(t *testing.T) {
+			ctx, cf := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cf()
+			start := time.Now()
+			if err := s.Run(ctx, &m, DefaultK8sNamespace); err == nil {
+				t.Fatalf("should have failed")
+			}
+			if d := time.Since(start); d > 10*time.Second {
+				t.Fatalf("should have stopped when the context was cancelled: %v", d)
+			}
+		})
+	}
+}
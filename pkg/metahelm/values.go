@@ -0,0 +1,211 @@
+package metahelm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chartutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ValuesSource is a source of chart values that is read when the chart is installed or upgraded, for values that must not be stored in
+// plaintext. Exactly one of SOPSFile, Secret or ConfigMap must be set. The values are kept in memory and are never logged.
+type ValuesSource struct {
+	SOPSFile  string        // path of a SOPS-encrypted YAML values file, decrypted with SOPSCommand (see WithAgeKeyFile)
+	Secret    *ObjectKeyRef // key of a Secret in the cluster
+	ConfigMap *ObjectKeyRef // key of a ConfigMap in the cluster
+}
+
+// ObjectKeyRef references a key of a Secret or ConfigMap
+type ObjectKeyRef struct {
+	Name      string
+	Namespace string // if empty, the graph namespace is used
+	Key       string
+	// Path is the values path (keys separated by dots, eg "postgres.auth.password") set to the value of Key. If empty, the value of Key must be
+	// a YAML values document.
+	Path string
+}
+
+// SOPSCommand is the sops CLI used to decrypt SOPS values files. It must be in the PATH if any chart has a SOPS values file.
+var SOPSCommand = "sops"
+
+// checkSOPS verifies that SOPSCommand can be run if any of the charts has a SOPS values file, so that a missing sops fails before any chart
+// is installed
+func checkSOPS(charts []Chart) error {
+	for _, c := range charts {
+		for _, vs := range c.ValuesFrom {
+			if vs.SOPSFile == "" {
+				continue
+			}
+			if _, err := exec.LookPath(SOPSCommand); err != nil {
+				return errors.Wrapf(err, "%v is required to decrypt the SOPS values files of chart %v", SOPSCommand, c.Title)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// WithAgeKeyFile sets the age key file used to decrypt SOPS values files (passed to sops as SOPS_AGE_KEY_FILE). If unset, sops uses its
+// own configuration.
+func WithAgeKeyFile(path string) InstallOption {
+	return func(op *options) {
+		op.ageKeyFile = path
+	}
+}
+
+// Validate verifies that exactly one source is set and that the referenced keys are complete
+func (vs ValuesSource) Validate() error {
+	n := 0
+	for _, set := range []bool{vs.SOPSFile != "", vs.Secret != nil, vs.ConfigMap != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of sops file, secret or config map is required")
+	}
+	for _, ref := range []*ObjectKeyRef{vs.Secret, vs.ConfigMap} {
+		if ref != nil && (ref.Name == "" || ref.Key == "") {
+			return errors.New("name and key are required")
+		}
+	}
+	return nil
+}
+
+// String describes the source without its values
+func (vs ValuesSource) String() string {
+	switch {
+	case vs.SOPSFile != "":
+		return "sops file " + vs.SOPSFile
+	case vs.Secret != nil:
+		return fmt.Sprintf("secret %v key %v", vs.Secret.Name, vs.Secret.Key)
+	case vs.ConfigMap != nil:
+		return fmt.Sprintf("config map %v key %v", vs.ConfigMap.Name, vs.ConfigMap.Key)
+	}
+	return "empty values source"
+}
+
+// chartValues returns the values of the chart: ValueOverrides, overridden by each of ValuesFrom in order
+func (m *Manager) chartValues(ctx context.Context, c *Chart, ops *options) (map[string]interface{}, error) {
+	vals, err := chartutil.ReadValues(c.ValueOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("error reading value overrides from raw YAML: %w", err)
+	}
+	for _, vs := range c.ValuesFrom {
+		sv, err := m.sourceValues(ctx, vs, ops)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading values from %v", vs)
+		}
+		vals = mergeValues(vals, sv)
+	}
+	return vals, nil
+}
+
+// sourceValues reads the values of vs. Errors don't include the contents of the source.
+func (m *Manager) sourceValues(ctx context.Context, vs ValuesSource, ops *options) (map[string]interface{}, error) {
+	if err := vs.Validate(); err != nil {
+		return nil, err
+	}
+	if vs.SOPSFile != "" {
+		b, err := m.decryptSOPS(ctx, vs.SOPSFile, ops.ageKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		vals, err := chartutil.ReadValues(b)
+		if err != nil {
+			return nil, errors.New("decrypted file is not a YAML values document")
+		}
+		return vals, nil
+	}
+	var v []byte
+	ref := vs.Secret
+	if ref != nil {
+		ns := ref.Namespace
+		if ns == "" {
+			ns = ops.k8sNamespace
+		}
+		s, err := m.K8c.CoreV1().Secrets(ns).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting secret")
+		}
+		var ok bool
+		if v, ok = s.Data[ref.Key]; !ok {
+			return nil, fmt.Errorf("key not found in secret %v/%v: %v", ns, ref.Name, ref.Key)
+		}
+	} else {
+		ref = vs.ConfigMap
+		ns := ref.Namespace
+		if ns == "" {
+			ns = ops.k8sNamespace
+		}
+		cm, err := m.K8c.CoreV1().ConfigMaps(ns).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting config map")
+		}
+		if s, ok := cm.Data[ref.Key]; ok {
+			v = []byte(s)
+		} else if v, ok = cm.BinaryData[ref.Key]; !ok {
+			return nil, fmt.Errorf("key not found in config map %v/%v: %v", ns, ref.Name, ref.Key)
+		}
+	}
+	if ref.Path != "" {
+		return pathValues(ref.Path, string(v)), nil
+	}
+	vals, err := chartutil.ReadValues(v)
+	if err != nil {
+		return nil, fmt.Errorf("key %v is not a YAML values document (set a path to use its value as a string)", ref.Key)
+	}
+	return vals, nil
+}
+
+// decryptSOPS returns the decrypted contents of the SOPS file f. The plaintext is only held in memory.
+func (m *Manager) decryptSOPS(ctx context.Context, f, ageKeyFile string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, SOPSCommand, "--decrypt", "--input-type", "yaml", "--output-type", "yaml", f)
+	cmd.Env = os.Environ()
+	if ageKeyFile != "" {
+		cmd.Env = append(cmd.Env, "SOPS_AGE_KEY_FILE="+ageKeyFile)
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.Wrapf(err, "error decrypting with %v: %v", SOPSCommand, msg)
+		}
+		return nil, errors.Wrapf(err, "error decrypting with %v", SOPSCommand)
+	}
+	return stdout.Bytes(), nil
+}
+
+// pathValues returns values with value set at path (keys separated by dots)
+func pathValues(path, value string) map[string]interface{} {
+	keys := strings.Split(path, ".")
+	var v interface{} = value
+	for i := len(keys) - 1; i >= 0; i-- {
+		v = map[string]interface{}{keys[i]: v}
+	}
+	return v.(map[string]interface{})
+}
+
+// mergeValues merges override into base recursively: values in override take precedence, and nested maps are merged
+func mergeValues(base, override map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(base))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range override {
+		if om, ok := v.(map[string]interface{}); ok {
+			if bm, ok := out[k].(map[string]interface{}); ok {
+				out[k] = mergeValues(bm, om)
+				continue
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,131 @@
+package metahelm
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestChartValues(t *testing.T) {
+	kc := k8sfake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "foo"},
+			Data: map[string][]byte{
+				"password":    []byte("s3cr3t"),
+				"values.yaml": []byte("db:\n  user: app\n  port: 5433\n"),
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared", Namespace: "infra"},
+			Data:       map[string]string{"host": "db.infra"},
+		},
+	)
+	// fake sops that checks the age key file and prints the decrypted values
+	dir := t.TempDir()
+	sops := filepath.Join(dir, "sops")
+	script := "#!/bin/sh\n[ \"$SOPS_AGE_KEY_FILE\" = key.txt ] || { echo 'no age key' >&2; exit 1; }\nprintf 'api:\\n  token: t0k3n\\n'\n"
+	if err := ioutil.WriteFile(sops, []byte(script), 0755); err != nil {
+		t.Fatalf("error writing fake sops: %v", err)
+	}
+	defer func(cmd string) { SOPSCommand = cmd }(SOPSCommand)
+	SOPSCommand = sops
+	m := Manager{LogF: t.Logf, K8c: kc}
+	ops := &options{k8sNamespace: "foo", ageKeyFile: "key.txt"}
+	c := &Chart{
+		Title:          "app",
+		ValueOverrides: []byte("db:\n  user: default\n  host: localhost\nreplicas: 2\n"),
+		ValuesFrom: []ValuesSource{
+			{Secret: &ObjectKeyRef{Name: "db", Key: "values.yaml"}},
+			{Secret: &ObjectKeyRef{Name: "db", Key: "password", Path: "db.password"}},
+			{ConfigMap: &ObjectKeyRef{Name: "shared", Namespace: "infra", Key: "host", Path: "db.host"}},
+			{SOPSFile: "secrets.enc.yaml"},
+		},
+	}
+	vals, err := m.chartValues(context.Background(), c, ops)
+	if err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	expected := map[string]interface{}{
+		"db":       map[string]interface{}{"user": "app", "port": float64(5433), "host": "db.infra", "password": "s3cr3t"},
+		"replicas": float64(2),
+		"api":      map[string]interface{}{"token": "t0k3n"},
+	}
+	if !reflect.DeepEqual(vals, expected) {
+		t.Fatalf("bad values: %v", vals)
+	}
+
+	ops.ageKeyFile = ""
+	c.ValuesFrom = []ValuesSource{{SOPSFile: "secrets.enc.yaml"}}
+	if _, err := m.chartValues(context.Background(), c, ops); err == nil || !strings.Contains(err.Error(), "no age key") {
+		t.Fatalf("should have failed without the age key: %v", err)
+	}
+	cases := []struct {
+		name string
+		vs   ValuesSource
+	}{
+		{"not a values document", ValuesSource{Secret: &ObjectKeyRef{Name: "db", Key: "password"}}},
+		{"missing key", ValuesSource{Secret: &ObjectKeyRef{Name: "db", Key: "token"}}},
+		{"missing secret", ValuesSource{Secret: &ObjectKeyRef{Name: "db", Namespace: "bar", Key: "password"}}},
+		{"two sources", ValuesSource{SOPSFile: "a.yaml", ConfigMap: &ObjectKeyRef{Name: "shared", Key: "host"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c.ValuesFrom = []ValuesSource{tc.vs}
+			_, err := m.chartValues(context.Background(), c, ops)
+			if err == nil {
+				t.Fatalf("should have failed")
+			}
+			if strings.Contains(err.Error(), "s3cr3t") {
+				t.Fatalf("error includes the secret value: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckSOPS(t *testing.T) {
+	dir := t.TempDir()
+	sops := filepath.Join(dir, "sops")
+	if err := ioutil.WriteFile(sops, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("error writing fake sops: %v", err)
+	}
+	defer func(cmd string) { SOPSCommand = cmd }(SOPSCommand)
+	charts := []Chart{
+		Chart{Title: "app", Location: "/foo", ValuesFrom: []ValuesSource{{SOPSFile: "secrets.enc.yaml"}}},
+	}
+	SOPSCommand = sops
+	if err := checkSOPS(charts); err != nil {
+		t.Fatalf("should have succeeded: %v", err)
+	}
+	SOPSCommand = filepath.Join(dir, "missing")
+	if err := checkSOPS(charts); err == nil || !strings.Contains(err.Error(), "required to decrypt the SOPS values files of chart app") {
+		t.Fatalf("should have failed without sops: %v", err)
+	}
+	// validation doesn't need sops
+	if err := ValidateCharts(charts); err != nil {
+		t.Fatalf("validation should have succeeded without sops: %v", err)
+	}
+	// the install fails before any chart is installed
+	m := Manager{LogF: t.Logf, K8c: fakeKubernetesClientset(t, DefaultK8sNamespace, testCharts), HCfg: fakeHelmConfiguration(t)}
+	installed := []string{}
+	withSOPS := append([]Chart{}, testCharts...)
+	withSOPS[0].ValuesFrom = charts[0].ValuesFrom
+	cb := func(c Chart) InstallCallbackAction {
+		installed = append(installed, c.Title)
+		return Continue
+	}
+	if _, err := m.Install(context.Background(), withSOPS, WithInstallCallback(cb)); err == nil || len(installed) > 0 {
+		t.Fatalf("should have failed before installing: %v (installed: %v)", err, installed)
+	}
+	// charts without SOPS values files don't need sops
+	charts[0].ValuesFrom = nil
+	if err := checkSOPS(charts); err != nil {
+		t.Fatalf("should have succeeded without SOPS values files: %v", err)
+	}
+}